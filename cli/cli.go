@@ -3,7 +3,7 @@ package cli
 import (
 	"bufio"
 	"cadence/constants"
-	"cadence/server"
+	"cadence/protocol"
 	"cadence/utils"
 	"flag"
 	"fmt"
@@ -16,8 +16,20 @@ func main() {
 	// by default goes to local host port 6379
 	port := flag.String("port", constants.DefaultPort, "the port to connect to")
 	host := flag.String("host", "localhost", "the host to connect to")
+	reshardTo := flag.String("reshard", "", "instead of taking commands, move slots to this node (id or host:port) in the cluster the instance belongs to")
+	reshardFrom := flag.String("from", "all", "with --reshard, comma separated nodes (ids or host:port) to take the slots from, or all")
+	reshardSlots := flag.Int("slots", 0, "with --reshard, how many slots to move")
+	dryRun := flag.Bool("dry-run", false, "with --reshard, only print which slots would move")
 	flag.Parse()
 
+	if *reshardTo != "" {
+		if err := reshard(net.JoinHostPort(*host, *port), *reshardTo, *reshardFrom, *reshardSlots, *dryRun); err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	fmt.Printf("Initiating connection to Cadence instance at %s:%s...\n", *host, *port)
 
 	// connect to server
@@ -27,7 +39,7 @@ func main() {
 		return
 	}
 	defer conn.Close()
-	dataChannel := utils.ReadFromConn(conn, server.NewResponse)
+	dataChannel := utils.ReadRepliesFromConn(conn, protocol.NewResponse)
 
 	fmt.Println("Connected successfully! Enter commands:")
 
@@ -46,11 +58,11 @@ func main() {
 			// a) print help message
 			if strings.ToUpper(parts[0]) == "HELP" {
 				fmt.Println("The valid commands and their use cases are as follows: ")
-				fmt.Printf("%s - quickly check status of server (if alive should respond with %s)\n", server.Commands.STATUS, server.Responses.ALL_GOOD)
-				fmt.Printf("%s args - returns back args\n", server.Commands.ECHO)
-				fmt.Printf("%s - get info about DB instance\n", server.Commands.INFO)
-				fmt.Printf("%s key - get value (if not set, returns nil string)\n", server.Commands.GET)
-				fmt.Printf("%s key value [PX millis] - set value (optionally specify millis expiration)\n", server.Commands.GET)
+				fmt.Printf("%s - quickly check status of server (if alive should respond with %s)\n", protocol.Commands.STATUS, protocol.Responses.ALL_GOOD)
+				fmt.Printf("%s args - returns back args\n", protocol.Commands.ECHO)
+				fmt.Printf("%s - get info about DB instance\n", protocol.Commands.INFO)
+				fmt.Printf("%s key - get value (if not set, returns nil string)\n", protocol.Commands.GET)
+				fmt.Printf("%s key value [PX millis] - set value (optionally specify millis expiration)\n", protocol.Commands.GET)
 				//TODO: add delete
 				continue
 			}
@@ -69,6 +81,14 @@ func main() {
 				fmt.Println("Connection closed, exiting process...")
 				break
 			}
+			if response.Err != nil {
+				fmt.Println("(error)", response.Err)
+				continue
+			}
+			if response.Type == ':' {
+				fmt.Println("(integer)", response.Int)
+				continue
+			}
 			fmt.Println(response)
 		}
 	}
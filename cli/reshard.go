@@ -0,0 +1,241 @@
+package cli
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cadence/constants"
+	"cadence/protocol"
+	"cadence/utils"
+
+	"github.com/pkg/errors"
+)
+
+// RESHARD ------------------------------------------------------------------------------------
+// moves slots to a node in a running cluster. each slot is moved the same way:
+//  1. the node taking it marks it IMPORTING, and the node giving it up marks it MIGRATING - from then on,
+//     clients asking the old node for keys that have already moved are sent to the new one with ASK
+//  2. its keys are moved over with MIGRATE, a batch at a time, until there are none left
+//  3. both nodes (and every other node, which would otherwise hear of it through gossip) are told the
+//     new node serves it
+type clusterNode struct {
+	id      string
+	address string
+	slots   int
+}
+
+type slotMove struct {
+	slot int
+	from clusterNode
+	to   clusterNode
+}
+
+// sends a command to a node on a connection of its own, and waits for the reply
+func query(address string, args ...string) (utils.RESPValue, error) {
+	conn, err := net.DialTimeout("tcp", address, constants.CLUSTER_MIGRATE_TIMEOUT)
+	if err != nil {
+		return utils.RESPValue{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * constants.CLUSTER_MIGRATE_TIMEOUT))
+
+	responses := utils.ReadRepliesFromConn(conn, protocol.NewResponse)
+	if _, err := conn.Write(utils.BulkStringArraySerialize(args)); err != nil {
+		return utils.RESPValue{}, err
+	}
+	response, ok := <-responses
+	if !ok {
+		return utils.RESPValue{}, errors.Errorf("%s closed the connection", address)
+	}
+	if response.Err != nil {
+		return utils.RESPValue{}, errors.Errorf("%s: %s", address, response.Err)
+	}
+	return response.RESPValue, nil
+}
+
+// every node in the cluster, and which slots each serves, from CLUSTER NODES on the node at address
+func clusterNodes(address string) ([]clusterNode, map[string][]int, error) {
+	reply, err := query(address, protocol.Commands.CLUSTER, "NODES")
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes := []clusterNode{}
+	slots := map[string][]int{}
+	for _, line := range strings.Split(reply.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		node := clusterNode{id: fields[0], address: strings.Split(fields[1], "@")[0]}
+		for _, field := range fields[8:] {
+			start, end, isRange := strings.Cut(field, "-")
+			if !isRange {
+				end = start
+			}
+			first, err1 := strconv.Atoi(start)
+			last, err2 := strconv.Atoi(end)
+			if err1 != nil || err2 != nil {
+				return nil, nil, errors.Errorf("malformed slots %q from %s", field, address)
+			}
+			for slot := first; slot <= last; slot++ {
+				slots[node.id] = append(slots[node.id], slot)
+			}
+		}
+		node.slots = len(slots[node.id])
+		nodes = append(nodes, node)
+	}
+	return nodes, slots, nil
+}
+
+// finds a node by id or address
+func findNode(nodes []clusterNode, name string) (clusterNode, bool) {
+	for _, node := range nodes {
+		if node.id == name || node.address == name {
+			return node, true
+		}
+	}
+	return clusterNode{}, false
+}
+
+// picks count slots for to, from the from nodes (every other node serving slots if there are none).
+// each gives up a share in proportion to how many slots it serves, from the end of its slots.
+func planReshard(nodes []clusterNode, slots map[string][]int, to clusterNode, from []clusterNode, count int) ([]slotMove, error) {
+	if len(from) == 0 {
+		for _, node := range nodes {
+			if node.id != to.id && node.slots > 0 {
+				from = append(from, node)
+			}
+		}
+	}
+	total := 0
+	for _, node := range from {
+		if node.id == to.id {
+			return nil, errors.New("a node can't give slots to itself")
+		}
+		total += node.slots
+	}
+	if count <= 0 || count > total {
+		return nil, errors.Errorf("can only move between 1 and %d slots from those nodes", total)
+	}
+
+	// each gives up its share rounded down, then the biggest ones make up what rounding left over
+	sort.Slice(from, func(i, j int) bool { return from[i].slots > from[j].slots })
+	shares := make([]int, len(from))
+	left := count
+	for i, node := range from {
+		shares[i] = count * node.slots / total
+		left -= shares[i]
+	}
+	for i := 0; left > 0; i = (i + 1) % len(from) {
+		if shares[i] < from[i].slots {
+			shares[i]++
+			left--
+		}
+	}
+
+	moves := []slotMove{}
+	for i, node := range from {
+		owned := slots[node.id]
+		for _, slot := range owned[len(owned)-shares[i]:] {
+			moves = append(moves, slotMove{slot: slot, from: node, to: to})
+		}
+	}
+	return moves, nil
+}
+
+func moveSlot(move slotMove, nodes []clusterNode) error {
+	slot := strconv.Itoa(move.slot)
+	if _, err := query(move.to.address, protocol.Commands.CLUSTER, "SETSLOT", slot, "IMPORTING", move.from.address); err != nil {
+		return err
+	}
+	if _, err := query(move.from.address, protocol.Commands.CLUSTER, "SETSLOT", slot, "MIGRATING", move.to.address); err != nil {
+		return err
+	}
+
+	host, port, _ := net.SplitHostPort(move.to.address)
+	timeout := strconv.Itoa(int(constants.CLUSTER_MIGRATE_TIMEOUT.Milliseconds()))
+	for {
+		reply, err := query(move.from.address, protocol.Commands.CLUSTER, "GETKEYSINSLOT", slot, strconv.Itoa(constants.CLUSTER_MIGRATE_BATCH))
+		if err != nil {
+			return err
+		}
+		// (the keys are read as array elements, a key can have a newline in it)
+		if len(reply.Array) == 0 {
+			break
+		}
+		args := append([]string{protocol.Commands.MIGRATE, host, port, timeout}, reply.Strings()...)
+		if _, err := query(move.from.address, args...); err != nil {
+			return err
+		}
+	}
+
+	// the new node first, so it has the slot before the old one starts sending clients there
+	if _, err := query(move.to.address, protocol.Commands.CLUSTER, "SETSLOT", slot, "NODE", move.to.address); err != nil {
+		return err
+	}
+	if _, err := query(move.from.address, protocol.Commands.CLUSTER, "SETSLOT", slot, "NODE", move.to.address); err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if node.id != move.to.id && node.id != move.from.id {
+			if _, err := query(node.address, protocol.Commands.CLUSTER, "SETSLOT", slot, "NODE", move.to.address); err != nil {
+				fmt.Println("WARNING: could not tell", node.address, "about the move (it will hear through gossip),", err)
+			}
+		}
+	}
+	return nil
+}
+
+// moves count slots to the node to (id or address) from the nodes in from (comma separated ids or
+// addresses, or empty for every other node), in the cluster the node at address belongs to.
+// with dryRun, only prints the plan.
+func reshard(address string, to string, from string, count int, dryRun bool) error {
+	nodes, slots, err := clusterNodes(address)
+	if err != nil {
+		return err
+	}
+	target, found := findNode(nodes, to)
+	if !found {
+		return errors.Errorf("no node %q in the cluster", to)
+	}
+	sources := []clusterNode{}
+	for _, name := range strings.Split(from, ",") {
+		if name = strings.TrimSpace(name); name == "" || strings.EqualFold(name, "all") {
+			continue
+		}
+		source, found := findNode(nodes, name)
+		if !found {
+			return errors.Errorf("no node %q in the cluster", name)
+		}
+		sources = append(sources, source)
+	}
+	moves, err := planReshard(nodes, slots, target, sources, count)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Moving %d slots to %s (%s):\n", len(moves), target.address, target.id)
+	perSource := map[string]int{}
+	for _, move := range moves {
+		perSource[move.from.address]++
+	}
+	for source, n := range perSource {
+		fmt.Printf("  %d slots from %s\n", n, source)
+	}
+	if dryRun {
+		return nil
+	}
+
+	for i, move := range moves {
+		if err := moveSlot(move, nodes); err != nil {
+			return errors.Wrapf(err, "failed to move slot %d from %s (it may be left migrating, see CLUSTER SETSLOT STABLE)", move.slot, move.from.address)
+		}
+		fmt.Printf("Moved slot %d from %s (%d/%d)\n", move.slot, move.from.address, i+1, len(moves))
+	}
+	fmt.Println("Resharding done.")
+	return nil
+}
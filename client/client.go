@@ -0,0 +1,274 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cadence/constants"
+	"cadence/protocol"
+	"cadence/utils"
+
+	"github.com/pkg/errors"
+)
+
+/*
+A client for a Cadence master and its replicas, safe to use from many goroutines. Writes (and anything
+else sent with Do) go to the master, while GETs are spread over its replicas by a ReadPolicy - replicas
+can be slightly behind the master, so a read may not see a write made just before it. The replicas are
+found through the master's INFO, and rediscovered every RefreshInterval. Reads fall back to the master
+when no replica is synced and answering.
+
+Every node gets a pool of at most PoolSize connections. Each command waits until its context is done,
+or for Timeout if the context has no deadline.
+*/
+
+type Options struct {
+	Policy          ReadPolicy    // which replica reads go to, RoundRobin() if nil
+	Timeout         time.Duration // for each command to get its reply (when its context has no deadline), constants.CLIENT_TIMEOUT if zero
+	PoolSize        int           // most connections open to each node at once, constants.CLIENT_POOL_SIZE if zero
+	RefreshInterval time.Duration // how often the replicas are rediscovered, constants.CLIENT_REFRESH_INTERVAL if zero
+}
+
+// NODE ---------------------------------------------------------------------------------------
+type node struct {
+	address string
+	pool    *pool
+	status  ReplicaStatus
+	mutex   sync.Mutex // guards status
+}
+
+func newNode(address string, poolSize int) *node {
+	return &node{address: address, pool: newPool(address, poolSize), status: ReplicaStatus{Address: address}}
+}
+
+// runs commands on the node in one go, on a connection from its pool
+func (n *node) pipeline(ctx context.Context, timeout time.Duration, commands [][]string) ([]utils.RESPValue, []error, error) {
+	c, err := n.pool.get(ctx)
+	if err != nil {
+		n.record(err, 0)
+		return nil, nil, err
+	}
+	start := time.Now()
+	replies, errs, err := c.pipeline(ctx, timeout, commands)
+	n.pool.put(c)
+	n.record(err, time.Since(start))
+	return replies, errs, err
+}
+
+func (n *node) do(ctx context.Context, timeout time.Duration, args ...string) (utils.RESPValue, error) {
+	replies, errs, err := n.pipeline(ctx, timeout, [][]string{args})
+	if err != nil {
+		return utils.RESPValue{}, err
+	}
+	return replies[0], errs[0]
+}
+
+// keeps track of whether the node is answering, and how fast
+func (n *node) record(err error, elapsed time.Duration) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	var connErr *ConnectionError
+	if errors.As(err, &connErr) {
+		n.status.Healthy = false
+		return
+	}
+	if err != nil {
+		return // e.g. the caller's context was done before a connection was free - says nothing about the node
+	}
+	n.status.Healthy = true
+	if n.status.Latency == 0 {
+		n.status.Latency = elapsed
+	} else {
+		n.status.Latency = (4*n.status.Latency + elapsed) / 5
+	}
+}
+
+func (n *node) getStatus() ReplicaStatus {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.status
+}
+
+// CLIENT -------------------------------------------------------------------------------------
+type Client struct {
+	master   *node
+	replicas []*node
+	options  Options
+	stop     chan struct{}
+	mutex    sync.Mutex
+}
+
+// connects to the master at masterAddress (host:port) and finds its replicas
+func New(ctx context.Context, masterAddress string, options Options) (*Client, error) {
+	if options.Policy == nil {
+		options.Policy = RoundRobin()
+	}
+	if options.Timeout == 0 {
+		options.Timeout = constants.CLIENT_TIMEOUT
+	}
+	if options.PoolSize == 0 {
+		options.PoolSize = constants.CLIENT_POOL_SIZE
+	}
+	if options.RefreshInterval == 0 {
+		options.RefreshInterval = constants.CLIENT_REFRESH_INTERVAL
+	}
+	c := &Client{master: newNode(masterAddress, options.PoolSize), options: options, stop: make(chan struct{})}
+	if err := c.Refresh(ctx); err != nil {
+		c.master.pool.close()
+		return nil, err
+	}
+	go c.refreshPeriodically()
+	return c, nil
+}
+
+// private methods -------------
+func (c *Client) refreshPeriodically() {
+	ticker := time.NewTicker(c.options.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Refresh(context.Background()) // if the master is down, writes will say so
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// replica a read should go to, or nil for the master
+func (c *Client) pickReplica() *node {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	candidates := []*node{}
+	statuses := []ReplicaStatus{}
+	for _, replica := range c.replicas {
+		if status := replica.getStatus(); status.Online && status.Healthy {
+			candidates = append(candidates, replica)
+			statuses = append(statuses, status)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if picked := c.options.Policy.Pick(statuses); picked >= 0 && picked < len(candidates) {
+		return candidates[picked]
+	}
+	return nil
+}
+
+// runs a read on the replica the policy picks, or on the master if it picks none or the replica doesn't answer
+func (c *Client) read(ctx context.Context, args ...string) (utils.RESPValue, error) {
+	if replica := c.pickReplica(); replica != nil {
+		reply, err := replica.do(ctx, c.options.Timeout, args...)
+		var connErr *ConnectionError
+		if !errors.As(err, &connErr) {
+			return reply, err
+		}
+	}
+	return c.master.do(ctx, c.options.Timeout, args...)
+}
+
+// public methods -------------
+// rediscovers the master's replicas from its INFO, and pings them to see which are answering and how fast
+func (c *Client) Refresh(ctx context.Context) error {
+	info, err := c.master.do(ctx, c.options.Timeout, protocol.Commands.INFO)
+	if err != nil {
+		return errors.Wrapf(err, "could not get INFO from master %s", c.master.address)
+	}
+	fields := parseInfo(info.String())
+	masterOffset, _ := strconv.Atoi(fields["master_repl_offset"])
+
+	c.mutex.Lock()
+	existing := map[string]*node{}
+	for _, replica := range c.replicas {
+		existing[replica.address] = replica
+	}
+	c.mutex.Unlock()
+
+	replicas := []*node{}
+	for _, found := range replicaFields(fields) {
+		replica, known := existing[found["address"]]
+		if !known {
+			replica = newNode(found["address"], c.options.PoolSize)
+		}
+		delete(existing, found["address"])
+		offset, _ := strconv.Atoi(found["offset"])
+
+		replica.do(ctx, c.options.Timeout, protocol.Commands.STATUS)
+		replica.mutex.Lock()
+		replica.status.Online = found["state"] == "online"
+		replica.status.Lag = max(0, masterOffset-offset)
+		replica.mutex.Unlock()
+		replicas = append(replicas, replica)
+	}
+
+	c.mutex.Lock()
+	c.replicas = replicas
+	c.mutex.Unlock()
+	for _, gone := range existing {
+		gone.pool.close()
+	}
+	return nil
+}
+
+// what the client knows of each replica
+func (c *Client) Replicas() []ReplicaStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	statuses := []ReplicaStatus{}
+	for _, replica := range c.replicas {
+		statuses = append(statuses, replica.getStatus())
+	}
+	return statuses
+}
+
+// sends any command to the master, and returns its reply as text (see utils.RESPValue.String)
+func (c *Client) Do(ctx context.Context, args ...string) (string, error) {
+	reply, err := c.master.do(ctx, c.options.Timeout, args...)
+	return reply.String(), err
+}
+
+func (c *Client) Close() {
+	close(c.stop)
+	c.master.pool.close()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, replica := range c.replicas {
+		replica.pool.close()
+	}
+}
+
+// INFO ---------------------------------------------------------------------------------------
+// splits an INFO reply into its fields
+func parseInfo(info string) map[string]string {
+	fields := map[string]string{}
+	for _, line := range strings.Split(info, "\r\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// the replicas listed in a master's INFO (slaveN:ip=...,port=...,state=...,offset=...), each with its
+// address (host:port), state and offset
+func replicaFields(fields map[string]string) []map[string]string {
+	replicas := []map[string]string{}
+	for i := 0; ; i++ {
+		value, exists := fields["slave"+strconv.Itoa(i)]
+		if !exists {
+			return replicas
+		}
+		replica := map[string]string{}
+		for _, part := range strings.Split(value, ",") {
+			name, v, _ := strings.Cut(part, "=")
+			replica[name] = v
+		}
+		replica["address"] = net.JoinHostPort(replica["ip"], replica["port"])
+		replicas = append(replicas, replica)
+	}
+}
@@ -0,0 +1,351 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cadence/protocol"
+	"cadence/utils"
+)
+
+func newTestClient(t *testing.T, s *fakeServer, options Options) *Client {
+	t.Helper()
+	c, err := New(context.Background(), s.address, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func okay(args []string) []byte {
+	return utils.SimpleStringSerialize(protocol.Responses.OKAY)
+}
+
+// POOL ---------------------------------------------------------------------------------------
+func TestPoolReusesConnections(t *testing.T) {
+	s := newFakeServer(t, masterReplies(okay))
+	c := newTestClient(t, s, Options{})
+	for i := 0; i < 10; i++ {
+		if _, err := c.Do(context.Background(), "SET", "a", "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.connections(); n != 1 {
+		t.Fatalf("opened %d connections for commands sent one after another, want 1", n)
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	release := make(chan struct{})
+	s := newFakeServer(t, masterReplies(func(args []string) []byte {
+		<-release
+		return okay(args)
+	}))
+	c := newTestClient(t, s, Options{PoolSize: 2})
+
+	var done sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			if _, err := c.Do(context.Background(), "BLOCK"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// two get a connection, the third waits for one of them to be given back
+	waitFor(t, "two commands to be sent", func() bool { return len(s.commands("BLOCK")) == 2 })
+	time.Sleep(50 * time.Millisecond)
+	if n, sent := s.connections(), len(s.commands("BLOCK")); n != 2 || sent != 2 {
+		t.Fatalf("%d connections and %d commands sent, want 2 of each while both are busy", n, sent)
+	}
+	close(release)
+	done.Wait()
+	if n := s.connections(); n != 2 {
+		t.Fatalf("opened %d connections, want the third command to reuse one", n)
+	}
+}
+
+func TestPoolWaitCancelled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s := newFakeServer(t, masterReplies(func(args []string) []byte {
+		<-release
+		return okay(args)
+	}))
+	c := newTestClient(t, s, Options{PoolSize: 1})
+	go c.Do(context.Background(), "BLOCK")
+	waitFor(t, "the connection to be taken", func() bool { return len(s.commands("BLOCK")) == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := c.Do(ctx, "SET", "a", "1")
+	var connErr *ConnectionError
+	if !errors.Is(err, context.DeadlineExceeded) || errors.As(err, &connErr) {
+		t.Fatalf("got %v waiting for a connection, want the context's error", err)
+	}
+	// the node answered everything it was sent, so it isn't counted as down
+	if !c.master.getStatus().Healthy {
+		t.Fatal("master marked unhealthy because a caller gave up waiting")
+	}
+}
+
+func TestBrokenConnectionDropped(t *testing.T) {
+	s := newFakeServer(t, masterReplies(func(args []string) []byte {
+		if args[0] == "HANGUP" {
+			return nil
+		}
+		return okay(args)
+	}))
+	c := newTestClient(t, s, Options{})
+
+	_, err := c.Do(context.Background(), "HANGUP")
+	var connErr *ConnectionError
+	if !errors.As(err, &connErr) || !strings.Contains(err.Error(), "closed the connection") {
+		t.Fatalf("got %v when the node hung up, want a *ConnectionError", err)
+	}
+	if c.master.getStatus().Healthy {
+		t.Fatal("master still healthy after its connection broke")
+	}
+	if reply, err := c.Do(context.Background(), "SET", "a", "1"); err != nil || reply != "OK" {
+		t.Fatalf("got %q (%v) after the broken connection, want OK", reply, err)
+	}
+	if n := s.connections(); n != 2 {
+		t.Fatalf("opened %d connections, want a new one after the broken one", n)
+	}
+}
+
+func TestClosedClient(t *testing.T) {
+	s := newFakeServer(t, masterReplies(okay))
+	c, err := New(context.Background(), s.address, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := c.Do(context.Background(), "SET", "a", "1"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("got %v from a closed client, want ErrClosed", err)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	s := newFakeServer(t, okay)
+	s.close()
+	_, err := New(context.Background(), s.address, Options{})
+	var connErr *ConnectionError
+	if !errors.As(err, &connErr) || connErr.Address != s.address {
+		t.Fatalf("got %v connecting to a node that isn't there, want a *ConnectionError for it", err)
+	}
+}
+
+// REPLIES ------------------------------------------------------------------------------------
+func TestReplies(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  string
+	}{
+		{"simple string", "+OK\r\n", "OK"},
+		{"bulk string", "$5\r\nhello\r\n", "hello"},
+		{"empty bulk string", "$0\r\n\r\n", ""},
+		{"bulk string with CRLF in it", "$4\r\na\r\nb\r\n", "a\r\nb"},
+		{"integer", ":42\r\n", "42"},
+		{"negative integer", ":-3\r\n", "-3"},
+		{"nil", "$-1\r\n", "NIL"},
+		{"array", "*2\r\n$1\r\na\r\n:1\r\n", "a\n1"},
+		{"nested array", "*2\r\n*2\r\n:0\r\n:5\r\n$1\r\nb\r\n", "0 5\nb"},
+	}
+	for _, trickle := range []bool{false, true} {
+		for _, tt := range tests {
+			name := tt.name
+			if trickle {
+				name += " in pieces"
+			}
+			t.Run(name, func(t *testing.T) {
+				s := newFakeServer(t, masterReplies(func(args []string) []byte { return []byte(tt.reply) }))
+				s.trickle = trickle
+				c := newTestClient(t, s, Options{})
+				// twice, so a reply read too far or not far enough shows up in the next one
+				for i := 0; i < 2; i++ {
+					if got, err := c.Do(context.Background(), "REPLY"); err != nil || got != tt.want {
+						t.Fatalf("got %q (%v), want %q", got, err, tt.want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestGetNil(t *testing.T) {
+	s := newFakeServer(t, masterReplies(func(args []string) []byte { return utils.NilBulkString() }))
+	c := newTestClient(t, s, Options{})
+	if value, ok, err := c.Get(context.Background(), "missing"); err != nil || ok || value != "" {
+		t.Fatalf("got %q, %v (%v) for a key that isn't set", value, ok, err)
+	}
+}
+
+func TestReplyTimeout(t *testing.T) {
+	s := newFakeServer(t, masterReplies(func(args []string) []byte {
+		if args[0] == "SLOW" {
+			time.Sleep(300 * time.Millisecond)
+			return utils.SimpleStringSerialize("LATE")
+		}
+		return okay(args)
+	}))
+	c := newTestClient(t, s, Options{Timeout: 100 * time.Millisecond})
+
+	_, err := c.Do(context.Background(), "SLOW")
+	var connErr *ConnectionError
+	if !errors.As(err, &connErr) || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("got %v, want a *ConnectionError for the timeout", err)
+	}
+
+	// the late reply must not be taken for the next command's
+	if reply, err := c.Do(context.Background(), "SET", "a", "1"); err != nil || reply != "OK" {
+		t.Fatalf("got %q (%v) after a timeout, want OK", reply, err)
+	}
+	if n := s.connections(); n != 2 {
+		t.Fatalf("opened %d connections, want the timed out one replaced", n)
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	s := newFakeServer(t, masterReplies(func(args []string) []byte {
+		time.Sleep(300 * time.Millisecond)
+		return okay(args)
+	}))
+	c := newTestClient(t, s, Options{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := c.Do(ctx, "SLOW")
+	var connErr *ConnectionError
+	if !errors.Is(err, context.Canceled) || !errors.As(err, &connErr) {
+		t.Fatalf("got %v, want a *ConnectionError wrapping context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("took %v to notice the context was cancelled", elapsed)
+	}
+}
+
+// ERRORS -------------------------------------------------------------------------------------
+func TestErrorReplies(t *testing.T) {
+	tests := []struct {
+		reply   string
+		code    string
+		message string
+	}{
+		{"-ERR Invalid command.\r\n", utils.ErrorCodes.ERR, "ERR Invalid command."},
+		{"-READONLY You can't write against a read only replica.\r\n", utils.ErrorCodes.READONLY, "READONLY You can't write against a read only replica."},
+		{"-MOVED 3999 127.0.0.1:6381\r\n", utils.ErrorCodes.MOVED, "MOVED 3999 127.0.0.1:6381"},
+		{"-NOTLEADER\r\n", utils.ErrorCodes.NOTLEADER, "NOTLEADER"},
+		{"-something went wrong\r\n", utils.ErrorCodes.ERR, "ERR something went wrong"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			s := newFakeServer(t, masterReplies(func(args []string) []byte {
+				if args[0] == "FAIL" {
+					return []byte(tt.reply)
+				}
+				return okay(args)
+			}))
+			c := newTestClient(t, s, Options{})
+
+			_, err := c.Do(context.Background(), "FAIL")
+			var serverErr *Error
+			if !errors.As(err, &serverErr) || serverErr.Code != tt.code || serverErr.Message != tt.message {
+				t.Fatalf("got %#v, want an *Error with code %s and message %q", err, tt.code, tt.message)
+			}
+			if !HasCode(err, tt.code) || HasCode(err, "OTHER") {
+				t.Fatalf("HasCode doesn't match %v to %s alone", err, tt.code)
+			}
+
+			// an error reply is still a reply, so the connection carries on
+			if reply, err := c.Do(context.Background(), "SET", "a", "1"); err != nil || reply != "OK" {
+				t.Fatalf("got %q (%v) after an error reply, want OK", reply, err)
+			}
+			if n := s.connections(); n != 1 {
+				t.Fatalf("opened %d connections, want the one to be kept after an error reply", n)
+			}
+		})
+	}
+}
+
+// PIPELINE -----------------------------------------------------------------------------------
+func TestPipelineExec(t *testing.T) {
+	s := newFakeServer(t, masterReplies(func(args []string) []byte {
+		switch args[0] {
+		case protocol.Commands.GET:
+			if args[1] == "a" {
+				return utils.BulkStringSerialize("1")
+			}
+			return utils.NilBulkString()
+		case "BAD":
+			return utils.ErrorSerialize(utils.ErrorCodes.ERR, "Invalid command.")
+		}
+		return okay(args)
+	}))
+	c := newTestClient(t, s, Options{})
+	before := len(s.commands(""))
+
+	results, err := c.Pipeline().Set("a", "1", time.Minute).Get("a").Do("BAD").Get("missing").Delete("a").Exec(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("got %d results, want 5", len(results))
+	}
+	want := []Result{{Value: "OK"}, {Value: "1"}, {}, {IsNil: true}, {Value: "OK"}}
+	for i, result := range results {
+		if i == 2 {
+			if !HasCode(result.Err, utils.ErrorCodes.ERR) {
+				t.Fatalf("result %d is %+v, want the ERR it was refused with", i, result)
+			}
+			continue
+		}
+		if result != want[i] {
+			t.Fatalf("result %d is %+v, want %+v", i, result, want[i])
+		}
+	}
+
+	// sent in order, on one connection
+	sent := s.commands("")[before:]
+	wantSent := []string{"SET a 1 PX 60000", "GET a", "BAD", "GET missing", "DELETE a"}
+	for i, args := range sent {
+		if i >= len(wantSent) || strings.Join(args, " ") != wantSent[i] {
+			t.Fatalf("server got %v, want %v", sent, wantSent)
+		}
+	}
+	if n := s.connections(); n != 1 {
+		t.Fatalf("opened %d connections for one pipeline, want 1", n)
+	}
+
+	// nothing queued, nothing sent
+	if results, err := c.Pipeline().Exec(context.Background()); err != nil || len(results) != 0 {
+		t.Fatalf("empty pipeline got %v (%v)", results, err)
+	}
+	if len(s.commands("")) != before+len(wantSent) {
+		t.Fatal("empty pipeline sent something")
+	}
+}
+
+func TestPipelineConnectionLost(t *testing.T) {
+	s := newFakeServer(t, masterReplies(func(args []string) []byte {
+		if args[0] == "HANGUP" {
+			return nil
+		}
+		return okay(args)
+	}))
+	c := newTestClient(t, s, Options{})
+	results, err := c.Pipeline().Set("a", "1", 0).Do("HANGUP").Set("b", "2", 0).Exec(context.Background())
+	var connErr *ConnectionError
+	if !errors.As(err, &connErr) || results != nil {
+		t.Fatalf("got %v (%v), want no results and a *ConnectionError", results, err)
+	}
+}
@@ -0,0 +1,416 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cadence/cluster"
+	"cadence/constants"
+	"cadence/protocol"
+	"cadence/utils"
+
+	"github.com/pkg/errors"
+)
+
+/*
+A client for a Cadence cluster, that sees its nodes as one keyspace. It keeps a map of which node serves
+each hash slot, from CLUSTER SLOTS, and sends each command straight to the node serving its key. When a
+slot has moved since, the node says so (MOVED) and the command is sent again where it went - and the slot
+map refreshed. A slot in the middle of being moved gets an ASK for keys already gone, which only covers
+that one command, so it is sent to the new node after an ASKING without touching the map.
+
+Commands on many keys (MGet, MSet, Delete) are split up by slot, and each node gets the commands for the
+slots it serves in one round trip.
+*/
+
+type ClusterOptions struct {
+	Timeout         time.Duration // for each command to get its reply (when its context has no deadline), constants.CLIENT_TIMEOUT if zero
+	PoolSize        int           // most connections open to each node at once, constants.CLIENT_POOL_SIZE if zero
+	RefreshInterval time.Duration // how often the slot map is refreshed, constants.CLIENT_REFRESH_INTERVAL if zero
+}
+
+type ClusterClient struct {
+	seeds   []string                        // addresses the client was given, asked for the slot map when no known node answers
+	nodes   map[string]*node                // by address
+	owners  [constants.CLUSTER_SLOTS]string // address of the node serving each slot, as of the last refresh or redirect
+	options ClusterOptions
+	refresh chan struct{} // asks for the slot map to be refreshed soon, e.g. after a MOVED
+	stop    chan struct{}
+	closed  bool
+	mutex   sync.RWMutex
+}
+
+// connects to the cluster through any of the nodes at seeds (host:port), and gets its slot map
+func NewCluster(ctx context.Context, seeds []string, options ClusterOptions) (*ClusterClient, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("no cluster nodes given")
+	}
+	if options.Timeout == 0 {
+		options.Timeout = constants.CLIENT_TIMEOUT
+	}
+	if options.PoolSize == 0 {
+		options.PoolSize = constants.CLIENT_POOL_SIZE
+	}
+	if options.RefreshInterval == 0 {
+		options.RefreshInterval = constants.CLIENT_REFRESH_INTERVAL
+	}
+	c := &ClusterClient{
+		seeds:   seeds,
+		nodes:   map[string]*node{},
+		options: options,
+		refresh: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	if err := c.Refresh(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	go c.refreshPeriodically()
+	return c, nil
+}
+
+// private methods -------------
+func (c *ClusterClient) refreshPeriodically() {
+	ticker := time.NewTicker(c.options.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.refresh:
+		case <-c.stop:
+			return
+		}
+		c.Refresh(context.Background()) // until it works, redirects keep commands going to the right nodes
+	}
+}
+
+func (c *ClusterClient) requestRefresh() {
+	select {
+	case c.refresh <- struct{}{}:
+	default: // one is already on its way
+	}
+}
+
+// the node at address, connecting to it if it is new
+func (c *ClusterClient) nodeAt(address string) (*node, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	n, exists := c.nodes[address]
+	if !exists {
+		n = newNode(address, c.options.PoolSize)
+		c.nodes[address] = n
+	}
+	return n, nil
+}
+
+// nodes serving slots, then the seeds - the ones to ask for the slot map, in order
+func (c *ClusterClient) addresses() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	seen := map[string]bool{"": true}
+	addresses := []string{}
+	for _, address := range append(c.owners[:], c.seeds...) {
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// node serving slot, or any node if it isn't known (or slot is -1, for commands without keys) - that
+// node will redirect the command if need be
+func (c *ClusterClient) ownerOf(slot int) string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if slot >= 0 && c.owners[slot] != "" {
+		return c.owners[slot]
+	}
+	for _, address := range c.owners {
+		if address != "" {
+			return address
+		}
+	}
+	return c.seeds[0]
+}
+
+// replaces the slot map, and closes the connections to nodes no longer in it - commands already on
+// their way to one of them get ErrClosed from its pool, and are sent to the slot's new owner instead (see do)
+func (c *ClusterClient) setOwners(owners *[constants.CLUSTER_SLOTS]string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.owners = *owners
+	inUse := map[string]bool{}
+	for _, address := range append(c.owners[:], c.seeds...) {
+		inUse[address] = true
+	}
+	for address, n := range c.nodes {
+		if !inUse[address] {
+			n.pool.close()
+			delete(c.nodes, address)
+		}
+	}
+}
+
+func (c *ClusterClient) isClosed() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.closed
+}
+
+func (c *ClusterClient) setOwner(slot int, address string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.owners[slot] = address
+}
+
+// runs a command touching keys in slot (-1 if it has none) on the node serving it, following redirects
+func (c *ClusterClient) do(ctx context.Context, slot int, args []string) (utils.RESPValue, error) {
+	address := c.ownerOf(slot)
+	asking := false
+	var err error
+	for range constants.CLIENT_MAX_REDIRECTS + 1 {
+		var n *node
+		if n, err = c.nodeAt(address); err != nil {
+			return utils.RESPValue{}, err
+		}
+		var reply utils.RESPValue
+		if asking {
+			var replies []utils.RESPValue
+			var errs []error
+			if replies, errs, err = n.pipeline(ctx, c.options.Timeout, [][]string{{protocol.Commands.ASKING}, args}); err == nil {
+				reply, err = replies[1], errs[1]
+			}
+		} else {
+			reply, err = n.do(ctx, c.options.Timeout, args...)
+		}
+
+		// the node was dropped from the slot map (and its pool closed) while the command was on its way
+		// to it, so go to whoever serves the slot now
+		if errors.Is(err, ErrClosed) && !c.isClosed() {
+			address, asking = c.ownerOf(slot), false
+			continue
+		}
+
+		kind, movedSlot, target, isRedirect := parseRedirect(err)
+		if !isRedirect {
+			// the node may have left the cluster, or lost its slots
+			var connErr *ConnectionError
+			if errors.As(err, &connErr) || HasCode(err, "CLUSTERDOWN") {
+				c.requestRefresh()
+			}
+			return reply, err
+		}
+		if kind == "MOVED" {
+			c.setOwner(movedSlot, target)
+			c.requestRefresh()
+		}
+		address, asking = target, kind == "ASK"
+	}
+	return utils.RESPValue{}, errors.Wrapf(err, "%s was redirected more than %d times", args[0], constants.CLIENT_MAX_REDIRECTS)
+}
+
+// runs commands[i] (which touches keys[i] only) for every key, each node getting the ones for the slots
+// it serves in one go. a command that is redirected, or whose node didn't answer or was dropped from the
+// slot map, is tried again on its own.
+func (c *ClusterClient) perKey(ctx context.Context, keys []string, commands [][]string) []Result {
+	byNode := map[string][]int{}
+	for i, key := range keys {
+		address := c.ownerOf(cluster.KeySlot(key))
+		byNode[address] = append(byNode[address], i)
+	}
+
+	results := make([]Result, len(keys))
+	var wg sync.WaitGroup
+	for address, indices := range byNode {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch := make([][]string, len(indices))
+			for j, i := range indices {
+				batch[j] = commands[i]
+			}
+			var replies []utils.RESPValue
+			var errs []error
+			n, err := c.nodeAt(address)
+			if err == nil {
+				replies, errs, err = n.pipeline(ctx, c.options.Timeout, batch)
+			}
+			for j, i := range indices {
+				reply, replyErr := utils.RESPValue{}, err
+				if err == nil {
+					reply, replyErr = replies[j], errs[j]
+				}
+				var connErr *ConnectionError
+				if _, _, _, isRedirect := parseRedirect(replyErr); isRedirect || errors.As(replyErr, &connErr) || errors.Is(replyErr, ErrClosed) {
+					reply, replyErr = c.do(ctx, cluster.KeySlot(keys[i]), commands[i])
+				}
+				results[i] = newResult(reply, replyErr)
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// public methods -------------
+// gets the slot map from CLUSTER SLOTS, asking each node in turn until one answers
+func (c *ClusterClient) Refresh(ctx context.Context) error {
+	var err error
+	for _, address := range c.addresses() {
+		var n *node
+		if n, err = c.nodeAt(address); err != nil {
+			return err
+		}
+		var reply utils.RESPValue
+		if reply, err = n.do(ctx, c.options.Timeout, protocol.Commands.CLUSTER, "SLOTS"); err == nil {
+			var owners *[constants.CLUSTER_SLOTS]string
+			if owners, err = parseSlots(reply); err == nil {
+				c.setOwners(owners)
+				return nil
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return errors.Wrap(err, "could not get CLUSTER SLOTS from any node")
+}
+
+// address of the node serving key, as far as the client knows
+func (c *ClusterClient) NodeFor(key string) string {
+	return c.ownerOf(cluster.KeySlot(key))
+}
+
+// sends any command to the node serving its first argument (the key, for commands with one), following
+// redirects, and returns its reply as text. commands without arguments go to any node.
+func (c *ClusterClient) Do(ctx context.Context, args ...string) (string, error) {
+	slot := -1
+	if len(args) > 1 {
+		slot = cluster.KeySlot(args[1])
+	}
+	reply, err := c.do(ctx, slot, args)
+	return reply.String(), err
+}
+
+func (c *ClusterClient) Ping(ctx context.Context) error {
+	reply, err := c.Do(ctx, protocol.Commands.STATUS)
+	if err == nil && reply != protocol.Responses.ALL_GOOD {
+		return errors.Errorf("unexpected reply to %s: %q", protocol.Commands.STATUS, reply)
+	}
+	return err
+}
+
+// value of key, and whether it is set
+func (c *ClusterClient) Get(ctx context.Context, key string) (string, bool, error) {
+	reply, err := c.do(ctx, cluster.KeySlot(key), []string{protocol.Commands.GET, key})
+	if err != nil || reply.Nil {
+		return "", false, err
+	}
+	return reply.String(), true, nil
+}
+
+// sets key to value, expiring after ttl (never, if ttl is zero)
+func (c *ClusterClient) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	_, err := c.Do(ctx, setArgs(key, value, ttl)...)
+	return err
+}
+
+// values of keys, in the same order. the error is the first any key got (the rest are still filled in).
+func (c *ClusterClient) MGet(ctx context.Context, keys ...string) ([]Result, error) {
+	commands := make([][]string, len(keys))
+	for i, key := range keys {
+		commands[i] = []string{protocol.Commands.GET, key}
+	}
+	results := c.perKey(ctx, keys, commands)
+	return results, firstError(results)
+}
+
+// sets every key to its value, expiring after ttl (never, if ttl is zero). returns the first error any
+// key got - the others are still set.
+func (c *ClusterClient) MSet(ctx context.Context, values map[string]string, ttl time.Duration) error {
+	keys := make([]string, 0, len(values))
+	commands := make([][]string, 0, len(values))
+	for key, value := range values {
+		keys = append(keys, key)
+		commands = append(commands, setArgs(key, value, ttl))
+	}
+	return firstError(c.perKey(ctx, keys, commands))
+}
+
+// deletes keys, wherever they are. returns the first error any key got - the others are still deleted.
+func (c *ClusterClient) Delete(ctx context.Context, keys ...string) error {
+	commands := make([][]string, len(keys))
+	for i, key := range keys {
+		commands[i] = []string{protocol.Commands.DELETE, key}
+	}
+	return firstError(c.perKey(ctx, keys, commands))
+}
+
+func (c *ClusterClient) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.stop)
+	for _, n := range c.nodes {
+		n.pool.close()
+	}
+}
+
+// REPLIES ------------------------------------------------------------------------------------
+// the slot map in a CLUSTER SLOTS reply, an array with a [start, end, [host, port, id]] entry per run of slots
+func parseSlots(reply utils.RESPValue) (*[constants.CLUSTER_SLOTS]string, error) {
+	owners := [constants.CLUSTER_SLOTS]string{}
+	if reply.Type != '*' {
+		return nil, errors.Errorf("unexpected CLUSTER SLOTS reply: %q", reply.String())
+	}
+	for _, entry := range reply.Array {
+		if len(entry.Array) < 3 || len(entry.Array[2].Array) < 2 {
+			return nil, errors.Errorf("unexpected CLUSTER SLOTS entry: %q", entry.String())
+		}
+		start, end, owner := entry.Array[0].Int, entry.Array[1].Int, entry.Array[2].Array
+		if start < 0 || end >= constants.CLUSTER_SLOTS || start > end {
+			return nil, errors.Errorf("invalid slot range %d-%d in CLUSTER SLOTS", start, end)
+		}
+		for slot := start; slot <= end; slot++ {
+			owners[slot] = net.JoinHostPort(owner[0].Str, strconv.Itoa(owner[1].Int))
+		}
+	}
+	return &owners, nil
+}
+
+// whether err is a MOVED or ASK redirect, and if so which (kind), its slot and the node it points to
+func parseRedirect(err error) (kind string, slot int, target string, ok bool) {
+	var serverErr *Error
+	if !errors.As(err, &serverErr) || (serverErr.Code != "MOVED" && serverErr.Code != "ASK") {
+		return "", 0, "", false
+	}
+	fields := strings.Fields(serverErr.Message)
+	if len(fields) != 3 {
+		return "", 0, "", false
+	}
+	slot, parseErr := strconv.Atoi(fields[1])
+	if parseErr != nil || slot < 0 || slot >= constants.CLUSTER_SLOTS {
+		return "", 0, "", false
+	}
+	return fields[0], slot, fields[2], true
+}
+
+func firstError(results []Result) error {
+	for _, result := range results {
+		if result.Err != nil {
+			return result.Err
+		}
+	}
+	return nil
+}
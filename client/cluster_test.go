@@ -0,0 +1,396 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"cadence/cluster"
+	"cadence/constants"
+	"cadence/protocol"
+	"cadence/utils"
+)
+
+// FAKE_CLUSTER -------------------------------------------------------------------------------
+// fake servers sharing a slot map, each keeping the keys of the slots it serves. a command for a slot
+// a node doesn't serve gets MOVED, unless the slot is moving away from it and the key is already gone
+// (ASK), or it is moving to it and the command came right after an ASKING.
+type fakeCluster struct {
+	servers []*fakeServer
+	owners  [constants.CLUSTER_SLOTS]int // index of the server serving each slot
+	moving  map[int]int                  // slot -> index of the server it is moving to
+	stores  []map[string]string
+	asking  []bool // whether the last command each server got was ASKING
+	mutex   sync.Mutex
+}
+
+// n nodes, the slots split evenly between them in order
+func newFakeCluster(t *testing.T, n int) *fakeCluster {
+	fc := &fakeCluster{moving: map[int]int{}, stores: make([]map[string]string, n), asking: make([]bool, n)}
+	for slot := range fc.owners {
+		fc.owners[slot] = slot * n / constants.CLUSTER_SLOTS
+	}
+	for i := 0; i < n; i++ {
+		fc.stores[i] = map[string]string{}
+		fc.servers = append(fc.servers, newFakeServer(t, func(args []string) []byte { return fc.reply(i, args) }))
+	}
+	return fc
+}
+
+func (fc *fakeCluster) reply(i int, args []string) []byte {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	asking := fc.asking[i]
+	fc.asking[i] = false
+
+	switch args[0] {
+	case protocol.Commands.STATUS:
+		return utils.SimpleStringSerialize(protocol.Responses.ALL_GOOD)
+	case protocol.Commands.CLUSTER:
+		return fc.slotsReply()
+	case protocol.Commands.ASKING:
+		fc.asking[i] = true
+		return utils.SimpleStringSerialize(protocol.Responses.OKAY)
+	}
+
+	key := args[1]
+	slot := cluster.KeySlot(key)
+	_, stored := fc.stores[i][key]
+	switch target, isMoving := fc.moving[slot]; {
+	case fc.owners[slot] == i && isMoving && !stored:
+		return utils.ErrorSerialize(utils.ErrorCodes.ASK, fmt.Sprintf("%d %s", slot, fc.servers[target].address))
+	case fc.owners[slot] == i, isMoving && target == i && asking:
+	default:
+		return utils.ErrorSerialize(utils.ErrorCodes.MOVED, fmt.Sprintf("%d %s", slot, fc.servers[fc.owners[slot]].address))
+	}
+
+	switch args[0] {
+	case protocol.Commands.GET:
+		if key == "bad" {
+			return utils.ErrorSerialize(utils.ErrorCodes.ERR, "Invalid command.")
+		}
+		if value, ok := fc.stores[i][key]; ok {
+			return utils.BulkStringSerialize(value)
+		}
+		return utils.NilBulkString()
+	case protocol.Commands.SET:
+		fc.stores[i][key] = args[2]
+		return utils.SimpleStringSerialize(protocol.Responses.OKAY)
+	case protocol.Commands.DELETE:
+		delete(fc.stores[i], key)
+		return utils.IntegerSerialize(1)
+	}
+	return utils.ErrorSerialize(utils.ErrorCodes.ERR, "Invalid command.")
+}
+
+// CLUSTER SLOTS for the current slot map, one entry per run of slots
+func (fc *fakeCluster) slotsReply() []byte {
+	entries := [][]byte{}
+	start := 0
+	for slot := 1; slot <= constants.CLUSTER_SLOTS; slot++ {
+		if slot < constants.CLUSTER_SLOTS && fc.owners[slot] == fc.owners[start] {
+			continue
+		}
+		host, port, _ := net.SplitHostPort(fc.servers[fc.owners[start]].address)
+		portNumber, _ := strconv.Atoi(port)
+		owner := utils.ArraySerialize([][]byte{utils.BulkStringSerialize(host), utils.IntegerSerialize(portNumber), utils.BulkStringSerialize("id")})
+		entries = append(entries, utils.ArraySerialize([][]byte{utils.IntegerSerialize(start), utils.IntegerSerialize(slot - 1), owner}))
+		start = slot
+	}
+	return utils.ArraySerialize(entries)
+}
+
+// moves slot to server i without telling the client
+func (fc *fakeCluster) setOwner(slot int, i int) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.owners[slot] = i
+}
+
+func (fc *fakeCluster) store(i int, key string, value string) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.stores[i][key] = value
+}
+
+func (fc *fakeCluster) keys(i int) map[string]string {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	keys := map[string]string{}
+	for key, value := range fc.stores[i] {
+		keys[key] = value
+	}
+	return keys
+}
+
+func newTestClusterClient(t *testing.T, fc *fakeCluster) *ClusterClient {
+	t.Helper()
+	c, err := NewCluster(context.Background(), []string{fc.servers[0].address}, ClusterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// REPLIES ------------------------------------------------------------------------------------
+func TestParseRedirect(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		kind   string
+		slot   int
+		target string
+		ok     bool
+	}{
+		{"moved", &Error{Code: "MOVED", Message: "MOVED 3999 127.0.0.1:6381"}, "MOVED", 3999, "127.0.0.1:6381", true},
+		{"ask", &Error{Code: "ASK", Message: "ASK 0 10.0.0.2:7000"}, "ASK", 0, "10.0.0.2:7000", true},
+		{"last slot", &Error{Code: "MOVED", Message: "MOVED 16383 a:1"}, "MOVED", 16383, "a:1", true},
+		{"wrapped", fmt.Errorf("GET: %w", &Error{Code: "MOVED", Message: "MOVED 7 a:1"}), "MOVED", 7, "a:1", true},
+		{"slot past the last", &Error{Code: "MOVED", Message: "MOVED 16384 a:1"}, "", 0, "", false},
+		{"negative slot", &Error{Code: "ASK", Message: "ASK -1 a:1"}, "", 0, "", false},
+		{"slot not a number", &Error{Code: "MOVED", Message: "MOVED x a:1"}, "", 0, "", false},
+		{"no target", &Error{Code: "MOVED", Message: "MOVED 7"}, "", 0, "", false},
+		{"extra field", &Error{Code: "MOVED", Message: "MOVED 7 a:1 b"}, "", 0, "", false},
+		{"other code", &Error{Code: "ERR", Message: "ERR 7 a:1"}, "", 0, "", false},
+		{"connection error", &ConnectionError{Address: "a:1", Err: errors.New("MOVED 7 a:1")}, "", 0, "", false},
+		{"no error", nil, "", 0, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, slot, target, ok := parseRedirect(tt.err)
+			if kind != tt.kind || slot != tt.slot || target != tt.target || ok != tt.ok {
+				t.Fatalf("got %q %d %q %v, want %q %d %q %v", kind, slot, target, ok, tt.kind, tt.slot, tt.target, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseSlots(t *testing.T) {
+	entry := func(start int, end int, host string, port int) utils.RESPValue {
+		owner := utils.RESPValue{Type: '*', Array: []utils.RESPValue{{Type: '$', Str: host}, {Type: ':', Int: port}, {Type: '$', Str: "id"}}}
+		return utils.RESPValue{Type: '*', Array: []utils.RESPValue{{Type: ':', Int: start}, {Type: ':', Int: end}, owner}}
+	}
+	slots := func(entries ...utils.RESPValue) utils.RESPValue {
+		return utils.RESPValue{Type: '*', Array: entries}
+	}
+
+	tests := []struct {
+		name  string
+		reply utils.RESPValue
+		want  map[int]string // owners of some slots, checked when there's no error
+		err   bool
+	}{
+		{"two nodes", slots(entry(0, 8191, "127.0.0.1", 7000), entry(8192, 16383, "127.0.0.1", 7001)),
+			map[int]string{0: "127.0.0.1:7000", 8191: "127.0.0.1:7000", 8192: "127.0.0.1:7001", 16383: "127.0.0.1:7001"}, false},
+		{"gaps", slots(entry(5, 5, "a", 1), entry(100, 199, "b", 2)),
+			map[int]string{4: "", 5: "a:1", 6: "", 99: "", 100: "b:2", 199: "b:2", 200: ""}, false},
+		{"ipv6", slots(entry(0, 0, "::1", 7000)), map[int]string{0: "[::1]:7000"}, false},
+		{"no slots served", slots(), map[int]string{0: "", 16383: ""}, false},
+		{"not an array", utils.RESPValue{Type: '+', Str: "OK"}, nil, true},
+		{"short entry", slots(utils.RESPValue{Type: '*', Array: []utils.RESPValue{{Type: ':', Int: 0}, {Type: ':', Int: 1}}}), nil, true},
+		{"owner without port", slots(utils.RESPValue{Type: '*', Array: []utils.RESPValue{{Type: ':'}, {Type: ':'}, {Type: '*', Array: []utils.RESPValue{{Type: '$', Str: "a"}}}}}), nil, true},
+		{"start after end", slots(entry(10, 9, "a", 1)), nil, true},
+		{"end past the last slot", slots(entry(0, 16384, "a", 1)), nil, true},
+		{"negative start", slots(entry(-1, 5, "a", 1)), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owners, err := parseSlots(tt.reply)
+			if tt.err {
+				if err == nil {
+					t.Fatal("parsed a bad CLUSTER SLOTS reply")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for slot, want := range tt.want {
+				if owners[slot] != want {
+					t.Fatalf("slot %d is served by %q, want %q", slot, owners[slot], want)
+				}
+			}
+		})
+	}
+}
+
+// REDIRECTS ----------------------------------------------------------------------------------
+func TestMovedUpdatesSlotMap(t *testing.T) {
+	fc := newFakeCluster(t, 2)
+	c := newTestClusterClient(t, fc)
+	a, b := fc.servers[0], fc.servers[1]
+	slot := cluster.KeySlot("foo") // served by b
+	if owner := c.NodeFor("foo"); owner != b.address {
+		t.Fatalf("foo is on %s, want %s", owner, b.address)
+	}
+
+	// resharded behind the client's back
+	fc.setOwner(slot, 0)
+	fc.store(0, "foo", "bar")
+	if value, ok, err := c.Get(context.Background(), "foo"); err != nil || !ok || value != "bar" {
+		t.Fatalf("got %q, %v (%v) after a MOVED, want bar", value, ok, err)
+	}
+	if owner := c.ownerOf(slot); owner != a.address {
+		t.Fatalf("slot %d is still mapped to %s after a MOVED to %s", slot, owner, a.address)
+	}
+	// and the whole map is refreshed, since more than one slot probably moved
+	waitFor(t, "the slot map to be refreshed", func() bool {
+		return len(a.commands(protocol.Commands.CLUSTER))+len(b.commands(protocol.Commands.CLUSTER)) > 1
+	})
+
+	// the next one goes straight to the new owner
+	if _, _, err := c.Get(context.Background(), "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(b.commands(protocol.Commands.GET)); got != 1 {
+		t.Fatalf("old owner got %d GETs, want only the one before the MOVED", got)
+	}
+	if got := len(a.commands(protocol.Commands.GET)); got != 2 {
+		t.Fatalf("new owner got %d GETs, want 2", got)
+	}
+}
+
+func TestAskSendsAsking(t *testing.T) {
+	fc := newFakeCluster(t, 2)
+	c := newTestClusterClient(t, fc)
+	a, b := fc.servers[0], fc.servers[1]
+	slot := cluster.KeySlot("foo")
+
+	// foo has already been moved from b to a, {foo}.stays hasn't yet
+	fc.mutex.Lock()
+	fc.moving[slot] = 0
+	fc.mutex.Unlock()
+	fc.store(0, "foo", "moved")
+	fc.store(1, "{foo}.stays", "here")
+
+	for i := 0; i < 2; i++ {
+		if value, ok, err := c.Get(context.Background(), "foo"); err != nil || !ok || value != "moved" {
+			t.Fatalf("got %q, %v (%v) after an ASK, want moved", value, ok, err)
+		}
+		// an ASK is for that one command, so the slot stays where it was
+		if owner := c.ownerOf(slot); owner != b.address {
+			t.Fatalf("slot %d mapped to %s after an ASK, want it left on %s", slot, owner, b.address)
+		}
+	}
+	if got := len(a.commands(protocol.Commands.ASKING)); got != 2 {
+		t.Fatalf("new owner got %d ASKINGs for 2 ASKs, want 2", got)
+	}
+	if got := len(b.commands(protocol.Commands.ASKING)); got != 0 {
+		t.Fatalf("old owner got %d ASKINGs, want none", got)
+	}
+
+	if value, ok, err := c.Get(context.Background(), "{foo}.stays"); err != nil || !ok || value != "here" {
+		t.Fatalf("got %q, %v (%v) for a key that wasn't moved, want here", value, ok, err)
+	}
+	if got := len(a.commands("")) - len(a.commands(protocol.Commands.CLUSTER)); got != 4 {
+		t.Fatalf("new owner got %d commands, want only the 2 ASKING and GET pairs", got)
+	}
+}
+
+func TestTooManyRedirects(t *testing.T) {
+	fc := newFakeCluster(t, 1)
+	c := newTestClusterClient(t, fc)
+	// a slot moving to the node it is already on, so the node keeps sending the client back to itself
+	fc.mutex.Lock()
+	fc.moving[cluster.KeySlot("foo")] = 0
+	fc.mutex.Unlock()
+	_, _, err := c.Get(context.Background(), "foo")
+	if !HasCode(err, utils.ErrorCodes.ASK) {
+		t.Fatalf("got %v, want the last ASK once it gave up", err)
+	}
+	if got := len(fc.servers[0].commands(protocol.Commands.GET)); got != constants.CLIENT_MAX_REDIRECTS+1 {
+		t.Fatalf("sent GET %d times, want %d", got, constants.CLIENT_MAX_REDIRECTS+1)
+	}
+}
+
+// MULTI_KEY ----------------------------------------------------------------------------------
+func TestPerKey(t *testing.T) {
+	fc := newFakeCluster(t, 3)
+	c := newTestClusterClient(t, fc)
+	ctx := context.Background()
+
+	values := map[string]string{}
+	for i := 0; i < 30; i++ {
+		values[fmt.Sprintf("key%d", i)] = strconv.Itoa(i)
+	}
+	if err := c.MSet(ctx, values, 0); err != nil {
+		t.Fatal(err)
+	}
+	// each node got its own keys and nothing else, so none were redirected
+	for i, s := range fc.servers {
+		keys := fc.keys(i)
+		for key, value := range keys {
+			if fc.owners[cluster.KeySlot(key)] != i || values[key] != value {
+				t.Fatalf("%s got %s=%s", s.address, key, value)
+			}
+		}
+		if sets := len(s.commands(protocol.Commands.SET)); sets != len(keys) {
+			t.Fatalf("%s got %d SETs for its %d keys", s.address, sets, len(keys))
+		}
+		if len(keys) == 0 {
+			t.Fatalf("%s got none of the keys", s.address)
+		}
+	}
+
+	keys := []string{"key3", "missing", "key17", "bad", "key0"}
+	results, err := c.MGet(ctx, keys...)
+	if !HasCode(err, utils.ErrorCodes.ERR) {
+		t.Fatalf("got %v, want the ERR one key got", err)
+	}
+	want := []Result{{Value: "3"}, {IsNil: true}, {Value: "17"}, {}, {Value: "0"}}
+	for i, result := range results {
+		if i == 3 {
+			if !HasCode(result.Err, utils.ErrorCodes.ERR) {
+				t.Fatalf("%s got %+v, want its ERR", keys[i], result)
+			}
+			continue
+		}
+		if result != want[i] {
+			t.Fatalf("%s got %+v, want %+v", keys[i], result, want[i])
+		}
+	}
+
+	if err := c.Delete(ctx, "key3", "key17", "key0"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range fc.servers {
+		for _, key := range []string{"key3", "key17", "key0"} {
+			if _, ok := fc.keys(i)[key]; ok {
+				t.Fatalf("%s still set after Delete", key)
+			}
+		}
+	}
+}
+
+func TestPerKeyFollowsRedirects(t *testing.T) {
+	fc := newFakeCluster(t, 2)
+	c := newTestClusterClient(t, fc)
+	ctx := context.Background()
+	if err := c.MSet(ctx, map[string]string{"foo": "1", "bar": "2", "hello": "3"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// foo's slot moves to the other node, with the key
+	slot := cluster.KeySlot("foo")
+	from := fc.owners[slot]
+	fc.setOwner(slot, 1-from)
+	fc.store(1-from, "foo", "1")
+
+	results, err := c.MGet(ctx, "foo", "bar", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"1", "2", "3"} {
+		if results[i] != (Result{Value: want}) {
+			t.Fatalf("result %d is %+v, want %s", i, results[i], want)
+		}
+	}
+	if owner := c.ownerOf(slot); owner != fc.servers[1-from].address {
+		t.Fatalf("slot %d still mapped to %s after MGet was redirected", slot, owner)
+	}
+}
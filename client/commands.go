@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"cadence/protocol"
+	"cadence/utils"
+
+	"github.com/pkg/errors"
+)
+
+// COMMANDS -----------------------------------------------------------------------------------
+// typed wrappers for the commands clients use (the ones nodes use to talk to each other are left out)
+
+// the number in an integer reply to command
+func integer(command string, reply utils.RESPValue) (int, error) {
+	if reply.Type != ':' {
+		return 0, errors.Errorf("unexpected reply to %s: %q", command, reply.String())
+	}
+	return reply.Int, nil
+}
+
+// SET's arguments, with PX millis if ttl isn't zero
+func setArgs(key string, value string, ttl time.Duration) []string {
+	args := []string{protocol.Commands.SET, key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(1, ttl.Milliseconds()), 10))
+	}
+	return args
+}
+
+func (c *Client) Ping(ctx context.Context) error {
+	reply, err := c.Do(ctx, protocol.Commands.STATUS)
+	if err == nil && reply != protocol.Responses.ALL_GOOD {
+		return errors.Errorf("unexpected reply to %s: %q", protocol.Commands.STATUS, reply)
+	}
+	return err
+}
+
+func (c *Client) Echo(ctx context.Context, message string) (string, error) {
+	return c.Do(ctx, protocol.Commands.ECHO, message)
+}
+
+// the master's INFO, field by field
+func (c *Client) Info(ctx context.Context) (map[string]string, error) {
+	reply, err := c.Do(ctx, protocol.Commands.INFO)
+	if err != nil {
+		return nil, err
+	}
+	return parseInfo(reply), nil
+}
+
+// value of key, and whether it is set. read from a replica if the policy picks one.
+func (c *Client) Get(ctx context.Context, key string) (string, bool, error) {
+	reply, err := c.read(ctx, protocol.Commands.GET, key)
+	if err != nil || reply.Nil {
+		return "", false, err
+	}
+	return reply.String(), true, nil
+}
+
+// sets key to value, expiring after ttl (never, if ttl is zero)
+func (c *Client) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	_, err := c.Do(ctx, setArgs(key, value, ttl)...)
+	return err
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.Do(ctx, protocol.Commands.DELETE, key)
+	return err
+}
+
+// waits until numReplicas replicas have every write made so far, or timeout passes. returns how many do.
+func (c *Client) Wait(ctx context.Context, numReplicas int, timeout time.Duration) (int, error) {
+	args := []string{protocol.Commands.WAIT, strconv.Itoa(numReplicas), strconv.FormatInt(timeout.Milliseconds(), 10)}
+	// the reply only comes once the wait is over
+	reply, err := c.master.do(ctx, c.options.Timeout+timeout, args...)
+	if err != nil {
+		return 0, err
+	}
+	return integer(protocol.Commands.WAIT, reply)
+}
+
+// makes the master a replica of the node at host:port
+func (c *Client) ReplicaOf(ctx context.Context, host string, port string) error {
+	_, err := c.Do(ctx, protocol.Commands.REPLICA_OF, host, port)
+	return err
+}
+
+// makes the node a master again, if it is a replica
+func (c *Client) ReplicaOfNoOne(ctx context.Context) error {
+	_, err := c.Do(ctx, protocol.Commands.REPLICA_OF, "NO", "ONE")
+	return err
+}
+
+func (c *Client) Save(ctx context.Context) error {
+	_, err := c.Do(ctx, protocol.Commands.SAVE)
+	return err
+}
+
+func (c *Client) BgSave(ctx context.Context) error {
+	_, err := c.Do(ctx, protocol.Commands.BG_SAVE)
+	return err
+}
+
+// when the last snapshot was taken
+func (c *Client) LastSave(ctx context.Context) (time.Time, error) {
+	reply, err := c.master.do(ctx, c.options.Timeout, protocol.Commands.LAST_SAVE)
+	if err != nil {
+		return time.Time{}, err
+	}
+	seconds, err := integer(protocol.Commands.LAST_SAVE, reply)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(seconds), 0), nil
+}
+
+func (c *Client) BgRewriteAOF(ctx context.Context) error {
+	_, err := c.Do(ctx, protocol.Commands.REWRITE_LOG)
+	return err
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"cadence/utils"
+
+	"github.com/pkg/errors"
+)
+
+// CONN ---------------------------------------------------------------------------------------
+// a connection to one node, used by one caller at a time (its pool sees to that). replies are read
+// by that caller as it waits for them. once anything goes wrong it is closed for good, and the pool dials a new one.
+type conn struct {
+	address string
+	netConn net.Conn
+	reader  *bufio.Reader
+	broken  bool
+}
+
+func dial(ctx context.Context, address string) (*conn, error) {
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, &ConnectionError{Address: address, Err: err}
+	}
+	return &conn{address: address, netConn: netConn, reader: bufio.NewReader(netConn)}, nil
+}
+
+// sends commands all at once, then waits for their replies - until ctx is done, or for timeout if ctx
+// has no deadline. error replies come back as the command's *Error, and leave the connection usable.
+func (c *conn) pipeline(ctx context.Context, timeout time.Duration, commands [][]string) ([]utils.RESPValue, []error, error) {
+	if c.broken {
+		return nil, nil, &ConnectionError{Address: c.address, Err: errors.New("connection is closed")}
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		deadline = time.Now().Add(timeout)
+	}
+
+	request := []byte{}
+	for _, args := range commands {
+		request = append(request, utils.BulkStringArraySerialize(args)...)
+	}
+	c.netConn.SetWriteDeadline(deadline)
+	if _, err := c.netConn.Write(request); err != nil {
+		return nil, nil, c.fail(err)
+	}
+
+	// cancelling ctx cuts the read short. either way, replies still on their way would be taken as
+	// replies to the next commands, so a read that doesn't finish gives up on the connection.
+	c.netConn.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { c.netConn.SetReadDeadline(time.Now()) })
+	defer func() {
+		// (if it was cut short just as the last reply came in, the deadline could still land after this returns)
+		if !stop() {
+			c.Close()
+		}
+	}()
+	replies := make([]utils.RESPValue, len(commands))
+	errs := make([]error, len(commands))
+	for i := range commands {
+		reply, err := utils.ReadValue(c.reader)
+		if err != nil {
+			// with a deadline on ctx, ctx says when time is up (so the error is its own)
+			if ctx.Err() != nil {
+				return nil, nil, c.fail(ctx.Err())
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, nil, c.fail(errors.New("timed out waiting for reply"))
+			}
+			if err == io.EOF {
+				return nil, nil, c.fail(errors.New("node closed the connection"))
+			}
+			return nil, nil, c.fail(err)
+		}
+		if reply.Err != nil {
+			errs[i] = newError(reply.Err)
+		} else {
+			replies[i] = reply
+		}
+	}
+	return replies, errs, nil
+}
+
+func (c *conn) fail(err error) error {
+	c.Close()
+	return &ConnectionError{Address: c.address, Err: err}
+}
+
+func (c *conn) Close() {
+	c.broken = true
+	c.netConn.Close()
+}
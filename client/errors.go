@@ -0,0 +1,48 @@
+package client
+
+import (
+	"cadence/utils"
+
+	"github.com/pkg/errors"
+)
+
+// returned once the client is closed
+var ErrClosed = errors.New("client is closed")
+
+// ERROR --------------------------------------------------------------------------------------
+// a command the server refused, with the code its error reply started with (ERR, READONLY, MOVED, ASK,
+// CLUSTERDOWN, NOTLEADER...)
+type Error struct {
+	Code    string
+	Message string // the whole message, code included
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(respErr *utils.RESPError) *Error {
+	return &Error{Code: respErr.Code, Message: respErr.Error()}
+}
+
+// whether err is a server error with the given code
+func HasCode(err error, code string) bool {
+	var serverErr *Error
+	return errors.As(err, &serverErr) && serverErr.Code == code
+}
+
+// CONNECTION_ERROR ---------------------------------------------------------------------------
+// a node couldn't be reached, or the connection to it broke (including timing out) before the reply
+// came - so a write may or may not have happened
+type ConnectionError struct {
+	Address string
+	Err     error
+}
+
+func (e *ConnectionError) Error() string {
+	return "connection to " + e.Address + " failed: " + e.Err.Error()
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"cadence/protocol"
+	"cadence/utils"
+)
+
+// PIPELINE -----------------------------------------------------------------------------------
+// queues up commands to send to the master all at once, saving a round trip per command:
+//
+//	results, err := c.Pipeline().Set("a", "1", 0).Get("a").Exec(ctx)
+//
+// (reads in a pipeline go to the master too, so they see the writes queued before them)
+type Pipeline struct {
+	client   *Client
+	commands [][]string
+}
+
+// reply to one command in a pipeline
+type Result struct {
+	Value string
+	IsNil bool  // a GET of a key that isn't set
+	Err   error // *Error if the server refused the command
+}
+
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: c}
+}
+
+func (p *Pipeline) Do(args ...string) *Pipeline {
+	p.commands = append(p.commands, args)
+	return p
+}
+
+func (p *Pipeline) Get(key string) *Pipeline {
+	return p.Do(protocol.Commands.GET, key)
+}
+
+func (p *Pipeline) Set(key string, value string, ttl time.Duration) *Pipeline {
+	return p.Do(setArgs(key, value, ttl)...)
+}
+
+func (p *Pipeline) Delete(key string) *Pipeline {
+	return p.Do(protocol.Commands.DELETE, key)
+}
+
+// sends the queued commands, and returns their replies in the same order. the error is only for the
+// pipeline as a whole (e.g. the master couldn't be reached) - a command the server refused has it in its Result.
+func (p *Pipeline) Exec(ctx context.Context) ([]Result, error) {
+	if len(p.commands) == 0 {
+		return []Result{}, nil
+	}
+	replies, errs, err := p.client.master.pipeline(ctx, p.client.options.Timeout, p.commands)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, len(replies))
+	for i := range replies {
+		results[i] = newResult(replies[i], errs[i])
+	}
+	return results, nil
+}
+
+func newResult(reply utils.RESPValue, err error) Result {
+	if err == nil && reply.Nil {
+		return Result{IsNil: true}
+	}
+	return Result{Value: reply.String(), Err: err}
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// READ_POLICY --------------------------------------------------------------------------------
+// picks which replica a read goes to, out of the ones that are synced with the master and answering
+// (there is always at least one). returns its index, or -1 to read from the master instead.
+type ReadPolicy interface {
+	Pick(replicas []ReplicaStatus) int
+}
+
+// what a client knows of a replica
+type ReplicaStatus struct {
+	Address string
+	Online  bool          // synced with the master, as of the last refresh
+	Healthy bool          // answered the last command (or ping) sent to it
+	Latency time.Duration // moving average of how long it takes to answer
+	Lag     int           // bytes of the replication stream it is behind the master, as of the last refresh
+}
+
+// takes turns between the replicas
+func RoundRobin() ReadPolicy {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+func (p *roundRobin) Pick(replicas []ReplicaStatus) int {
+	return int((p.next.Add(1) - 1) % uint64(len(replicas)))
+}
+
+// the replica that has been answering fastest
+func LeastLatency() ReadPolicy {
+	return leastLatency{}
+}
+
+type leastLatency struct{}
+
+func (p leastLatency) Pick(replicas []ReplicaStatus) int {
+	best := 0
+	for i, replica := range replicas {
+		if replica.Latency < replicas[best].Latency {
+			best = i
+		}
+	}
+	return best
+}
+
+// only reads from replicas at most maxLag bytes behind the master (the master if none are), picking
+// between them with then
+func LagBounded(maxLag int, then ReadPolicy) ReadPolicy {
+	return lagBounded{maxLag: maxLag, then: then}
+}
+
+type lagBounded struct {
+	maxLag int
+	then   ReadPolicy
+}
+
+func (p lagBounded) Pick(replicas []ReplicaStatus) int {
+	indexes := []int{}
+	fresh := []ReplicaStatus{}
+	for i, replica := range replicas {
+		if replica.Lag <= p.maxLag {
+			indexes = append(indexes, i)
+			fresh = append(fresh, replica)
+		}
+	}
+	if len(fresh) == 0 {
+		return -1
+	}
+	if picked := p.then.Pick(fresh); picked >= 0 {
+		return indexes[picked]
+	}
+	return -1
+}
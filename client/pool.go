@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// POOL ---------------------------------------------------------------------------------------
+// connections to one node, at most size of them open at once. callers take one, use it and give it
+// back - when all are taken, the next caller waits for one to be given back.
+type pool struct {
+	address string
+	idle    []*conn
+	slots   chan struct{} // holds one value per connection in use, so it fills up at size
+	closed  bool
+	mutex   sync.Mutex
+}
+
+func newPool(address string, size int) *pool {
+	return &pool{address: address, slots: make(chan struct{}, size)}
+}
+
+// an idle connection, or a new one if there are none (and fewer than size are open)
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		<-p.slots
+		return nil, ErrClosed
+	}
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mutex.Unlock()
+		return c, nil
+	}
+	p.mutex.Unlock()
+
+	c, err := dial(ctx, p.address)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// gives back a connection taken with get - broken ones are dropped
+func (p *pool) put(c *conn) {
+	p.mutex.Lock()
+	if c.broken || p.closed {
+		c.Close()
+	} else {
+		p.idle = append(p.idle, c)
+	}
+	p.mutex.Unlock()
+	<-p.slots
+}
+
+// closes the idle connections, and the rest as they are given back
+func (p *pool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	for _, c := range p.idle {
+		c.Close()
+	}
+	p.idle = nil
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cadence/protocol"
+	"cadence/utils"
+)
+
+// FAKE_SERVER --------------------------------------------------------------------------------
+// a node on a real listener, answering every command with whatever reply returns for it. reply can
+// block (holding the connection busy), and returning nil closes the connection instead of answering.
+type fakeServer struct {
+	listener net.Listener
+	address  string
+	reply    func(args []string) []byte
+	trickle  bool // write replies a byte at a time, so they arrive in pieces
+
+	accepted int        // connections accepted so far
+	received [][]string // every command, in the order they came in
+	conns    []net.Conn
+	mutex    sync.Mutex
+}
+
+func newFakeServer(t *testing.T, reply func(args []string) []byte) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{listener: l, address: l.Addr().String(), reply: reply}
+	go s.serve()
+	t.Cleanup(s.close)
+	return s
+}
+
+// replies a master with no replicas gives to INFO and PING, and reply's for anything else
+func masterReplies(reply func(args []string) []byte) func(args []string) []byte {
+	return func(args []string) []byte {
+		switch strings.ToUpper(args[0]) {
+		case protocol.Commands.INFO:
+			return utils.BulkStringSerialize("role:master\r\nmaster_repl_offset:0\r\n")
+		case protocol.Commands.STATUS:
+			return utils.SimpleStringSerialize(protocol.Responses.ALL_GOOD)
+		}
+		return reply(args)
+	}
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.accepted++
+		s.conns = append(s.conns, conn)
+		s.mutex.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := utils.ReadBulkStringArray(r)
+		if err != nil || len(args) == 0 {
+			return
+		}
+		s.mutex.Lock()
+		s.received = append(s.received, args)
+		s.mutex.Unlock()
+
+		reply := s.reply(args)
+		if reply == nil {
+			return
+		}
+		if !s.trickle {
+			conn.Write(reply)
+			continue
+		}
+		for i := range reply {
+			conn.Write(reply[i : i+1])
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func (s *fakeServer) close() {
+	s.listener.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *fakeServer) connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.accepted
+}
+
+// the commands received so far named command (all of them if empty)
+func (s *fakeServer) commands(command string) [][]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	commands := [][]string{}
+	for _, args := range s.received {
+		if command == "" || strings.EqualFold(args[0], command) {
+			commands = append(commands, slices.Clone(args))
+		}
+	}
+	return commands
+}
+
+// waits until cond holds, failing the test if it doesn't within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
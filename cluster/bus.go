@@ -0,0 +1,542 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cadence/constants"
+	"cadence/utils"
+
+	"github.com/pkg/errors"
+)
+
+// BUS ----------------------------------------------------------------------------------------
+// gossips with the other nodes on the cluster bus, so that every node learns of every other node, which
+// slots each one serves and which ones have failed, without anything coordinating them:
+//   - every node pings a random node (and any it hasn't heard from in a while) every CLUSTER_GOSSIP_INTERVAL.
+//     every message carries the sender's slots and config epoch, and a few other nodes it knows of.
+//   - a slot goes to whichever node claims it with the highest config epoch. two nodes can't share an
+//     epoch for long - the one with the lower id moves to a new one.
+//   - a node that doesn't answer for CLUSTER_NODE_TIMEOUT is suspected to be failing (PFAIL), and once a
+//     majority of the nodes serving slots suspect it, it has failed (FAIL) and every node is told so.
+type Bus struct {
+	myself       *Node
+	nodes        map[string]*Node // by id, including myself
+	currentEpoch int              // highest epoch seen in the cluster
+	slots        *SlotMap
+	configFile   string
+	savedConfig  []byte // what was last written to configFile
+	listener     net.Listener
+	stop         chan struct{}
+	done         chan struct{}
+	mutex        sync.Mutex
+}
+
+// what is kept in the config file
+type busConfig struct {
+	Myself       string
+	CurrentEpoch int
+	Nodes        []NodeInfo
+}
+
+// BUS_STATUS ---------------------------------------------------------------------------------
+type BusStatus struct {
+	ID           string
+	CurrentEpoch int
+	ConfigEpoch  int
+	KnownNodes   int
+	Ok           bool // every slot is served, by a node that hasn't failed
+}
+
+// bus for the node clients reach at address, which gossips on its bus port. what the node knew before
+// a restart (its id, epochs, the nodes and slots) is loaded from configFile, and saved back as it changes.
+func NewBus(address string, slots *SlotMap, configFile string) (*Bus, error) {
+	busAddress, err := BusAddressOf(address)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bus{
+		nodes:      map[string]*Node{},
+		slots:      slots,
+		configFile: configFile,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if err := b.loadConfig(address, busAddress); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// private methods -------------
+func (b *Bus) loadConfig(address string, busAddress string) error {
+	data, err := os.ReadFile(b.configFile)
+	if os.IsNotExist(err) {
+		b.myself = newNode(newNodeID(), address, busAddress)
+		b.nodes[b.myself.ID] = b.myself
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "failed to read %s", b.configFile)
+	}
+
+	var config busConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return errors.Wrapf(err, "malformed %s", b.configFile)
+	}
+	b.currentEpoch = config.CurrentEpoch
+	for _, info := range config.Nodes {
+		node := newNode(info.ID, info.Address, info.BusAddress)
+		node.ConfigEpoch = info.ConfigEpoch
+		if info.ID == config.Myself {
+			// it may have been restarted at another address
+			node.Address, node.BusAddress = address, busAddress
+			b.myself = node
+		}
+		b.nodes[node.ID] = node
+		for _, r := range info.Slots {
+			for slot := r.Start; slot <= r.End; slot++ {
+				b.slots.Assign(slot, node.Address)
+			}
+		}
+	}
+	if b.myself == nil {
+		return errors.Errorf("%s doesn't say which node this is", b.configFile)
+	}
+	b.savedConfig = data
+	return nil
+}
+
+// writes the config file if anything in it changed (it is only called from the gossip loop)
+func (b *Bus) saveConfig() {
+	b.mutex.Lock()
+	config := busConfig{Myself: b.myself.ID, CurrentEpoch: b.currentEpoch, Nodes: []NodeInfo{}}
+	for _, node := range b.nodes {
+		config.Nodes = append(config.Nodes, b.info(node))
+	}
+	b.mutex.Unlock()
+	sort.Slice(config.Nodes, func(i, j int) bool { return config.Nodes[i].ID < config.Nodes[j].ID })
+
+	data, _ := json.MarshalIndent(config, "", "  ")
+	if bytes.Equal(data, b.savedConfig) {
+		return
+	}
+	tempFilename := b.configFile + ".tmp"
+	if err := os.WriteFile(tempFilename, data, 0644); err != nil {
+		fmt.Println("ERROR: failed to write cluster config,", err)
+		return
+	}
+	if err := os.Rename(tempFilename, b.configFile); err != nil {
+		fmt.Println("ERROR: failed to rename cluster config into place,", err)
+		return
+	}
+	b.savedConfig = data
+}
+
+// the node as other nodes should hear of it. must hold the lock.
+func (b *Bus) info(node *Node) NodeInfo {
+	return NodeInfo{
+		ID:          node.ID,
+		Address:     node.Address,
+		BusAddress:  node.BusAddress,
+		ConfigEpoch: node.ConfigEpoch,
+		Slots:       ToRanges(b.slots.SlotsOf(node.Address)),
+	}
+}
+
+// every node but this one. must hold the lock.
+func (b *Bus) others() []*Node {
+	others := []*Node{}
+	for _, node := range b.nodes {
+		if node != b.myself {
+			others = append(others, node)
+		}
+	}
+	return others
+}
+
+// message from this node to another (nil if it goes to every node). besides this node, it tells them
+// of a few others - always including any it thinks are failing, so the failure reports get around.
+// must hold the lock.
+func (b *Bus) message(to *Node) Message {
+	msg := Message{Sender: b.info(b.myself), CurrentEpoch: b.currentEpoch, Gossip: []GossipEntry{}}
+	others := b.others()
+	rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	sort.SliceStable(others, func(i, j int) bool { return others[i].pfail && !others[j].pfail })
+
+	count := max(3, len(others)/10)
+	for _, node := range others {
+		if len(msg.Gossip) == count {
+			break
+		}
+		if node != to {
+			entry := GossipEntry{ID: node.ID, Address: node.Address, BusAddress: node.BusAddress, Failing: node.pfail || node.fail}
+			msg.Gossip = append(msg.Gossip, entry)
+		}
+	}
+	return msg
+}
+
+// adds a node it just heard of - dropping any node it knew at the same address, which must have
+// been restarted without its config. must hold the lock.
+func (b *Bus) addNode(id string, address string, busAddress string) *Node {
+	for otherID, node := range b.nodes {
+		if node.Address == address && node != b.myself {
+			delete(b.nodes, otherID)
+		}
+	}
+	node := newNode(id, address, busAddress)
+	b.nodes[id] = node
+	fmt.Printf("Cluster node %s (%s) joined.\n", id, address)
+	return node
+}
+
+// config epoch of the node at address, -1 if it isn't known. must hold the lock.
+func (b *Bus) epochOf(address string) int {
+	for _, node := range b.nodes {
+		if node.Address == address {
+			return node.ConfigEpoch
+		}
+	}
+	return -1
+}
+
+// takes in a message from another node (or the reply to one this node sent)
+func (b *Bus) receive(msgType string, msg Message) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.currentEpoch = max(b.currentEpoch, msg.CurrentEpoch)
+	sender := b.nodes[msg.Sender.ID]
+	if sender == b.myself {
+		return
+	}
+	if sender == nil {
+		// nodes join by being met (or heard of through gossip), anything else from a stranger is ignored
+		if msgType != MEET && msgType != PONG {
+			return
+		}
+		sender = b.addNode(msg.Sender.ID, msg.Sender.Address, msg.Sender.BusAddress)
+	}
+	sender.Address, sender.BusAddress, sender.ConfigEpoch = msg.Sender.Address, msg.Sender.BusAddress, msg.Sender.ConfigEpoch
+
+	// hearing from it at all shows it is up
+	if sender.pfail || sender.fail {
+		fmt.Printf("Cluster node %s (%s) is reachable again.\n", sender.ID, sender.Address)
+	}
+	sender.pongReceived, sender.pingSent = time.Now(), time.Time{}
+	sender.pfail, sender.fail = false, false
+
+	// two nodes with the same config epoch can't tell whose claim on a slot wins
+	if sender.ConfigEpoch == b.myself.ConfigEpoch && b.myself.ID < sender.ID {
+		b.currentEpoch++
+		b.myself.ConfigEpoch = b.currentEpoch
+		fmt.Printf("Config epoch collision with %s, moved to epoch %d.\n", sender.ID, b.myself.ConfigEpoch)
+	}
+	b.claimSlots(sender, msg.Sender.Slots)
+
+	owners := b.slots.Owners()
+	for _, entry := range msg.Gossip {
+		b.hearGossip(sender, entry, owners)
+	}
+	if msgType == FAIL {
+		if node := b.nodes[msg.Failed]; node != nil && node != b.myself && !node.fail {
+			node.fail = true
+			fmt.Printf("Cluster node %s (%s) has failed, according to %s.\n", node.ID, node.Address, sender.ID)
+		}
+	}
+}
+
+// gives sender the slots it claims, unless they are served by a node with a higher config epoch. must hold the lock.
+func (b *Bus) claimSlots(sender *Node, claimed []SlotRange) {
+	moved := 0
+	for _, r := range claimed {
+		for slot := r.Start; slot <= r.End; slot++ {
+			owner := b.slots.Owner(slot)
+			if owner == sender.Address {
+				continue
+			}
+			if owner == "" || b.epochOf(owner) < sender.ConfigEpoch {
+				b.slots.Assign(slot, sender.Address)
+				moved++
+			}
+		}
+	}
+	if moved > 0 {
+		fmt.Printf("%d slots are now served by %s.\n", moved, sender.Address)
+	}
+}
+
+// takes in what sender said about another node. must hold the lock.
+func (b *Bus) hearGossip(sender *Node, entry GossipEntry, owners map[string]int) {
+	if entry.ID == b.myself.ID || entry.Address == b.myself.Address {
+		return
+	}
+	node := b.nodes[entry.ID]
+	if node == nil {
+		if !entry.Failing {
+			b.addNode(entry.ID, entry.Address, entry.BusAddress)
+		}
+		return
+	}
+
+	// only nodes serving slots get a say in whether others have failed
+	if owners[sender.Address] == 0 {
+		return
+	}
+	if entry.Failing {
+		node.failReports[sender.ID] = time.Now()
+	} else {
+		delete(node.failReports, sender.ID)
+	}
+	b.checkFailed(node, owners)
+}
+
+// marks a node this node suspects is failing as failed, once a majority of the nodes serving slots
+// suspect it too (recently), and tells every node. must hold the lock.
+func (b *Bus) checkFailed(node *Node, owners map[string]int) {
+	if !node.pfail || node.fail {
+		return
+	}
+	masters, reports := 0, 0
+	for _, n := range b.nodes {
+		if owners[n.Address] > 0 {
+			masters++
+		}
+	}
+	for id, reported := range node.failReports {
+		if time.Since(reported) > 2*constants.CLUSTER_NODE_TIMEOUT {
+			delete(node.failReports, id)
+		} else if reporter := b.nodes[id]; reporter != nil && owners[reporter.Address] > 0 {
+			reports++
+		}
+	}
+	if owners[b.myself.Address] > 0 {
+		reports++
+	}
+	if masters == 0 || reports < masters/2+1 {
+		return
+	}
+
+	node.fail = true
+	fmt.Printf("Cluster node %s (%s) has failed.\n", node.ID, node.Address)
+	msg := b.message(nil)
+	msg.Failed = node.ID
+	for _, other := range b.others() {
+		go b.send(other.BusAddress, FAIL, msg)
+	}
+}
+
+// sends a message to the node with the cluster bus at busAddress, and waits for its reply (unless it's a FAIL)
+func (b *Bus) send(busAddress string, msgType string, msg Message) (Message, error) {
+	conn, err := net.DialTimeout("tcp", busAddress, constants.CLUSTER_BUS_TIMEOUT)
+	if err != nil {
+		return Message{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(constants.CLUSTER_BUS_TIMEOUT))
+
+	payload, _ := json.Marshal(msg)
+	replies := utils.ReadFromConn(conn, func(parts []string) string { return strings.Join(parts, "") })
+	if _, err := conn.Write(utils.BulkStringArraySerialize([]string{msgType, string(payload)})); err != nil {
+		return Message{}, err
+	}
+	if msgType == FAIL {
+		return Message{}, nil
+	}
+	reply, ok := <-replies
+	if !ok {
+		return Message{}, errors.Errorf("%s closed the connection", busAddress)
+	}
+	var pong Message
+	if err := json.Unmarshal([]byte(reply), &pong); err != nil {
+		return Message{}, errors.Wrapf(err, "malformed reply from %s", busAddress)
+	}
+	return pong, nil
+}
+
+// sends a PING (or MEET) and takes in the PONG
+func (b *Bus) exchange(busAddress string, msgType string, msg Message) error {
+	pong, err := b.send(busAddress, msgType, msg)
+	if err != nil {
+		return err
+	}
+	b.receive(PONG, pong)
+	return nil
+}
+
+func (b *Bus) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return // closed by Stop
+		}
+		go b.handleConnection(conn)
+	}
+}
+
+func (b *Bus) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	for parts := range utils.ReadFromConn(conn, func(parts []string) []string { return parts }) {
+		if len(parts) != 2 {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal([]byte(parts[1]), &msg); err != nil {
+			fmt.Println("ERROR: malformed cluster bus message,", err)
+			continue
+		}
+		b.receive(parts[0], msg)
+		if parts[0] == MEET || parts[0] == PING {
+			b.mutex.Lock()
+			pong := b.message(b.nodes[msg.Sender.ID])
+			b.mutex.Unlock()
+			payload, _ := json.Marshal(pong)
+			conn.Write(utils.BulkStringSerialize(string(payload)))
+		}
+	}
+}
+
+// pings a random node and any it hasn't heard from in a while, and suspects any that haven't answered in too long
+func (b *Bus) tick() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	others := b.others()
+	targets := map[*Node]bool{}
+	if len(others) > 0 {
+		targets[others[rand.Intn(len(others))]] = true
+	}
+	owners := b.slots.Owners()
+	for _, node := range others {
+		if now.Sub(node.pongReceived) > constants.CLUSTER_NODE_TIMEOUT/2 {
+			targets[node] = true
+		}
+		if !node.pingSent.IsZero() && now.Sub(node.pingSent) > constants.CLUSTER_NODE_TIMEOUT && !node.pfail {
+			node.pfail = true
+			fmt.Printf("Cluster node %s (%s) is not answering, it may be failing.\n", node.ID, node.Address)
+		}
+		b.checkFailed(node, owners)
+	}
+
+	for node := range targets {
+		if node.pingSent.IsZero() {
+			node.pingSent = now
+		}
+		go b.exchange(node.BusAddress, PING, b.message(node))
+	}
+}
+
+func (b *Bus) gossip() {
+	defer close(b.done)
+	ticker := time.NewTicker(constants.CLUSTER_GOSSIP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.tick()
+			b.saveConfig()
+		case <-b.stop:
+			b.saveConfig()
+			return
+		}
+	}
+}
+
+// public methods -------------
+// starts listening on the bus port and gossiping with the other nodes
+func (b *Bus) Start() error {
+	_, port, _ := net.SplitHostPort(b.myself.BusAddress)
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return errors.Wrapf(err, "failed to bind cluster bus to port %s", port)
+	}
+	b.listener = l
+	go b.accept()
+	go b.gossip()
+	return nil
+}
+
+func (b *Bus) Stop() {
+	b.listener.Close()
+	close(b.stop)
+	<-b.done
+}
+
+// introduces this node to the node clients reach at address, which will tell the rest of the cluster about it
+func (b *Bus) Meet(address string) error {
+	busAddress, err := BusAddressOf(address)
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	msg := b.message(nil)
+	b.mutex.Unlock()
+	return b.exchange(busAddress, MEET, msg)
+}
+
+// moves this node to a new config epoch, higher than any other node's, so its claims on slots beat
+// theirs - e.g. once a slot has been moved to it, so the node it came from gives it up. if its epoch
+// is already the highest there is no need.
+func (b *Bus) BumpEpoch() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, node := range b.nodes {
+		if node != b.myself && node.ConfigEpoch >= b.myself.ConfigEpoch {
+			b.currentEpoch++
+			b.myself.ConfigEpoch = b.currentEpoch
+			return
+		}
+	}
+}
+
+func (b *Bus) Nodes() []NodeStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	nodes := []NodeStatus{}
+	for _, node := range b.nodes {
+		nodes = append(nodes, NodeStatus{
+			ID:           node.ID,
+			Address:      node.Address,
+			BusAddress:   node.BusAddress,
+			ConfigEpoch:  node.ConfigEpoch,
+			Myself:       node == b.myself,
+			PFail:        node.pfail,
+			Fail:         node.fail,
+			PingSent:     node.pingSent,
+			PongReceived: node.pongReceived,
+			Slots:        ToRanges(b.slots.SlotsOf(node.Address)),
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Address < nodes[j].Address })
+	return nodes
+}
+
+func (b *Bus) Status() BusStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	owners := b.slots.Owners()
+	served := 0
+	ok := true
+	for _, node := range b.nodes {
+		served += owners[node.Address]
+		if node.fail && owners[node.Address] > 0 {
+			ok = false
+		}
+	}
+	return BusStatus{
+		ID:           b.myself.ID,
+		CurrentEpoch: b.currentEpoch,
+		ConfigEpoch:  b.myself.ConfigEpoch,
+		KnownNodes:   len(b.nodes),
+		Ok:           ok && served == constants.CLUSTER_SLOTS,
+	}
+}
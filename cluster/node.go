@@ -0,0 +1,98 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"time"
+
+	"cadence/constants"
+
+	"github.com/pkg/errors"
+)
+
+// NODE ---------------------------------------------------------------------------------------
+// what this node knows of a node in the cluster (including itself)
+type Node struct {
+	ID          string
+	Address     string // host:port clients reach it at
+	BusAddress  string // host:port of its cluster bus
+	ConfigEpoch int    // its claims on slots beat claims made with a lower epoch
+
+	pingSent     time.Time            // when the ping still waiting for an answer was sent, zero if none is
+	pongReceived time.Time            // last time it was heard from
+	pfail        bool                 // this node thinks it is failing
+	fail         bool                 // enough nodes agreed it is failing
+	failReports  map[string]time.Time // when each node (by id) last said it thinks it is failing
+}
+
+func newNode(id string, address string, busAddress string) *Node {
+	return &Node{ID: id, Address: address, BusAddress: busAddress, failReports: map[string]time.Time{}}
+}
+
+func newNodeID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// host:port of the cluster bus of the node clients reach at address
+func BusAddressOf(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid address %q", address)
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum+constants.CLUSTER_BUS_PORT_OFFSET > 65535 {
+		return "", errors.Errorf("invalid port in %q", address)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(portNum+constants.CLUSTER_BUS_PORT_OFFSET)), nil
+}
+
+// NODE_STATUS --------------------------------------------------------------------------------
+// snapshot of a node, for CLUSTER NODES
+type NodeStatus struct {
+	ID           string
+	Address      string
+	BusAddress   string
+	ConfigEpoch  int
+	Myself       bool
+	PFail        bool
+	Fail         bool
+	PingSent     time.Time
+	PongReceived time.Time
+	Slots        []SlotRange
+}
+
+// MESSAGES -----------------------------------------------------------------------------------
+// sent between nodes on the cluster bus, as a [Type, JSON] bulk string array. MEET and PING are
+// answered with a PONG, FAIL isn't answered.
+const (
+	MEET = "MEET" // like PING, but asks a node that doesn't know the sender yet to add it
+	PING = "PING"
+	PONG = "PONG"
+	FAIL = "FAIL" // tells every node a node has failed
+)
+
+type Message struct {
+	Sender       NodeInfo      // the sender, as it sees itself
+	CurrentEpoch int           // highest epoch the sender has seen
+	Gossip       []GossipEntry // a few other nodes the sender knows of
+	Failed       string        `json:",omitempty"` // id of the node a FAIL is about
+}
+
+type NodeInfo struct {
+	ID          string
+	Address     string
+	BusAddress  string
+	ConfigEpoch int
+	Slots       []SlotRange // slots it claims to serve
+}
+
+type GossipEntry struct {
+	ID         string
+	Address    string
+	BusAddress string
+	Failing    bool // the sender thinks it is failing (or knows it has failed)
+}
@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"strconv"
+	"sync"
+
+	"cadence/constants"
+
+	"github.com/pkg/errors"
+)
+
+// a run of consecutive slots (Start to End inclusive), and the node serving them if it matters
+type SlotRange struct {
+	Start int
+	End   int
+	Owner string `json:",omitempty"`
+}
+
+// groups sorted slots into runs
+func ToRanges(slots []int) []SlotRange {
+	ranges := []SlotRange{}
+	for _, slot := range slots {
+		if n := len(ranges); n > 0 && ranges[n-1].End == slot-1 {
+			ranges[n-1].End = slot
+		} else {
+			ranges = append(ranges, SlotRange{Start: slot, End: slot})
+		}
+	}
+	return ranges
+}
+
+// SLOT_MAP -----------------------------------------------------------------------------------
+// which node (by host:port) serves each hash slot, and which slots are being moved between nodes
+type SlotMap struct {
+	owners    [constants.CLUSTER_SLOTS]string // empty if no node serves the slot
+	migrating map[int]string                  // slots this node is moving out, to the node taking them
+	importing map[int]string                  // slots this node is taking in, from the node moving them
+	mutex     sync.RWMutex
+}
+
+func NewSlotMap() *SlotMap {
+	return &SlotMap{migrating: map[int]string{}, importing: map[int]string{}}
+}
+
+// public methods -------------
+func (m *SlotMap) Owner(slot int) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.owners[slot]
+}
+
+// hands slot to the node at address (or unassigns it, if address is empty). the slot is no longer
+// migrating or importing after this - the move is over.
+func (m *SlotMap) Assign(slot int, address string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.owners[slot] = address
+	delete(m.migrating, slot)
+	delete(m.importing, slot)
+}
+
+// node slot is being moved to, if it is being moved out of this node
+func (m *SlotMap) Migrating(slot int) (string, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	target, migrating := m.migrating[slot]
+	return target, migrating
+}
+
+// node slot is being moved from, if it is being moved into this node
+func (m *SlotMap) Importing(slot int) (string, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	source, importing := m.importing[slot]
+	return source, importing
+}
+
+// marks slot as being moved out of this node, to the node at target
+func (m *SlotMap) SetMigrating(slot int, target string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.migrating[slot] = target
+	delete(m.importing, slot)
+}
+
+// marks slot as being moved into this node, from the node at source
+func (m *SlotMap) SetImporting(slot int, source string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.importing[slot] = source
+	delete(m.migrating, slot)
+}
+
+// calls off any move of slot
+func (m *SlotMap) SetStable(slot int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.migrating, slot)
+	delete(m.importing, slot)
+}
+
+// slots served by the node at address, in order
+func (m *SlotMap) SlotsOf(address string) []int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	slots := []int{}
+	for slot, owner := range m.owners {
+		if owner == address {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// every run of slots served by the same node, in order (unassigned slots are left out)
+func (m *SlotMap) Ranges() []SlotRange {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ranges := []SlotRange{}
+	for slot, owner := range m.owners {
+		if owner == "" {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].Owner == owner && ranges[n-1].End == slot-1 {
+			ranges[n-1].End = slot
+		} else {
+			ranges = append(ranges, SlotRange{Start: slot, End: slot, Owner: owner})
+		}
+	}
+	return ranges
+}
+
+// how many slots each node serves, by address
+func (m *SlotMap) Owners() map[string]int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	owners := map[string]int{}
+	for _, owner := range m.owners {
+		if owner != "" {
+			owners[owner]++
+		}
+	}
+	return owners
+}
+
+// parses a slot number, checking it is in range
+func ParseSlot(s string) (int, error) {
+	slot, err := strconv.Atoi(s)
+	if err != nil || slot < 0 || slot >= constants.CLUSTER_SLOTS {
+		return 0, errors.Errorf("invalid slot %q, slots go from 0 to %d", s, constants.CLUSTER_SLOTS-1)
+	}
+	return slot, nil
+}
@@ -0,0 +1,43 @@
+package cluster
+
+import (
+	"strings"
+
+	"cadence/constants"
+)
+
+// CRC16 (XMODEM - polynomial 0x1021, no reflection, initial value 0) lookup table
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func CRC16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// slot a key hashes to. if the key has a hash tag - a non empty part between the first { and the
+// first } after it - only that part is hashed, so keys sharing a tag always land on the same node.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(CRC16([]byte(key))) % constants.CLUSTER_SLOTS
+}
@@ -0,0 +1,57 @@
+package cluster
+
+import (
+	"testing"
+
+	"cadence/constants"
+)
+
+func TestCRC16(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint16
+	}{
+		{"", 0x0000},
+		{"123456789", 0x31C3}, // the XMODEM check value
+		{"A", 0x58E5},
+		{"foo", 0xAF96},
+	}
+	for _, tt := range tests {
+		if got := CRC16([]byte(tt.data)); got != tt.want {
+			t.Errorf("CRC16(%q) = 0x%04X, want 0x%04X", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key    string
+		hashed string // what the slot should be computed from
+	}{
+		{"foo", "foo"},
+		{"", ""},
+		{"{}", "{}"},                 // an empty tag doesn't count, the whole key is hashed
+		{"{a}b", "a"},                // just the tag
+		{"a{b", "a{b"},               // no closing brace
+		{"a}b{", "a}b{"},             // closing brace before the opening one
+		{"{a}{b}", "a"},              // only the first tag counts
+		{"foo{}{bar}", "foo{}{bar}"}, // the first { has an empty tag, so there is none
+		{"foo{{bar}}zap", "{bar"},    // the tag runs from the first { to the first } after it
+		{"{user1000}.following", "user1000"},
+		{"{user1000}.followers", "user1000"},
+	}
+	for _, tt := range tests {
+		want := int(CRC16([]byte(tt.hashed))) % constants.CLUSTER_SLOTS
+		if got := KeySlot(tt.key); got != want {
+			t.Errorf("KeySlot(%q) = %d, want %d (the slot of %q)", tt.key, got, want, tt.hashed)
+		}
+	}
+
+	// slots redis-cli's CLUSTER KEYSLOT gives, so clients agree with other implementations
+	known := map[string]int{"foo": 12182, "bar": 5061, "hello": 866, "123456789": 12739}
+	for key, want := range known {
+		if got := KeySlot(key); got != want {
+			t.Errorf("KeySlot(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
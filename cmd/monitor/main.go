@@ -0,0 +1,7 @@
+package main
+
+import "cadence/monitor"
+
+func main() {
+	monitor.Main()
+}
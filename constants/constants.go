@@ -8,4 +8,57 @@ const (
 	SHARD_COUNT          = 16 // TODO: take this as input later
 	CAPACITY_PER_SHARD   = 100
 	SNAPSHOT_INTERVAL    = time.Minute * 5
+	SNAPSHOT_FILE        = "snapshot.cdb"
+	REPL_BACKLOG_SIZE    = 1 << 20          // bytes of the replication stream kept for partial resyncs
+	REPL_PING_INTERVAL   = 5 * time.Second  // how often a master pings its replicas
+	REPL_ACK_INTERVAL    = time.Second      // how often a replica acknowledges its offset to its master
+	REPL_TIMEOUT         = 30 * time.Second // how long a replica waits on a silent master before reconnecting
+	REPL_MIN_BACKOFF     = 100 * time.Millisecond
+	REPL_MAX_BACKOFF     = 10 * time.Second
+	REPL_OUTPUT_LIMIT    = 64 << 20 // bytes queued for a replica before it is considered too slow and disconnected
+	AOF_FILE             = "appendonly.aof"
+	AOF_FSYNC_INTERVAL   = time.Second
+	AOF_REWRITE_PERCENT  = 100      // rewrite once the log has grown this much since the last rewrite
+	AOF_REWRITE_MIN_SIZE = 64 << 20 // never rewrite logs smaller than this (bytes)
+)
+
+// monitors
+const (
+	MONITOR_PORT             = "26380"
+	MONITOR_PING_INTERVAL    = time.Second      // how often a monitor checks on the master and its replicas
+	MONITOR_DOWN_AFTER       = 5 * time.Second  // how long the master can go without answering before a monitor thinks it is down
+	MONITOR_FAILOVER_TIMEOUT = 10 * time.Second // how long a failover (or an election for one) gets before it can be tried again
+	MONITOR_QUERY_TIMEOUT    = time.Second
+)
+
+// raft
+const (
+	RAFT_ELECTION_TIMEOUT   = 500 * time.Millisecond // followers wait up to twice this for a leader before standing for election
+	RAFT_HEARTBEAT_INTERVAL = 100 * time.Millisecond
+	RAFT_RPC_TIMEOUT        = time.Second
+	RAFT_PROPOSE_TIMEOUT    = 5 * time.Second // how long a write waits to be committed
+	RAFT_SNAPSHOT_THRESHOLD = 1000            // log entries kept before they are compacted into a snapshot
+	RAFT_MAX_BATCH          = 256             // most entries sent to a follower at once
+	RAFT_STATE_FILE         = "raft.state"
+	RAFT_SNAPSHOT_FILE      = "raft.snapshot"
+)
+
+// cluster
+const (
+	CLUSTER_SLOTS           = 16384           // keys are spread over this many hash slots, each served by one node
+	CLUSTER_BUS_PORT_OFFSET = 10000           // nodes gossip on their client port plus this
+	CLUSTER_GOSSIP_INTERVAL = 1 * time.Second // how often a node pings others on the cluster bus
+	CLUSTER_NODE_TIMEOUT    = 5 * time.Second // how long a node can go without answering a ping before it is suspected to be failing
+	CLUSTER_BUS_TIMEOUT     = 1 * time.Second // for sending a message on the cluster bus and getting the reply
+	CLUSTER_CONFIG_FILE     = "nodes.conf"    // where a node keeps its id, epochs, and the nodes and slots it knows of
+	CLUSTER_MIGRATE_BATCH   = 100             // keys moved per MIGRATE when resharding
+	CLUSTER_MIGRATE_TIMEOUT = 5 * time.Second // for a MIGRATE when resharding
+)
+
+// client
+const (
+	CLIENT_TIMEOUT          = 5 * time.Second // default for a command to get its reply
+	CLIENT_REFRESH_INTERVAL = 5 * time.Second // how often a client rediscovers a master's replicas
+	CLIENT_POOL_SIZE        = 10              // default for how many connections a client keeps open to each node
+	CLIENT_MAX_REDIRECTS    = 5               // how many MOVED/ASK redirects a cluster client follows for one command
 )
@@ -2,4 +2,4 @@ module cadence
 
 go 1.23.1
 
-require github.com/pkg/errors v0.9.1 // indirect
+require github.com/pkg/errors v0.9.1
@@ -3,6 +3,7 @@ package lru
 import (
 	"math"
 	"math/rand"
+	"slices"
 	"sync"
 	"time"
 )
@@ -26,9 +27,20 @@ type LRUCache struct {
 	clock int
 	stopJob chan struct{}
 	rng *rand.Rand
+	view *shardView // non-nil while a point in time iteration is in progress
+	onEvict func(key string) // called (with the lock held) whenever a key expires or is evicted
+	onKeys func(key string, added bool) // called (with the lock held) whenever a key is added or removed
+	passive bool // never expires or evicts keys itself, only deletes them when told to
 	mutex sync.Mutex
 }
 
+// frozen view of a shard, so it can be read at a single point in time while writes carry on
+type shardView struct {
+	keys       []string         // keys at the moment the view was taken, never mutated
+	keysShared bool             // lru.keys still shares its backing array with keys
+	preimages  map[string]Entry // entries as they were when the view was taken, saved just before they first change
+}
+
 func NewLRUCache(capacity int) *LRUCache {
 	if capacity <= 0 {
 		panic("LRU Cache capacity must be greater than 0.")
@@ -52,19 +64,114 @@ func NewLRUCache(capacity int) *LRUCache {
 func (lru *LRUCache) deleteEntry(key string) {
 	entry, exists := lru.cache[key]
 	if exists {
+		lru.preserve(key, entry)
 		delete(lru.cache, key)
-		
+		if lru.onKeys != nil {
+			lru.onKeys(key, false)
+		}
+
+		// the swap below would rearrange the view's keys, so copy them first
+		if lru.view != nil && lru.view.keysShared {
+			lru.keys = slices.Clone(lru.keys)
+			lru.view.keysShared = false
+		}
+
 		// swap key index with last index and pop
 		lastInd := len(lru.keys) - 1
 		lru.keys[entry.index], lru.keys[lastInd] = lru.keys[lastInd], lru.keys[entry.index]
 		lru.keys = lru.keys[:lastInd]
 
-		// update swapped keys entry
-		swappedKey := lru.keys[entry.index]
-		swappedEntry := lru.cache[swappedKey]
-		swappedEntry.index = entry.index
-		lru.cache[swappedKey] = swappedEntry
+		// update swapped keys entry (nothing was swapped if it was already last)
+		if entry.index < lastInd {
+			swappedKey := lru.keys[entry.index]
+			swappedEntry := lru.cache[swappedKey]
+			swappedEntry.index = entry.index
+			lru.cache[swappedKey] = swappedEntry
+		}
+	}
+}
+
+// removes a key that expired or was evicted (as opposed to explicitly deleted)
+func (lru *LRUCache) evict(key string) {
+	if _, exists := lru.cache[key]; !exists {
+		return
+	}
+	lru.deleteEntry(key)
+	if lru.onEvict != nil {
+		lru.onEvict(key)
+	}
+}
+
+func (lru *LRUCache) setEntry(key string, value string, expiryTime time.Time) {
+	entry, exists := lru.cache[key]
+
+	// create new/updated entry - set index later (depends on if exists or not)
+	newEntry := Entry{
+		value:      value,
+		expiryTime: expiryTime,
+		accessTime: lru.getClock(),
+	}
+
+	if exists {
+		// just update entry
+		lru.preserve(key, entry)
+		newEntry.index = entry.index
+		lru.cache[key] = newEntry
+	} else {
+		// set entry index, add key to keys, add entry
+		newEntry.index = len(lru.keys)
+		lru.keys = append(lru.keys, key)
+		lru.cache[key] = newEntry
+		if lru.onKeys != nil {
+			lru.onKeys(key, true)
+		}
+
+		// if exceeding capacity, perform sample removal
+		if !lru.passive && len(lru.keys) > lru.capacity {
+			lru.sampleEviction()
+		}
+	}
+}
+
+// copy on write - save the entry as it was when the view was taken, before it changes for the first time
+func (lru *LRUCache) preserve(key string, entry Entry) {
+	if lru.view == nil {
+		return
+	}
+	if _, saved := lru.view.preimages[key]; !saved {
+		lru.view.preimages[key] = entry
+	}
+}
+
+// must hold the lock
+func (lru *LRUCache) freeze() {
+	lru.view = &shardView{keys: lru.keys, keysShared: true, preimages: make(map[string]Entry)}
+}
+
+// reads up to n entries of the view starting at offset, as they were when it was taken
+func (lru *LRUCache) readView(offset int, n int) []viewEntry {
+	// set lock
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
+
+	end := min(offset+n, len(lru.view.keys))
+	entries := make([]viewEntry, 0, end-offset)
+	for _, key := range lru.view.keys[offset:end] {
+		entry, saved := lru.view.preimages[key]
+		if !saved {
+			entry = lru.cache[key] // unchanged since the view was taken
+		}
+		entries = append(entries, viewEntry{key: key, value: entry.value, expiryTime: entry.expiryTime})
 	}
+	return entries
+}
+
+func (lru *LRUCache) unfreeze() {
+	// set lock
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
+
+	lru.view = nil
 }
 
 func (lru *LRUCache) getClock() int {
@@ -84,7 +191,7 @@ func (lru *LRUCache) sampleEviction() {
 	oldest := ""
 	oldestTime := lru.clock
 
-	for i := 0; i < min(cacheSize, SAMPLE_SIZE); i++ {
+	for i := 0; i < min(cacheSize, SAMPLE_SIZE) && len(lru.keys) > 0; i++ {
 		// draw
 		key := lru.keys[lru.rng.Intn(len(lru.keys))]
 		entry, exists := lru.cache[key]
@@ -95,7 +202,7 @@ func (lru *LRUCache) sampleEviction() {
 
 		// if expired, kick
 		if !entry.expiryTime.IsZero() && !time.Now().Before(entry.expiryTime) {
-			lru.deleteEntry(key)
+			lru.evict(key)
 			continue
 		}
 		
@@ -106,7 +213,7 @@ func (lru *LRUCache) sampleEviction() {
 	}
 
 	if len(lru.keys) > lru.capacity {
-		lru.deleteEntry(oldest)
+		lru.evict(oldest)
 	}
 }
 
@@ -119,7 +226,7 @@ func (lru *LRUCache) startJanitor() {
             select {
             case <-t.C:
 				lru.mutex.Lock()
-				for len(lru.keys) > lru.capacity {
+				for !lru.passive && len(lru.keys) > lru.capacity {
 					lru.sampleEviction()
 				}
 				lru.mutex.Unlock()
@@ -132,6 +239,12 @@ func (lru *LRUCache) startJanitor() {
 
 // public methods -------------
 func (lru *LRUCache) Get(key string) (string, bool) {
+	value, _, exists := lru.GetWithExpiry(key)
+	return value, exists
+}
+
+// like Get, but also returns when the entry expires (zero time if it never does)
+func (lru *LRUCache) GetWithExpiry(key string) (string, time.Time, bool) {
 	// set lock
 	lru.mutex.Lock()
 	defer lru.mutex.Unlock()
@@ -144,54 +257,58 @@ func (lru *LRUCache) Get(key string) (string, bool) {
 			entry.accessTime = lru.getClock()
 			lru.cache[key] = entry
 
-			return entry.value, true
+			return entry.value, entry.expiryTime, true
 		} else {
-			lru.deleteEntry(key)
-			return "", false
+			// passive caches leave expired keys for whoever drives them to delete
+			if !lru.passive {
+				lru.evict(key)
+			}
+			return "", time.Time{}, false
 		}
 	}
-	return "", false
+	return "", time.Time{}, false
 }
 
-func (lru *LRUCache) Set(key string, value string, duration int) {
+// like Get, but leaves the cache exactly as it was - the entry isn't made more recent, and an expired
+// one is just reported as missing rather than evicted
+func (lru *LRUCache) Peek(key string) (string, bool) {
+	value, _, exists := lru.PeekWithExpiry(key)
+	return value, exists
+}
+
+// like Peek, but also returns when the entry expires (zero time if it never does)
+func (lru *LRUCache) PeekWithExpiry(key string) (string, time.Time, bool) {
 	// set lock
 	lru.mutex.Lock()
 	defer lru.mutex.Unlock()
 
 	entry, exists := lru.cache[key]
+	if exists && (entry.expiryTime.IsZero() || time.Now().Before(entry.expiryTime)) {
+		return entry.value, entry.expiryTime, true
+	}
+	return "", time.Time{}, false
+}
+
+func (lru *LRUCache) Set(key string, value string, duration int) {
+	// set lock
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
 
-	// create new/updated entry - if duration negative, count as infinite
-	// set index later (depends on if exists or not)
-	var newEntry Entry
+	// if duration negative, count as infinite
 	if duration >= 0 {
-		newEntry = Entry{
-			value: value,
-			expiryTime: time.Now().Add(time.Duration(duration) * time.Millisecond),
-			accessTime: lru.getClock(),			
-		}
+		lru.setEntry(key, value, time.Now().Add(time.Duration(duration) * time.Millisecond))
 	} else {
-		newEntry = Entry{
-			value: value,
-			expiryTime: time.Time{},
-			accessTime: lru.getClock(),
-		}
+		lru.setEntry(key, value, time.Time{})
 	}
+}
 
-	if exists {
-		// just update entry
-		newEntry.index = entry.index
-		lru.cache[key] = newEntry
-	} else {
-		// set entry index, add key to keys, add entry
-		newEntry.index = len(lru.keys)
-		lru.keys = append(lru.keys, key)
-		lru.cache[key] = newEntry
+// like Set, but with an absolute expiry time (zero time means it never expires)
+func (lru *LRUCache) SetWithExpiry(key string, value string, expiryTime time.Time) {
+	// set lock
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
 
-		// if exceeding capacity, perform sample removal
-		if len(lru.keys) > lru.capacity {
-			lru.sampleEviction()
-		}
-	}
+	lru.setEntry(key, value, expiryTime)
 }
 
 func (lru *LRUCache) Delete(key string) {
@@ -203,6 +320,55 @@ func (lru *LRUCache) Delete(key string) {
 	lru.deleteEntry(key)
 }
 
+// fn is called (with the lock held, so it must not use the cache) whenever a key expires or is evicted
+func (lru *LRUCache) OnEvict(fn func(key string)) {
+	// set lock
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
+
+	lru.onEvict = fn
+}
+
+// fn is called (with the lock held, so it must not use the cache) whenever a key is added or removed,
+// however it goes (deleted, expired, evicted or flushed) - not when an existing key is just overwritten
+func (lru *LRUCache) OnKeys(fn func(key string, added bool)) {
+	// set lock
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
+
+	lru.onKeys = fn
+}
+
+// a passive cache never expires or evicts keys on its own (expired keys just read as missing), so that
+// whatever drives it - e.g. a replica's master - decides exactly which keys go and when, with explicit deletes.
+// it can go over capacity in the meantime, once it stops being passive it is brought back down.
+func (lru *LRUCache) SetPassive(passive bool) {
+	// set lock
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
+
+	lru.passive = passive
+}
+
+func (lru *LRUCache) Flush() {
+	// set lock
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
+
+	// an in progress view still needs everything that is about to go
+	for key, entry := range lru.cache {
+		lru.preserve(key, entry)
+		if lru.onKeys != nil {
+			lru.onKeys(key, false)
+		}
+	}
+	if lru.view != nil {
+		lru.view.keysShared = false
+	}
+	lru.cache = make(map[string]Entry)
+	lru.keys = []string{}
+}
+
 func (lru *LRUCache) Cleanup() {
 	close(lru.stopJob)
 }
\ No newline at end of file
@@ -1,18 +1,27 @@
 package lru
 
 import (
-	"bufio"
-	"cadence/utils"
-	"fmt"
-	"os"
+	"sync"
+	"time"
 )
 
+// number of entries read from a shard per lock acquisition during Range
+const RANGE_BATCH_SIZE = 256
+
 type ShardedLRU struct {
-	shards []*LRUCache
+	shards     []*LRUCache
+	rangeMutex *sync.Mutex // only one point in time view at a time
+}
+
+// entry as it was at the point in time a Range started
+type viewEntry struct {
+	key        string
+	value      string
+	expiryTime time.Time
 }
 
 func NewShardedLRU(capacityPerShard int, shardCount int) ShardedLRU {
-	slru := ShardedLRU{shards: make([]*LRUCache, 0, shardCount)}
+	slru := ShardedLRU{shards: make([]*LRUCache, shardCount), rangeMutex: &sync.Mutex{}}
 	for i := 0; i < shardCount; i++ {
 		slru.shards[i] = NewLRUCache(capacityPerShard)
 	}
@@ -32,34 +41,95 @@ func (slru *ShardedLRU) Get(key string) (string, bool) {
 	return slru.getLRU(key).Get(key)
 }
 
+func (slru *ShardedLRU) GetWithExpiry(key string) (string, time.Time, bool) {
+	return slru.getLRU(key).GetWithExpiry(key)
+}
+
+func (slru *ShardedLRU) Peek(key string) (string, bool) {
+	return slru.getLRU(key).Peek(key)
+}
+
+func (slru *ShardedLRU) PeekWithExpiry(key string) (string, time.Time, bool) {
+	return slru.getLRU(key).PeekWithExpiry(key)
+}
+
 func (slru *ShardedLRU) Set(key string, value string, duration int) {
 	slru.getLRU(key).Set(key, value, duration)
 }
 
+func (slru *ShardedLRU) SetWithExpiry(key string, value string, expiryTime time.Time) {
+	slru.getLRU(key).SetWithExpiry(key, value, expiryTime)
+}
+
 func (slru *ShardedLRU) Delete(key string) {
 	slru.getLRU(key).Delete(key)
 }
 
-func (slru *ShardedLRU) Snapshot(filename string) {
-	f, err := os.OpenFile(filename+".txt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		panic("ERROR: error writing to snapshot file")
-		// TODO: handle this later
-	}
-		defer f.Close()
+// calls fn on every entry that was unexpired at a single point in time (expiryTime is zero if the entry never expires).
+// writes carry on while it runs - shards are copy on write, and only locked briefly per batch of entries read.
+func (slru *ShardedLRU) Range(fn func(key string, value string, expiryTime time.Time)) {
+	slru.RangeFrozen(nil, fn)
+}
+
+// like Range, but onFreeze (if not nil) is called while every shard is locked at the point in time being read,
+// so callers can line other state up with exactly that moment (e.g. start buffering writes that come after it)
+func (slru *ShardedLRU) RangeFrozen(onFreeze func(), fn func(key string, value string, expiryTime time.Time)) {
+	slru.rangeMutex.Lock()
+	defer slru.rangeMutex.Unlock()
 
+	// take the view of every shard at the same instant - always lock shards in order
+	for _, shard := range slru.shards {
+		shard.mutex.Lock()
+	}
+	now := time.Now()
+	for _, shard := range slru.shards {
+		shard.freeze()
+	}
+	if onFreeze != nil {
+		onFreeze()
+	}
+	for _, shard := range slru.shards {
+		shard.mutex.Unlock()
+	}
 
-	// use 64KB buffered writer
-	bw := bufio.NewWriterSize(f, 64<<10) 
+	// read it back in batches, calling fn without holding any lock
 	for _, shard := range slru.shards {
-		for k, entry := range shard.cache {
-			if _, err := bw.Write(utils.BulkStringArraySerialize([]string{k, entry.value})); err != nil {
-				panic("ERROR: died while writing")
+		for offset := 0; offset < len(shard.view.keys); offset += RANGE_BATCH_SIZE {
+			for _, entry := range shard.readView(offset, RANGE_BATCH_SIZE) {
+				if entry.expiryTime.IsZero() || now.Before(entry.expiryTime) {
+					fn(entry.key, entry.value, entry.expiryTime)
+				}
 			}
 		}
+		shard.unfreeze()
+	}
+}
+
+// fn is called (with a shard locked, so it must not use the cache) whenever a key expires or is evicted
+func (slru *ShardedLRU) OnEvict(fn func(key string)) {
+	for _, shard := range slru.shards {
+		shard.OnEvict(fn)
+	}
+}
+
+// fn is called (with a shard locked, so it must not use the cache) whenever a key is added or removed
+func (slru *ShardedLRU) OnKeys(fn func(key string, added bool)) {
+	for _, shard := range slru.shards {
+		shard.OnKeys(fn)
 	}
-	if err := bw.Flush(); err != nil {
-		fmt.Println("ERROR: couldn't flush buffer at end properly.")
+}
+
+// see LRUCache.SetPassive
+func (slru *ShardedLRU) SetPassive(passive bool) {
+	for _, shard := range slru.shards {
+		shard.SetPassive(passive)
+	}
+}
+
+// removes every entry from every shard
+func (slru *ShardedLRU) Flush() {
+	for _, shard := range slru.shards {
+		shard.Flush()
 	}
 }
 
@@ -0,0 +1,252 @@
+package lru
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Binary snapshot format (integers are big endian):
+
+header:   "CADENCE" magic, uint16 version
+entries:  one per key, each made of
+            byte    entry type (only ENTRY_STRING for now)
+            int64   expiry time in unix milliseconds, 0 if it never expires
+            uvarint key length, followed by the key
+            uvarint value length, followed by the value
+footer:   END_OF_SNAPSHOT byte, uint32 CRC-32 (Castagnoli) of everything before it
+*/
+
+const SNAPSHOT_MAGIC = "CADENCE"
+const SNAPSHOT_VERSION uint16 = 1
+
+const (
+	ENTRY_STRING    byte = 0x00
+	END_OF_SNAPSHOT byte = 0xFF
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// smallest possible snapshot: header and footer with no entries
+const minSnapshotSize = len(SNAPSHOT_MAGIC) + 2 + 1 + 4
+
+// single entry read back from a snapshot
+type snapshotEntry struct {
+	key        string
+	value      string
+	expiryTime time.Time
+}
+
+// writes every unexpired entry to w in the snapshot format, returns the number of entries written.
+// the snapshot is of a single point in time, onFreeze (if not nil) is called at that moment (see RangeFrozen).
+func (slru *ShardedLRU) WriteSnapshot(w io.Writer, onFreeze func()) (int, error) {
+	crc := crc32.New(crcTable)
+	hw := io.MultiWriter(w, crc)
+
+	// header
+	header := append([]byte(SNAPSHOT_MAGIC), 0, 0)
+	binary.BigEndian.PutUint16(header[len(SNAPSHOT_MAGIC):], SNAPSHOT_VERSION)
+	if _, err := hw.Write(header); err != nil {
+		return 0, err
+	}
+
+	// entries - reuse one buffer so each entry is a single write
+	written := 0
+	var writeErr error
+	buf := []byte{}
+	slru.RangeFrozen(onFreeze, func(key string, value string, expiryTime time.Time) {
+		if writeErr != nil {
+			return
+		}
+		expiry := int64(0)
+		if !expiryTime.IsZero() {
+			expiry = expiryTime.UnixMilli()
+		}
+
+		buf = append(buf[:0], ENTRY_STRING)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(expiry))
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+		buf = binary.AppendUvarint(buf, uint64(len(value)))
+		buf = append(buf, value...)
+		if _, writeErr = hw.Write(buf); writeErr == nil {
+			written++
+		}
+	})
+	if writeErr != nil {
+		return written, writeErr
+	}
+
+	// footer - the checksum covers the end marker too
+	if _, err := hw.Write([]byte{END_OF_SNAPSHOT}); err != nil {
+		return written, err
+	}
+	_, err := w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+	return written, err
+}
+
+// writes a snapshot to a temp file and renames it over filename, so a crash mid-write never
+// destroys the previous snapshot. returns the number of entries written.
+func (slru *ShardedLRU) Snapshot(filename string) (int, error) {
+	tempFilename := filename + ".tmp"
+	f, err := os.OpenFile(tempFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create snapshot file")
+	}
+	defer os.Remove(tempFilename) // no-op once renamed
+	defer f.Close()
+
+	// use 64KB buffered writer
+	bw := bufio.NewWriterSize(f, 64<<10)
+	written, err := slru.WriteSnapshot(bw, nil)
+	if err != nil {
+		return written, errors.Wrap(err, "failed to write snapshot")
+	}
+	if err := bw.Flush(); err != nil {
+		return written, errors.Wrap(err, "failed to write snapshot")
+	}
+	if err := f.Sync(); err != nil {
+		return written, errors.Wrap(err, "failed to fsync snapshot")
+	}
+	if err := f.Close(); err != nil {
+		return written, errors.Wrap(err, "failed to close snapshot")
+	}
+	if err := os.Rename(tempFilename, filename); err != nil {
+		return written, errors.Wrap(err, "failed to rename snapshot into place")
+	}
+
+	// fsync the directory so the rename itself survives a crash
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return written, nil
+}
+
+// repopulates the shards from a snapshot, returns the number of entries loaded.
+// nothing is loaded unless the whole snapshot is intact. entries that have expired since are skipped.
+func (slru *ShardedLRU) ReadSnapshot(r io.Reader) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read snapshot")
+	}
+	entries, err := parseSnapshot(data)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	loaded := 0
+	for _, entry := range entries {
+		if !entry.expiryTime.IsZero() && !now.Before(entry.expiryTime) {
+			continue
+		}
+		slru.SetWithExpiry(entry.key, entry.value, entry.expiryTime)
+		loaded++
+	}
+	return loaded, nil
+}
+
+// loads a snapshot file written by Snapshot, returns the number of entries loaded.
+// a missing file is not an error (nothing has been snapshotted yet), a truncated or corrupt one is.
+func (slru *ShardedLRU) LoadSnapshot(filename string) (int, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "failed to open snapshot")
+	}
+	defer f.Close()
+
+	loaded, err := slru.ReadSnapshot(f)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to load %s", filename)
+	}
+	return loaded, nil
+}
+
+func parseSnapshot(data []byte) ([]snapshotEntry, error) {
+	// check the frame before trusting anything inside it
+	if len(data) < minSnapshotSize {
+		return nil, errors.New("snapshot is truncated")
+	}
+	if string(data[:len(SNAPSHOT_MAGIC)]) != SNAPSHOT_MAGIC {
+		return nil, errors.New("not a snapshot file (bad magic)")
+	}
+	version := binary.BigEndian.Uint16(data[len(SNAPSHOT_MAGIC):])
+	if version != SNAPSHOT_VERSION {
+		return nil, errors.Errorf("unsupported snapshot version %d (expected %d)", version, SNAPSHOT_VERSION)
+	}
+	body, checksum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != checksum {
+		return nil, errors.New("snapshot checksum mismatch, file is truncated or corrupt")
+	}
+
+	// then read entries until the end marker
+	r := bytes.NewReader(body[len(SNAPSHOT_MAGIC)+2:])
+	entries := []snapshotEntry{}
+	for {
+		entryType, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.New("snapshot is missing its end marker")
+		}
+
+		switch entryType {
+		case END_OF_SNAPSHOT:
+			if r.Len() != 0 {
+				return nil, errors.Errorf("snapshot has %d unexpected bytes after its end marker", r.Len())
+			}
+			return entries, nil
+		case ENTRY_STRING:
+			entry, err := readSnapshotEntry(r)
+			if err != nil {
+				return nil, errors.Wrapf(err, "snapshot is corrupt at entry %d", len(entries))
+			}
+			entries = append(entries, entry)
+		default:
+			return nil, errors.Errorf("snapshot has unknown entry type 0x%02x at entry %d", entryType, len(entries))
+		}
+	}
+}
+
+func readSnapshotEntry(r *bytes.Reader) (snapshotEntry, error) {
+	var expiry int64
+	if err := binary.Read(r, binary.BigEndian, &expiry); err != nil {
+		return snapshotEntry{}, errors.Wrap(err, "failed to read expiry")
+	}
+	key, err := readSnapshotString(r)
+	if err != nil {
+		return snapshotEntry{}, errors.Wrap(err, "failed to read key")
+	}
+	value, err := readSnapshotString(r)
+	if err != nil {
+		return snapshotEntry{}, errors.Wrap(err, "failed to read value")
+	}
+
+	entry := snapshotEntry{key: key, value: value}
+	if expiry != 0 {
+		entry.expiryTime = time.UnixMilli(expiry)
+	}
+	return entry, nil
+}
+
+func readSnapshotString(r *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if length > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, length)
+	r.Read(buf)
+	return string(buf), nil
+}
@@ -0,0 +1,171 @@
+package lru
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLRU(t *testing.T) *ShardedLRU {
+	c := NewShardedLRU(100, 4)
+	t.Cleanup(c.Cleanup)
+	return &c
+}
+
+func contents(c *ShardedLRU) map[string]string {
+	got := map[string]string{}
+	c.Range(func(key string, value string, expiryTime time.Time) { got[key] = value })
+	return got
+}
+
+// a valid snapshot of a few keys
+func testSnapshot(t *testing.T) []byte {
+	c := newTestLRU(t)
+	c.Set("a", "1", -1)
+	c.Set("b", "two", -1)
+	c.Set("expiring", "3", 60000)
+	var buf bytes.Buffer
+	if _, err := c.WriteSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// replaces the checksum of data with the right one for what comes before it
+func reseal(data []byte) []byte {
+	body := data[:len(data)-4]
+	return binary.BigEndian.AppendUint32(bytes.Clone(body), crc32.Checksum(body, crcTable))
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	c := newTestLRU(t)
+	want := map[string]string{
+		"a":                      "1",
+		"":                       "empty key",
+		"empty value":            "",
+		"binary\x00\xff":         "\r\n\x00",
+		strings.Repeat("k", 300): strings.Repeat("v", 70000), // lengths that take more than one varint byte
+	}
+	for key, value := range want {
+		c.Set(key, value, -1)
+	}
+	expiry := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	c.SetWithExpiry("expiring", "1", expiry)
+	want["expiring"] = "1"
+
+	filename := filepath.Join(t.TempDir(), "snapshot.cdb")
+	written, err := c.Snapshot(filename)
+	if err != nil || written != len(want) {
+		t.Fatalf("wrote %d entries (%v), want %d", written, err, len(want))
+	}
+
+	restored := newTestLRU(t)
+	loaded, err := restored.LoadSnapshot(filename)
+	if err != nil || loaded != len(want) {
+		t.Fatalf("loaded %d entries (%v), want %d", loaded, err, len(want))
+	}
+	got := contents(restored)
+	for key, value := range want {
+		if got[key] != value {
+			t.Fatalf("%q restored as %q, want %q", key, got[key], value)
+		}
+	}
+	if _, expiryTime, _ := restored.GetWithExpiry("expiring"); !expiryTime.Equal(expiry) {
+		t.Fatalf("expiry restored as %v, want %v", expiryTime, expiry)
+	}
+}
+
+func TestSnapshotSkipsExpired(t *testing.T) {
+	c := newTestLRU(t)
+	c.Set("kept", "1", -1)
+	c.Set("expires", "1", 20)
+	var buf bytes.Buffer
+	if written, err := c.WriteSnapshot(&buf, nil); err != nil || written != 2 {
+		t.Fatalf("wrote %d entries (%v), want 2", written, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	restored := newTestLRU(t)
+	loaded, err := restored.ReadSnapshot(&buf)
+	if err != nil || loaded != 1 {
+		t.Fatalf("loaded %d entries (%v), want 1", loaded, err)
+	}
+	if _, ok := restored.Peek("expires"); ok {
+		t.Fatal("loaded a key that expired after the snapshot was taken")
+	}
+}
+
+func TestSnapshotMissingFile(t *testing.T) {
+	loaded, err := newTestLRU(t).LoadSnapshot(filepath.Join(t.TempDir(), "snapshot.cdb"))
+	if err != nil || loaded != 0 {
+		t.Fatalf("loaded %d entries (%v) from a file that doesn't exist", loaded, err)
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	headerSize := len(SNAPSHOT_MAGIC) + 2
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		err     string
+	}{
+		{"empty", func(data []byte) []byte { return nil }, "truncated"},
+		{"header only", func(data []byte) []byte { return data[:headerSize] }, "truncated"},
+		{"missing last byte", func(data []byte) []byte { return data[:len(data)-1] }, "checksum mismatch"},
+		{"cut in half", func(data []byte) []byte { return data[:len(data)/2] }, "checksum mismatch"},
+		{"flipped bit in an entry", func(data []byte) []byte {
+			data[headerSize+3] ^= 0x01
+			return data
+		}, "checksum mismatch"},
+		{"flipped bit in the checksum", func(data []byte) []byte {
+			data[len(data)-1] ^= 0x01
+			return data
+		}, "checksum mismatch"},
+		{"bad magic", func(data []byte) []byte {
+			copy(data, "REDIS00")
+			return data
+		}, "bad magic"},
+		{"newer version", func(data []byte) []byte {
+			binary.BigEndian.PutUint16(data[len(SNAPSHOT_MAGIC):], SNAPSHOT_VERSION+1)
+			return reseal(data)
+		}, "unsupported snapshot version 2"},
+		{"version 0", func(data []byte) []byte {
+			binary.BigEndian.PutUint16(data[len(SNAPSHOT_MAGIC):], 0)
+			return reseal(data)
+		}, "unsupported snapshot version 0"},
+		{"unknown entry type", func(data []byte) []byte {
+			data[headerSize] = 0x07
+			return reseal(data)
+		}, "unknown entry type 0x07"},
+		{"no end marker", func(data []byte) []byte {
+			body := data[:len(data)-5]
+			return binary.BigEndian.AppendUint32(bytes.Clone(body), crc32.Checksum(body, crcTable))
+		}, "missing its end marker"},
+		{"bytes after end marker", func(data []byte) []byte {
+			data = append(data[:len(data)-4:len(data)-4], 0x00, 0x00, 0, 0, 0, 0)
+			return reseal(data)
+		}, "unexpected bytes after its end marker"},
+		{"key longer than the snapshot", func(data []byte) []byte {
+			data[headerSize+1+8] = 0x7f
+			return reseal(data)
+		}, "corrupt at entry 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestLRU(t)
+			c.Set("existing", "1", -1)
+			loaded, err := c.ReadSnapshot(bytes.NewReader(tt.corrupt(testSnapshot(t))))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want one saying %q", err, tt.err)
+			}
+			// a bad snapshot loads nothing at all
+			if got := contents(c); loaded != 0 || len(got) != 1 {
+				t.Fatalf("loaded %d entries from a bad snapshot, cache now has %v", loaded, got)
+			}
+		})
+	}
+}
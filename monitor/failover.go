@@ -0,0 +1,134 @@
+package monitor
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"cadence/constants"
+)
+
+// once this monitor thinks the master is down, asks the other monitors whether they agree.
+// if the quorum does, it tries to get elected to lead the failover.
+func (m *Monitor) checkMaster() {
+	m.mutex.Lock()
+	down := m.masterDown()
+	masterAddress := m.masterAddress
+	waiting := time.Now().Before(m.failoverUntil)
+	m.mutex.Unlock()
+	if !down || waiting {
+		return
+	}
+
+	host, port, _ := net.SplitHostPort(masterAddress)
+	agreed := 1
+	for _, peer := range m.peers {
+		if reply, err := query(peer, Commands.IS_MASTER_DOWN, host, port); err == nil && reply == "1" {
+			agreed++
+		}
+	}
+	if agreed < m.quorum {
+		fmt.Printf("Master %s looks down, but only %d of %d monitors needed agree.\n", masterAddress, agreed, m.quorum)
+		return
+	}
+	fmt.Printf("Master %s is down (%d monitors agree), starting election.\n", masterAddress, agreed)
+	m.startFailover(masterAddress)
+}
+
+// votes for the first monitor to ask in each epoch, returns who this monitor voted for
+func (m *Monitor) vote(epoch int, candidate string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.epoch = max(m.epoch, epoch)
+	if epoch > m.votedEpoch {
+		m.votedEpoch, m.votedFor = epoch, candidate
+		// let the candidate get on with it rather than competing
+		m.failoverUntil = time.Now().Add(constants.MONITOR_FAILOVER_TIMEOUT)
+	}
+	return m.votedFor
+}
+
+// stands for election in a new epoch, and fails over if a majority of monitors (and at least the quorum) vote for it.
+// win or lose, no other failover is started for MONITOR_FAILOVER_TIMEOUT (plus some jitter, so monitors
+// that split the vote don't just split it again).
+func (m *Monitor) startFailover(masterAddress string) {
+	m.mutex.Lock()
+	// another monitor may have asked for our vote (or finished a failover) while we were asking around
+	if time.Now().Before(m.failoverUntil) || m.masterAddress != masterAddress {
+		m.mutex.Unlock()
+		return
+	}
+	m.epoch++
+	epoch := m.epoch
+	m.votedEpoch, m.votedFor = epoch, m.id
+	jitter := time.Duration(rand.Int63n(int64(constants.MONITOR_FAILOVER_TIMEOUT)))
+	m.failoverUntil = time.Now().Add(constants.MONITOR_FAILOVER_TIMEOUT + jitter)
+	m.mutex.Unlock()
+
+	votes := 1
+	for _, peer := range m.peers {
+		if votedFor, err := query(peer, Commands.VOTE, strconv.Itoa(epoch), m.id); err == nil && votedFor == m.id {
+			votes++
+		}
+	}
+	needed := max((len(m.peers)+1)/2+1, m.quorum)
+	if votes < needed {
+		fmt.Printf("Lost election for epoch %d (%d of %d votes needed).\n", epoch, votes, needed)
+		return
+	}
+	fmt.Printf("Won election for epoch %d, failing over.\n", epoch)
+	m.failover(epoch)
+}
+
+// promotes the replica that got furthest through the replication stream, points the rest at it,
+// and tells the other monitors where the master is now
+func (m *Monitor) failover(epoch int) {
+	m.mutex.Lock()
+	promoted, best := "", -1
+	others := []string{}
+	for address, replica := range m.replicas {
+		others = append(others, address)
+		if replica.role != "slave" || time.Since(replica.lastReply) > m.downAfter {
+			continue
+		}
+		if replica.offset > best || (replica.offset == best && address < promoted) {
+			promoted, best = address, replica.offset
+		}
+	}
+	m.mutex.Unlock()
+	if promoted == "" {
+		fmt.Println("ERROR: no replica is reachable, cannot fail over")
+		return
+	}
+
+	fmt.Printf("Promoting %s (at offset %d).\n", promoted, best)
+	if err := replicaOf(promoted, ""); err != nil {
+		fmt.Println("ERROR: could not promote", promoted+":", err)
+		return
+	}
+	m.mutex.Lock()
+	m.masterEpoch = epoch
+	m.switchMaster(promoted)
+	m.mutex.Unlock()
+
+	for _, address := range others {
+		if address == promoted {
+			continue
+		}
+		if err := replicaOf(address, promoted); err != nil {
+			// it is pointed at the new master once it is reachable again
+			fmt.Println("ERROR: could not reconfigure", address+":", err)
+		}
+	}
+
+	host, port, _ := net.SplitHostPort(promoted)
+	for _, peer := range m.peers {
+		if _, err := query(peer, Commands.SWITCH_MASTER, strconv.Itoa(epoch), host, port); err != nil {
+			fmt.Println("ERROR: could not tell monitor", peer, "about the new master:", err)
+		}
+	}
+	fmt.Println("Failover done, new master is", promoted)
+}
@@ -0,0 +1,285 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cadence/protocol"
+	"cadence/utils"
+)
+
+// FAKE_NODE ----------------------------------------------------------------------------------
+// answers INFO, PING and REPLICAOF the way a node would, and records every REPLICAOF it gets
+type fakeNode struct {
+	listener net.Listener
+	address  string
+
+	role      string
+	offset    int
+	following string   // address of its master, if it is a replica
+	replicas  []string // addresses listed in its INFO, if it is a master
+	replicaOf []string // REPLICAOF targets it was sent, "NO ONE" for a promotion
+	conns     []net.Conn
+	mutex     sync.Mutex
+}
+
+func newFakeNode(t *testing.T, role string, offset int) *fakeNode {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &fakeNode{listener: l, address: l.Addr().String(), role: role, offset: offset}
+	go n.serve()
+	t.Cleanup(n.stop)
+	return n
+}
+
+func (n *fakeNode) serve() {
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			return
+		}
+		n.mutex.Lock()
+		n.conns = append(n.conns, conn)
+		n.mutex.Unlock()
+		go n.handle(conn)
+	}
+}
+
+func (n *fakeNode) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		parts, err := utils.ReadBulkStringArray(r)
+		if err != nil || len(parts) == 0 {
+			return
+		}
+		conn.Write(n.execute(strings.ToUpper(parts[0]), parts[1:]))
+	}
+}
+
+func (n *fakeNode) execute(command string, args []string) []byte {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	switch command {
+	case protocol.Commands.STATUS:
+		return utils.SimpleStringSerialize(protocol.Responses.ALL_GOOD)
+	case protocol.Commands.INFO:
+		info := fmt.Sprintf("role:%s\r\nmaster_repl_offset:%d\r\n", n.role, n.offset)
+		if n.role == "slave" {
+			host, port, _ := net.SplitHostPort(n.following)
+			info += fmt.Sprintf("master_host:%s\r\nmaster_port:%s\r\n", host, port)
+		}
+		for i, replica := range n.replicas {
+			host, port, _ := net.SplitHostPort(replica)
+			info += fmt.Sprintf("slave%d:ip=%s,port=%s,state=online,offset=%d\r\n", i, host, port, n.offset)
+		}
+		return utils.BulkStringSerialize(info)
+	case protocol.Commands.REPLICA_OF:
+		if strings.ToUpper(args[0]) == "NO" {
+			n.role, n.following = "master", ""
+			n.replicaOf = append(n.replicaOf, "NO ONE")
+		} else {
+			n.role, n.following = "slave", net.JoinHostPort(args[0], args[1])
+			n.replicaOf = append(n.replicaOf, n.following)
+		}
+		return utils.SimpleStringSerialize(protocol.Responses.OKAY)
+	}
+	return utils.ErrorSerialize(utils.ErrorCodes.ERR, "Invalid command.")
+}
+
+// stops answering, like a node that crashed
+func (n *fakeNode) stop() {
+	n.listener.Close()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, conn := range n.conns {
+		conn.Close()
+	}
+}
+
+func (n *fakeNode) replicaOfCommands() []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return slices.Clone(n.replicaOf)
+}
+
+// TEST_SETUP ---------------------------------------------------------------------------------
+// a master with replicas at the given offsets, all following it
+func newFakeReplicationGroup(t *testing.T, offsets ...int) (*fakeNode, []*fakeNode) {
+	master := newFakeNode(t, "master", 0)
+	replicas := []*fakeNode{}
+	for _, offset := range offsets {
+		replica := newFakeNode(t, "slave", offset)
+		replica.following = master.address
+		master.replicas = append(master.replicas, replica.address)
+		master.offset = max(master.offset, offset)
+		replicas = append(replicas, replica)
+	}
+	return master, replicas
+}
+
+// a monitor of masterAddress answering on a port of its own, for other monitors to query
+func newServedMonitor(t *testing.T, masterAddress string) (*Monitor, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	m := NewMonitor(masterAddress, nil, 1, time.Minute)
+	go m.Serve(l)
+	return m, l.Addr().String()
+}
+
+// as if the master had not answered for longer than downAfter
+func markMasterDown(m *Monitor) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.master.lastReply = time.Time{}
+}
+
+// TESTS --------------------------------------------------------------------------------------
+func TestQuorum(t *testing.T) {
+	tests := []struct {
+		name       string
+		peersAgree int
+		quorum     int
+		failover   bool
+	}{
+		{"alone is not enough", 0, 2, false},
+		{"one peer agrees", 1, 2, true},
+		{"quorum of all three", 1, 3, false},
+		{"all agree", 2, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			master, replicas := newFakeReplicationGroup(t, 10)
+			peers := []string{}
+			for i := 0; i < 2; i++ {
+				peer, address := newServedMonitor(t, master.address)
+				if i < tt.peersAgree {
+					markMasterDown(peer)
+				}
+				peers = append(peers, address)
+			}
+			m := NewMonitor(master.address, peers, tt.quorum, time.Minute)
+			m.checkNodes()
+			master.stop()
+			markMasterDown(m)
+
+			m.checkMaster()
+			promoted := slices.Equal(replicas[0].replicaOfCommands(), []string{"NO ONE"})
+			if promoted != tt.failover {
+				t.Fatalf("failed over: %v, expected %v", promoted, tt.failover)
+			}
+			if tt.failover && m.MasterAddress() != replicas[0].address {
+				t.Fatalf("master is %s, expected %s", m.MasterAddress(), replicas[0].address)
+			}
+			if !tt.failover && m.MasterAddress() != master.address {
+				t.Fatalf("master moved to %s without a quorum", m.MasterAddress())
+			}
+		})
+	}
+}
+
+func TestVote(t *testing.T) {
+	m := NewMonitor("127.0.0.1:1", nil, 1, time.Minute)
+	steps := []struct {
+		epoch     int
+		candidate string
+		expected  string
+	}{
+		{1, "a", "a"},
+		{1, "b", "a"}, // first to ask in an epoch gets the vote
+		{1, "a", "a"},
+		{2, "b", "b"},
+		{1, "a", "b"}, // an old epoch doesn't take it back
+	}
+	for _, step := range steps {
+		if votedFor := m.vote(step.epoch, step.candidate); votedFor != step.expected {
+			t.Fatalf("vote(%d, %s) = %s, expected %s", step.epoch, step.candidate, votedFor, step.expected)
+		}
+	}
+	if m.epoch != 2 {
+		t.Fatalf("epoch is %d, expected 2", m.epoch)
+	}
+}
+
+func TestElection(t *testing.T) {
+	tests := []struct {
+		name     string
+		votedFor []string // who each of the two peers already voted for in epoch 1, "" if nobody
+		elected  bool
+	}{
+		{"both vote for it", []string{"", ""}, true},
+		{"one already voted", []string{"other", ""}, true},
+		{"both already voted", []string{"other", "other"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			master, replicas := newFakeReplicationGroup(t, 10)
+			peers := []string{}
+			for _, votedFor := range tt.votedFor {
+				peer, address := newServedMonitor(t, master.address)
+				if votedFor != "" {
+					peer.vote(1, votedFor)
+				}
+				peers = append(peers, address)
+			}
+			m := NewMonitor(master.address, peers, 1, time.Minute)
+			m.checkNodes()
+			master.stop()
+
+			m.startFailover(master.address)
+			elected := m.MasterAddress() == replicas[0].address
+			if elected != tt.elected {
+				t.Fatalf("elected: %v, expected %v", elected, tt.elected)
+			}
+			if !tt.elected && len(replicas[0].replicaOfCommands()) != 0 {
+				t.Fatalf("a monitor that lost the election reconfigured %s", replicas[0].address)
+			}
+		})
+	}
+}
+
+func TestPromotion(t *testing.T) {
+	// the replica furthest along is down, so the next one is promoted
+	master, replicas := newFakeReplicationGroup(t, 100, 300, 500, 200)
+	replicas[2].stop()
+	peer, peerAddress := newServedMonitor(t, master.address)
+	m := NewMonitor(master.address, []string{peerAddress}, 1, time.Minute)
+	m.checkNodes()
+	master.stop()
+
+	m.failover(1)
+	promoted := replicas[1]
+	if m.MasterAddress() != promoted.address {
+		t.Fatalf("promoted %s, expected %s", m.MasterAddress(), promoted.address)
+	}
+	if commands := promoted.replicaOfCommands(); !slices.Equal(commands, []string{"NO ONE"}) {
+		t.Fatalf("promoted replica got %v", commands)
+	}
+	for _, replica := range []*fakeNode{replicas[0], replicas[3]} {
+		if commands := replica.replicaOfCommands(); !slices.Equal(commands, []string{promoted.address}) {
+			t.Fatalf("%s got %v, expected to be pointed at %s", replica.address, commands, promoted.address)
+		}
+	}
+	if peer.MasterAddress() != promoted.address {
+		t.Fatalf("peer monitor thinks the master is %s", peer.MasterAddress())
+	}
+
+	// the old master is made a replica of the new one once it is back
+	m.mutex.Lock()
+	_, kept := m.replicas[master.address]
+	m.mutex.Unlock()
+	if !kept {
+		t.Fatal("old master is no longer watched")
+	}
+}
@@ -0,0 +1,260 @@
+package monitor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cadence/constants"
+	"cadence/protocol"
+	"cadence/utils"
+)
+
+/*
+A monitor watches a master and its replicas. Once enough monitors (the quorum) agree the master is down,
+one of them is elected to fail over: it promotes the most up to date replica and points the others at it.
+Clients ask any monitor where the master currently is.
+
+Commands supported:
+
+PING
+GET-MASTER-ADDR - host and port of the current master
+IS-MASTER-DOWN host port - 1 if this monitor thinks the master at host:port is down, otherwise 0
+VOTE epoch monitor_id - asks for this monitor's vote to lead the failover of epoch, replies with who it voted for
+SWITCH-MASTER epoch host port - sent by the leader once a failover is done, host:port is the new master
+*/
+
+var Commands = struct {
+	STATUS          string
+	GET_MASTER_ADDR string
+	IS_MASTER_DOWN  string
+	VOTE            string
+	SWITCH_MASTER   string
+}{
+	STATUS:          "PING",
+	GET_MASTER_ADDR: "GET-MASTER-ADDR",
+	IS_MASTER_DOWN:  "IS-MASTER-DOWN",
+	VOTE:            "VOTE",
+	SWITCH_MASTER:   "SWITCH-MASTER",
+}
+
+// NODE_STATE ---------------------------------------------------------------------------------
+// what a monitor last heard from a node
+type NodeState struct {
+	lastReply time.Time // last time it answered, zero if it never has
+	role      string    // "master" or "slave"
+	offset    int       // replication offset it got up to
+}
+
+// REQUEST ---------------------------------------------------------------------------------
+// a command sent to a monitor
+type request struct {
+	command string
+	args    []string
+}
+
+func newRequest(rawParts []string) request {
+	if len(rawParts) == 0 {
+		return request{}
+	}
+	return request{command: rawParts[0], args: rawParts[1:]}
+}
+
+// MONITOR ------------------------------------------------------------------------------------
+type Monitor struct {
+	id            string
+	masterAddress string
+	master        NodeState
+	replicas      map[string]*NodeState // by address, discovered from the master's INFO
+	peers         []string              // addresses of the other monitors watching the same master
+	quorum        int                   // monitors that have to agree the master is down before failing over
+	downAfter     time.Duration
+
+	epoch         int // every failover attempt gets a new epoch
+	masterEpoch   int // epoch of the failover that made the current master, 0 if none has happened
+	votedEpoch    int // latest epoch this monitor voted in, and who for
+	votedFor      string
+	failoverUntil time.Time // no failover is started before this, one is in progress (or was just tried)
+	mutex         sync.Mutex
+}
+
+func NewMonitor(masterAddress string, peers []string, quorum int, downAfter time.Duration) *Monitor {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return &Monitor{
+		id:            hex.EncodeToString(id),
+		masterAddress: masterAddress,
+		master:        NodeState{lastReply: time.Now()}, // give it downAfter to answer at startup
+		replicas:      map[string]*NodeState{},
+		peers:         peers,
+		quorum:        quorum,
+		downAfter:     downAfter,
+	}
+}
+
+// private methods -------------
+// must hold the lock
+func (m *Monitor) masterDown() bool {
+	return time.Since(m.master.lastReply) > m.downAfter
+}
+
+// makes address the master, the old one is kept as a replica (so it is pointed at the new one if it comes back).
+// must hold the lock
+func (m *Monitor) switchMaster(address string) {
+	if address == m.masterAddress {
+		return
+	}
+	fmt.Printf("Switching master from %s to %s.\n", m.masterAddress, address)
+	old := m.masterAddress
+	m.replicas[old] = &NodeState{}
+	m.masterAddress = address
+	if state, ok := m.replicas[address]; ok {
+		m.master = *state
+		delete(m.replicas, address)
+	} else {
+		m.master = NodeState{}
+	}
+	m.master.lastReply = time.Now()
+	m.master.role = "master"
+}
+
+func (m *Monitor) handleConnection(conn net.Conn, requests chan request) {
+	defer conn.Close()
+	for req := range requests {
+		conn.Write(m.execute(req))
+	}
+}
+
+func (m *Monitor) execute(req request) []byte {
+	args := req.args
+	switch strings.ToUpper(req.command) {
+	case Commands.STATUS:
+		return utils.SimpleStringSerialize(protocol.Responses.ALL_GOOD)
+
+	case Commands.GET_MASTER_ADDR:
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		host, port, _ := net.SplitHostPort(m.masterAddress)
+		return utils.BulkStringArraySerialize([]string{host, port})
+
+	case Commands.IS_MASTER_DOWN:
+		if len(args) != 2 {
+			break
+		}
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if net.JoinHostPort(args[0], args[1]) == m.masterAddress && m.masterDown() {
+			return utils.SimpleStringSerialize("1")
+		}
+		return utils.SimpleStringSerialize("0")
+
+	case Commands.VOTE:
+		if len(args) != 2 {
+			break
+		}
+		epoch, err := strconv.Atoi(args[0])
+		if err != nil || epoch < 1 {
+			break
+		}
+		return utils.BulkStringSerialize(m.vote(epoch, args[1]))
+
+	case Commands.SWITCH_MASTER:
+		if len(args) != 3 {
+			break
+		}
+		epoch, err := strconv.Atoi(args[0])
+		if err != nil {
+			break
+		}
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		// a monitor that stood in a later (failed) election still takes the result of an earlier one
+		if epoch > m.masterEpoch {
+			m.epoch = max(m.epoch, epoch)
+			m.masterEpoch = epoch
+			m.switchMaster(net.JoinHostPort(args[1], args[2]))
+			m.failoverUntil = time.Now().Add(constants.MONITOR_FAILOVER_TIMEOUT)
+		}
+		return utils.SimpleStringSerialize(protocol.Responses.OKAY)
+
+	default:
+		return utils.ErrorSerialize(utils.ErrorCodes.ERR, "Invalid command.")
+	}
+	return utils.ErrorSerialize(utils.ErrorCodes.ERR, "Invalid use of command.")
+}
+
+// public methods -------------
+// checks on the master and its replicas every MONITOR_PING_INTERVAL, failing over if the master is down
+func (m *Monitor) Watch() {
+	t := time.NewTicker(constants.MONITOR_PING_INTERVAL)
+	defer t.Stop()
+	for range t.C {
+		m.checkNodes()
+		m.checkMaster()
+	}
+}
+
+func (m *Monitor) MasterAddress() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.masterAddress
+}
+
+// answers the commands of clients and other monitors on l, until it is closed
+func (m *Monitor) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go m.handleConnection(c, utils.ReadFromConn(c, newRequest))
+	}
+}
+
+// runs a monitor configured from the command line flags
+func Main() {
+	port := flag.String("port", constants.MONITOR_PORT, "the port the monitor listens on")
+	master := flag.String("master", "", "address of the master to monitor (host:port)")
+	peers := flag.String("peers", "", "comma separated addresses of the other monitors watching the same master")
+	quorum := flag.Int("quorum", 2, "how many monitors have to agree the master is down before failing over")
+	downAfter := flag.Duration("down-after", constants.MONITOR_DOWN_AFTER, "how long the master can go without answering before it is considered down")
+	flag.Parse()
+
+	if *master == "" {
+		fmt.Println("ERROR: --master is required")
+		os.Exit(1)
+	}
+	peerList := []string{}
+	for _, peer := range strings.Split(*peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peerList = append(peerList, peer)
+		}
+	}
+	if *quorum < 1 || *quorum > len(peerList)+1 {
+		fmt.Println("ERROR: --quorum must be between 1 and the number of monitors")
+		os.Exit(1)
+	}
+
+	m := NewMonitor(*master, peerList, *quorum, *downAfter)
+	go m.Watch()
+
+	fmt.Printf("Starting monitor of %s at port %s...\n", *master, *port)
+	l, err := net.Listen("tcp", ":"+*port)
+	if err != nil {
+		fmt.Println("Failed to bind to port " + *port)
+		os.Exit(1)
+	}
+	defer l.Close()
+
+	if err := m.Serve(l); err != nil {
+		fmt.Println("Error accepting connection: ", err.Error())
+		os.Exit(1)
+	}
+}
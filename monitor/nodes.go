@@ -0,0 +1,149 @@
+package monitor
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"cadence/constants"
+	"cadence/protocol"
+	"cadence/utils"
+
+	"github.com/pkg/errors"
+)
+
+// sends a command to a node (or another monitor) on a connection of its own, and waits for the reply
+func query(address string, args ...string) (string, error) {
+	conn, err := net.DialTimeout("tcp", address, constants.MONITOR_QUERY_TIMEOUT)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(constants.MONITOR_QUERY_TIMEOUT))
+
+	responses := utils.ReadRepliesFromConn(conn, protocol.NewResponse)
+	if _, err := conn.Write(utils.BulkStringArraySerialize(args)); err != nil {
+		return "", err
+	}
+	response, ok := <-responses
+	if !ok {
+		return "", errors.Errorf("%s closed the connection", address)
+	}
+	if response.Err != nil {
+		return "", response.Err
+	}
+	return response.String(), nil
+}
+
+// splits an INFO reply into its fields
+func parseInfo(info string) map[string]string {
+	fields := map[string]string{}
+	for _, line := range strings.Split(info, "\r\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// addresses of the replicas listed in a master's INFO (slaveN:ip=...,port=...,...)
+func replicaAddresses(fields map[string]string) []string {
+	addresses := []string{}
+	for key, value := range fields {
+		if !strings.HasPrefix(key, "slave") {
+			continue
+		}
+		var host, port string
+		for _, part := range strings.Split(value, ",") {
+			name, v, _ := strings.Cut(part, "=")
+			switch name {
+			case "ip":
+				host = v
+			case "port":
+				port = v
+			}
+		}
+		if host != "" && port != "" {
+			addresses = append(addresses, net.JoinHostPort(host, port))
+		}
+	}
+	return addresses
+}
+
+// asks a node for its INFO, returns what it said or an error if it didn't answer
+func checkNode(address string) (NodeState, map[string]string, error) {
+	info, err := query(address, protocol.Commands.INFO)
+	if err != nil {
+		return NodeState{}, nil, err
+	}
+	fields := parseInfo(info)
+	offset, _ := strconv.Atoi(fields["master_repl_offset"])
+	return NodeState{lastReply: time.Now(), role: fields["role"], offset: offset}, fields, nil
+}
+
+// checks on the master and every replica, picking up replicas the master has gained since.
+// replicas following some other node (or an old master coming back, claiming to be one) are pointed at the real one.
+func (m *Monitor) checkNodes() {
+	m.mutex.Lock()
+	masterAddress := m.masterAddress
+	addresses := []string{}
+	for address := range m.replicas {
+		addresses = append(addresses, address)
+	}
+	m.mutex.Unlock()
+
+	// master
+	state, fields, err := checkNode(masterAddress)
+	m.mutex.Lock()
+	if err == nil && masterAddress == m.masterAddress {
+		m.master = state
+		for _, address := range replicaAddresses(fields) {
+			if _, known := m.replicas[address]; !known && address != m.masterAddress {
+				fmt.Println("Discovered replica at", address)
+				m.replicas[address] = &NodeState{}
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	m.mutex.Unlock()
+
+	// replicas
+	for _, address := range addresses {
+		state, fields, err := checkNode(address)
+		if err != nil {
+			continue
+		}
+		following := net.JoinHostPort(fields["master_host"], fields["master_port"])
+
+		m.mutex.Lock()
+		replica, known := m.replicas[address]
+		if known {
+			*replica = state
+		}
+		masterAddress := m.masterAddress
+		stray := known && (state.role == "master" || following != masterAddress) && !time.Now().Before(m.failoverUntil)
+		m.mutex.Unlock()
+
+		if stray {
+			fmt.Printf("%s is not replicating from %s, pointing it there\n", address, masterAddress)
+			if err := replicaOf(address, masterAddress); err != nil {
+				fmt.Println("ERROR: could not reconfigure", address+":", err)
+			}
+		}
+	}
+}
+
+// REPLICAOF host port, or REPLICAOF NO ONE if masterAddress is empty
+func replicaOf(address string, masterAddress string) error {
+	host, port := "NO", "ONE"
+	if masterAddress != "" {
+		var err error
+		if host, port, err = net.SplitHostPort(masterAddress); err != nil {
+			return err
+		}
+	}
+	_, err := query(address, protocol.Commands.REPLICA_OF, host, port)
+	return err
+}
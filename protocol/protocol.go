@@ -0,0 +1,78 @@
+package protocol
+
+import "cadence/utils"
+
+// COMMANDS -----------------------------------------------------------------------------------
+// the names of commands and replies, shared by the server and everything that talks to it (clients, the cli,
+// the monitor) without having to link the whole server in. an explicit struct so they can easily be changed.
+var Commands = struct {
+	STATUS       string
+	INFO         string
+	ECHO         string
+	GET          string
+	SET          string
+	DELETE       string
+	PRINT        string
+	REPLICA_SYNC string
+	FULL_SYNC    string
+	PARTIAL_SYNC string
+	REPLICA_CONF string
+	WAIT         string
+	REPLICA_OF   string
+	RAFT_VOTE    string
+	RAFT_APPEND  string
+	RAFT_INSTALL string
+	REWRITE_LOG  string
+	SAVE         string
+	BG_SAVE      string
+	LAST_SAVE    string
+	CLUSTER      string
+	ASKING       string
+	MIGRATE      string
+}{
+	STATUS:       "PING",
+	INFO:         "INFO",
+	ECHO:         "ECHO",
+	GET:          "GET",
+	SET:          "SET",
+	DELETE:       "DELETE",
+	PRINT:        "PRINT",
+	REPLICA_SYNC: "REPLSYNC",
+	FULL_SYNC:    "FULLSYNC",
+	PARTIAL_SYNC: "CONTINUE",
+	REPLICA_CONF: "REPLCONF",
+	WAIT:         "WAIT",
+	REPLICA_OF:   "REPLICAOF",
+	RAFT_VOTE:    "RAFTVOTE",
+	RAFT_APPEND:  "RAFTAPPEND",
+	RAFT_INSTALL: "RAFTSNAPSHOT",
+	REWRITE_LOG:  "BGREWRITEAOF",
+	SAVE:         "SAVE",
+	BG_SAVE:      "BGSAVE",
+	LAST_SAVE:    "LASTSAVE",
+	CLUSTER:      "CLUSTER",
+	ASKING:       "ASKING",
+	MIGRATE:      "MIGRATE",
+}
+
+var Responses = struct {
+	ALL_GOOD        string
+	OKAY            string
+	REWRITE_STARTED string
+	BG_SAVE_STARTED string
+}{
+	ALL_GOOD:        "PONG",
+	OKAY:            "OK",
+	REWRITE_STARTED: "Background append only file rewriting started",
+	BG_SAVE_STARTED: "Background saving started",
+}
+
+// RESPONSE -----------------------------------------------------------------------------------
+// a reply, of any type - Err is set if it was an error, and String() gives it as text
+type Response struct {
+	utils.RESPValue
+}
+
+func NewResponse(value utils.RESPValue) Response {
+	return Response{value}
+}
@@ -0,0 +1,86 @@
+package raft
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// MEMORY_NETWORK -----------------------------------------------------------------------------
+// connects nodes in the same process, calling each other's handlers directly. nodes can be
+// disconnected and reconnected to simulate partitions and crashes.
+type MemoryNetwork struct {
+	nodes        map[string]*Node
+	disconnected map[string]bool
+	mutex        sync.Mutex
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{nodes: map[string]*Node{}, disconnected: map[string]bool{}}
+}
+
+// public methods -------------
+func (network *MemoryNetwork) Add(id string, node *Node) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.nodes[id] = node
+}
+
+// RPCs to or from id fail until it is reconnected
+func (network *MemoryNetwork) Disconnect(id string) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.disconnected[id] = true
+}
+
+func (network *MemoryNetwork) Reconnect(id string) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	delete(network.disconnected, id)
+}
+
+// transport for the node with the given id to send its RPCs over
+func (network *MemoryNetwork) Transport(id string) Transport {
+	return &memoryTransport{network: network, from: id}
+}
+
+// private methods -------------
+func (network *MemoryNetwork) route(from string, to string) (*Node, error) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	node, exists := network.nodes[to]
+	if !exists || network.disconnected[from] || network.disconnected[to] {
+		return nil, errors.Errorf("%s is unreachable from %s", to, from)
+	}
+	return node, nil
+}
+
+// MEMORY_TRANSPORT ---------------------------------------------------------------------------
+type memoryTransport struct {
+	network *MemoryNetwork
+	from    string
+}
+
+func (t *memoryTransport) RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error) {
+	node, err := t.network.route(t.from, peer)
+	if err != nil {
+		return RequestVoteReply{}, err
+	}
+	return node.HandleRequestVote(args), nil
+}
+
+func (t *memoryTransport) AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error) {
+	node, err := t.network.route(t.from, peer)
+	if err != nil {
+		return AppendEntriesReply{}, err
+	}
+	return node.HandleAppendEntries(args), nil
+}
+
+func (t *memoryTransport) InstallSnapshot(peer string, args InstallSnapshotArgs) (InstallSnapshotReply, error) {
+	node, err := t.network.route(t.from, peer)
+	if err != nil {
+		return InstallSnapshotReply{}, err
+	}
+	return node.HandleInstallSnapshot(args), nil
+}
@@ -0,0 +1,757 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (role Role) String() string {
+	switch role {
+	case Leader:
+		return "leader"
+	case Candidate:
+		return "candidate"
+	default:
+		return "follower"
+	}
+}
+
+// what a node keeps on disk, besides its snapshot. it is saved as a run of records (a length, then a gob):
+// a persistentState, followed by the batches of entries ([]Entry) appended to the log since it was saved
+type persistentState struct {
+	Term     int
+	VotedFor string
+	Log      []Entry
+}
+
+type snapshotRecord struct {
+	Index int
+	Term  int
+	Data  []byte
+}
+
+// a proposal waiting for its entry to be applied
+type waiter struct {
+	term int
+	done chan proposalResult
+}
+
+type proposalResult struct {
+	response []byte
+	err      error
+}
+
+// what a node knows about the cluster right now, for INFO and the like
+type Status struct {
+	ID          string
+	Role        Role
+	Term        int
+	Leader      string
+	CommitIndex int
+	LastApplied int
+	LastIndex   int
+}
+
+// NODE ---------------------------------------------------------------------------------------
+type Node struct {
+	id        string
+	peers     []string
+	transport Transport
+	sm        StateMachine
+	persister Persister
+	config    Config
+
+	role             Role
+	currentTerm      int
+	votedFor         string
+	log              []Entry // log[0] holds the index and term of the last entry in the snapshot, never a command
+	snapshot         []byte  // state machine snapshot up to log[0]
+	commitIndex      int
+	lastApplied      int
+	leaderID         string
+	electionDeadline time.Time
+	nextIndex        map[string]int           // leader only, next entry to send each peer
+	matchIndex       map[string]int           // leader only, last entry known to be on each peer
+	triggers         map[string]chan struct{} // leader only, wakes the goroutine replicating to each peer
+	waiters          map[int]waiter           // proposals by log index
+	stopped          bool
+	stop             chan struct{}
+	applyCond        *sync.Cond
+	applyMutex       sync.Mutex // held while the state machine is applied to or restored
+	mutex            sync.Mutex
+}
+
+// creates a node and restores whatever it persisted before. peers are the ids of every other node in the cluster.
+func NewNode(id string, peers []string, transport Transport, sm StateMachine, persister Persister, config Config) (*Node, error) {
+	n := &Node{
+		id:        id,
+		peers:     peers,
+		transport: transport,
+		sm:        sm,
+		persister: persister,
+		config:    config,
+		log:       []Entry{{}},
+		waiters:   map[int]waiter{},
+		stop:      make(chan struct{}),
+	}
+	n.applyCond = sync.NewCond(&n.mutex)
+
+	if err := n.restore(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// private methods -------------
+func (n *Node) restore() error {
+	data, err := n.persister.LoadSnapshot()
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		var record snapshotRecord
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&record); err != nil {
+			return errors.Wrap(err, "failed to decode raft snapshot")
+		}
+		if err := n.sm.Restore(record.Data); err != nil {
+			return errors.Wrap(err, "failed to restore raft snapshot")
+		}
+		n.log[0] = Entry{Index: record.Index, Term: record.Term}
+		n.snapshot = record.Data
+		n.commitIndex, n.lastApplied = record.Index, record.Index
+	}
+
+	data, err = n.persister.LoadState()
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		// saving the empty state up front means entries can always be appended to it
+		n.persistState()
+		return nil
+	}
+	records, torn := splitRecords(data)
+	if len(records) == 0 {
+		return errors.New("failed to decode raft state, it is cut short")
+	}
+	var state persistentState
+	if err := gob.NewDecoder(bytes.NewReader(records[0])).Decode(&state); err != nil {
+		return errors.Wrap(err, "failed to decode raft state")
+	}
+	for _, record := range records[1:] {
+		var entries []Entry
+		if err := gob.NewDecoder(bytes.NewReader(record)).Decode(&entries); err != nil {
+			return errors.Wrap(err, "failed to decode raft log entries")
+		}
+		state.Log = append(state.Log, entries...)
+	}
+	n.currentTerm, n.votedFor = state.Term, state.VotedFor
+
+	// the state may predate the snapshot (saving it is the second step), drop what the snapshot covers
+	base := state.Log[0].Index
+	if skip := n.log[0].Index - base; skip < len(state.Log) && skip >= 0 {
+		n.log = append([]Entry{n.log[0]}, state.Log[skip+1:]...)
+	}
+
+	// appends have to follow on from the log as it is now. rewrite the state if it no longer matches it, or if
+	// a crash in the middle of an append left half a record (which was never acknowledged) at the end of it.
+	if torn || n.log[0].Index != base {
+		n.persistState()
+	}
+	return nil
+}
+
+func encodeRecord(v any) []byte {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	gob.NewEncoder(&buf).Encode(v)
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	return data
+}
+
+// splits saved state into its records, torn is whether the last one was cut short (and left out)
+func splitRecords(data []byte) (records [][]byte, torn bool) {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return records, true
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if len(data)-4 < size {
+			return records, true
+		}
+		records = append(records, data[4:4+size])
+		data = data[4+size:]
+	}
+	return records, false
+}
+
+// must hold the lock
+func (n *Node) encodeState() []byte {
+	return encodeRecord(persistentState{Term: n.currentTerm, VotedFor: n.votedFor, Log: n.log})
+}
+
+// must hold the lock
+func (n *Node) persistState() {
+	if err := n.persister.SaveState(n.encodeState()); err != nil {
+		fmt.Println("ERROR: failed to persist raft state,", err)
+	}
+}
+
+// saves entries just added to the end of the log, without rewriting the rest of it. must hold the lock
+func (n *Node) persistEntries(entries []Entry) {
+	if err := n.persister.AppendState(encodeRecord(entries)); err != nil {
+		fmt.Println("ERROR: failed to persist raft log entries,", err)
+	}
+}
+
+// must hold the lock
+func (n *Node) persistSnapshot() {
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(snapshotRecord{Index: n.log[0].Index, Term: n.log[0].Term, Data: n.snapshot})
+	if err := n.persister.SaveSnapshot(buf.Bytes(), n.encodeState()); err != nil {
+		fmt.Println("ERROR: failed to persist raft snapshot,", err)
+	}
+}
+
+func (n *Node) lastIndex() int {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) lastTerm() int {
+	return n.log[len(n.log)-1].Term
+}
+
+// term of the entry at index, which must be in the log (or be the last one in the snapshot)
+func (n *Node) term(index int) int {
+	return n.log[index-n.log[0].Index].Term
+}
+
+func (n *Node) hasMajority(count int) bool {
+	return count*2 > len(n.peers)+1
+}
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// ELECTIONS -------------------------------------------------------------------------------------
+func (n *Node) runElectionTimer() {
+	t := time.NewTicker(n.config.ElectionTimeout / 10)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-n.stop:
+			return
+		}
+
+		n.mutex.Lock()
+		if n.role != Leader && time.Now().After(n.electionDeadline) {
+			n.startElection()
+		}
+		n.mutex.Unlock()
+	}
+}
+
+// must hold the lock
+func (n *Node) startElection() {
+	n.role = Candidate
+	n.currentTerm++
+	n.votedFor = n.id
+	n.leaderID = ""
+	n.persistState()
+	n.resetElectionDeadline()
+
+	term := n.currentTerm
+	args := RequestVoteArgs{Term: term, CandidateID: n.id, LastLogIndex: n.lastIndex(), LastLogTerm: n.lastTerm()}
+	votes := 1
+	if n.hasMajority(votes) {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.peers {
+		go func(peer string) {
+			reply, err := n.transport.RequestVote(peer, args)
+			if err != nil {
+				return
+			}
+
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+			if reply.Term > n.currentTerm {
+				n.becomeFollower(reply.Term)
+				return
+			}
+			if n.role != Candidate || n.currentTerm != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if n.hasMajority(votes) {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// must hold the lock
+func (n *Node) becomeFollower(term int) {
+	if term > n.currentTerm {
+		n.currentTerm = term
+		n.votedFor = ""
+		n.persistState()
+	}
+	if n.role == Leader {
+		fmt.Printf("Raft: %s stepping down in term %d.\n", n.id, n.currentTerm)
+	}
+	n.role = Follower
+	n.triggers = nil // replicating goroutines notice the term or role changed and stop
+	n.resetElectionDeadline()
+}
+
+// must hold the lock
+func (n *Node) becomeLeader() {
+	fmt.Printf("Raft: %s is the leader for term %d.\n", n.id, n.currentTerm)
+	n.role = Leader
+	n.leaderID = n.id
+
+	// a no-op of its own term lets it commit whatever earlier leaders left uncommitted
+	n.log = append(n.log, Entry{Index: n.lastIndex() + 1, Term: n.currentTerm})
+	n.persistEntries(n.log[len(n.log)-1:])
+
+	n.nextIndex = map[string]int{}
+	n.matchIndex = map[string]int{}
+	n.triggers = map[string]chan struct{}{}
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex()
+		n.matchIndex[peer] = 0
+		n.triggers[peer] = make(chan struct{}, 1)
+		go n.replicateTo(peer, n.currentTerm, n.triggers[peer])
+	}
+	n.advanceCommit()
+}
+
+// REPLICATION ----------------------------------------------------------------------------------
+// sends a peer whatever it is missing (or a heartbeat) every HeartbeatInterval, or straight away when
+// triggered, for as long as this node leads in term
+func (n *Node) replicateTo(peer string, term int, trigger chan struct{}) {
+	t := time.NewTicker(n.config.HeartbeatInterval)
+	defer t.Stop()
+	for {
+		n.mutex.Lock()
+		if n.stopped || n.role != Leader || n.currentTerm != term {
+			n.mutex.Unlock()
+			return
+		}
+		var more bool
+		var err error
+		if n.nextIndex[peer] <= n.log[0].Index {
+			// what it needs has been compacted away, send the snapshot instead
+			args := InstallSnapshotArgs{
+				Term:              term,
+				LeaderID:          n.id,
+				LastIncludedIndex: n.log[0].Index,
+				LastIncludedTerm:  n.log[0].Term,
+				Data:              n.snapshot,
+			}
+			n.mutex.Unlock()
+			var reply InstallSnapshotReply
+			if reply, err = n.transport.InstallSnapshot(peer, args); err == nil {
+				more = n.handleInstallSnapshotReply(peer, term, args, reply)
+			}
+		} else {
+			next := n.nextIndex[peer]
+			end := min(n.lastIndex()+1, next+n.config.MaxBatch)
+			args := AppendEntriesArgs{
+				Term:         term,
+				LeaderID:     n.id,
+				PrevLogIndex: next - 1,
+				PrevLogTerm:  n.term(next - 1),
+				Entries:      append([]Entry{}, n.log[next-n.log[0].Index:end-n.log[0].Index]...),
+				LeaderCommit: n.commitIndex,
+			}
+			n.mutex.Unlock()
+			var reply AppendEntriesReply
+			if reply, err = n.transport.AppendEntries(peer, args); err == nil {
+				more = n.handleAppendEntriesReply(peer, term, args, reply)
+			}
+		}
+		if more {
+			continue
+		}
+
+		select {
+		case <-t.C:
+		case <-trigger:
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+// returns whether there is more to send the peer straight away
+func (n *Node) handleAppendEntriesReply(peer string, term int, args AppendEntriesArgs, reply AppendEntriesReply) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if reply.Term > n.currentTerm {
+		n.becomeFollower(reply.Term)
+		return false
+	}
+	if n.role != Leader || n.currentTerm != term {
+		return false
+	}
+
+	if !reply.Success {
+		n.nextIndex[peer] = max(reply.ConflictIndex, n.matchIndex[peer]+1)
+		return true
+	}
+	match := args.PrevLogIndex + len(args.Entries)
+	if match > n.matchIndex[peer] {
+		n.matchIndex[peer] = match
+		n.advanceCommit()
+	}
+	n.nextIndex[peer] = max(n.nextIndex[peer], match+1)
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+func (n *Node) handleInstallSnapshotReply(peer string, term int, args InstallSnapshotArgs, reply InstallSnapshotReply) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if reply.Term > n.currentTerm {
+		n.becomeFollower(reply.Term)
+		return false
+	}
+	if n.role != Leader || n.currentTerm != term {
+		return false
+	}
+	n.matchIndex[peer] = max(n.matchIndex[peer], args.LastIncludedIndex)
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+// commits the newest entry of this term that a majority has. must hold the lock.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && n.term(index) == n.currentTerm; index-- {
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if n.hasMajority(count) {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+// APPLYING -------------------------------------------------------------------------------------
+// applies committed entries to the state machine in order, answering the proposals waiting on them
+func (n *Node) runApplier() {
+	for {
+		n.mutex.Lock()
+		for n.commitIndex <= n.lastApplied && !n.stopped {
+			n.applyCond.Wait()
+		}
+		if n.stopped {
+			n.mutex.Unlock()
+			return
+		}
+		// (while a snapshot is being installed the log already starts after it, but lastApplied doesn't yet)
+		base := n.log[0].Index
+		start := max(n.lastApplied, base) + 1
+		entries := append([]Entry{}, n.log[start-base:n.commitIndex+1-base]...)
+		n.mutex.Unlock()
+
+		n.applyMutex.Lock()
+		for _, entry := range entries {
+			n.mutex.Lock()
+			skip := entry.Index <= n.lastApplied // a snapshot was installed in the meantime
+			n.mutex.Unlock()
+			if skip {
+				continue
+			}
+
+			var response []byte
+			if len(entry.Command) > 0 {
+				response = n.sm.Apply(entry.Command)
+			}
+
+			n.mutex.Lock()
+			n.lastApplied = entry.Index
+			if w, ok := n.waiters[entry.Index]; ok {
+				delete(n.waiters, entry.Index)
+				if w.term == entry.Term {
+					w.done <- proposalResult{response: response}
+				} else {
+					w.done <- proposalResult{err: ErrLeadershipLost}
+				}
+			}
+			n.mutex.Unlock()
+		}
+		n.compactLog()
+		n.applyMutex.Unlock()
+	}
+}
+
+// once the log is long enough, replaces everything applied so far with a snapshot. must hold applyMutex.
+func (n *Node) compactLog() {
+	n.mutex.Lock()
+	if len(n.log)-1 < n.config.SnapshotThreshold {
+		n.mutex.Unlock()
+		return
+	}
+	index, term := n.lastApplied, n.term(n.lastApplied)
+	n.mutex.Unlock()
+
+	data, err := n.sm.Snapshot()
+	if err != nil {
+		fmt.Println("ERROR: failed to snapshot state machine,", err)
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.log = append([]Entry{{Index: index, Term: term}}, n.log[index-n.log[0].Index+1:]...)
+	n.snapshot = data
+	n.persistSnapshot()
+}
+
+// public methods -------------
+func (n *Node) Start() {
+	n.mutex.Lock()
+	n.resetElectionDeadline()
+	n.mutex.Unlock()
+
+	go n.runElectionTimer()
+	go n.runApplier()
+}
+
+func (n *Node) Stop() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.stopped {
+		return
+	}
+	n.stopped = true
+	close(n.stop)
+	n.applyCond.Broadcast()
+}
+
+// appends command to the log and waits until it is committed by a majority and applied, returning
+// what the state machine returned for it. only the leader takes proposals, others return a *NotLeaderError.
+func (n *Node) Propose(ctx context.Context, command []byte) ([]byte, error) {
+	n.mutex.Lock()
+	if n.stopped {
+		n.mutex.Unlock()
+		return nil, ErrStopped
+	}
+	if n.role != Leader {
+		leader := n.leaderID
+		n.mutex.Unlock()
+		return nil, &NotLeaderError{Leader: leader}
+	}
+
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.currentTerm, Command: command}
+	n.log = append(n.log, entry)
+	n.persistEntries([]Entry{entry})
+	done := make(chan proposalResult, 1)
+	n.waiters[entry.Index] = waiter{term: entry.Term, done: done}
+	for _, trigger := range n.triggers {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+	n.advanceCommit() // a cluster of one commits straight away
+	n.mutex.Unlock()
+
+	select {
+	case result := <-done:
+		return result.response, result.err
+	case <-ctx.Done():
+		n.mutex.Lock()
+		delete(n.waiters, entry.Index)
+		n.mutex.Unlock()
+		return nil, ctx.Err()
+	case <-n.stop:
+		return nil, ErrStopped
+	}
+}
+
+func (n *Node) HandleRequestVote(args RequestVoteArgs) RequestVoteReply {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if args.Term > n.currentTerm {
+		n.becomeFollower(args.Term)
+	}
+	reply := RequestVoteReply{Term: n.currentTerm}
+	if args.Term < n.currentTerm {
+		return reply
+	}
+
+	// only vote for candidates whose log is at least as up to date as ours
+	upToDate := args.LastLogTerm > n.lastTerm() || (args.LastLogTerm == n.lastTerm() && args.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == args.CandidateID) && upToDate {
+		n.votedFor = args.CandidateID
+		n.persistState()
+		n.resetElectionDeadline()
+		reply.VoteGranted = true
+	}
+	return reply
+}
+
+func (n *Node) HandleAppendEntries(args AppendEntriesArgs) AppendEntriesReply {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	reply := AppendEntriesReply{Term: n.currentTerm}
+	if args.Term < n.currentTerm {
+		return reply
+	}
+	if args.Term > n.currentTerm || n.role != Follower {
+		n.becomeFollower(args.Term)
+	}
+	n.leaderID = args.LeaderID
+	n.resetElectionDeadline()
+	reply.Term = n.currentTerm
+
+	// entries already in our snapshot are committed, so they match
+	if base := n.log[0].Index; args.PrevLogIndex < base {
+		skip := base - args.PrevLogIndex
+		if skip >= len(args.Entries) {
+			reply.Success = true
+			return reply
+		}
+		args.Entries = args.Entries[skip:]
+		args.PrevLogIndex, args.PrevLogTerm = base, n.log[0].Term
+	}
+
+	// the entry before the new ones has to match, otherwise the leader backs up and retries
+	if args.PrevLogIndex > n.lastIndex() {
+		reply.ConflictIndex = n.lastIndex() + 1
+		return reply
+	}
+	if conflictTerm := n.term(args.PrevLogIndex); conflictTerm != args.PrevLogTerm {
+		// skip back over the whole conflicting term at once
+		index := args.PrevLogIndex
+		for index > n.log[0].Index+1 && n.term(index-1) == conflictTerm {
+			index--
+		}
+		reply.ConflictIndex = index
+		return reply
+	}
+
+	// append what we don't have, dropping anything that conflicts with it
+	for i, entry := range args.Entries {
+		if entry.Index > n.lastIndex() {
+			n.log = append(n.log, args.Entries[i:]...)
+			n.persistEntries(args.Entries[i:])
+			break
+		}
+		if n.term(entry.Index) != entry.Term {
+			// entries were dropped, so the whole log is saved again
+			n.log = append(n.log[:entry.Index-n.log[0].Index], args.Entries[i:]...)
+			n.persistState()
+			break
+		}
+	}
+
+	if lastNew := args.PrevLogIndex + len(args.Entries); args.LeaderCommit > n.commitIndex {
+		n.commitIndex = max(n.commitIndex, min(args.LeaderCommit, lastNew))
+		n.applyCond.Broadcast()
+	}
+	reply.Success = true
+	return reply
+}
+
+func (n *Node) HandleInstallSnapshot(args InstallSnapshotArgs) InstallSnapshotReply {
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+	n.mutex.Lock()
+
+	reply := InstallSnapshotReply{Term: n.currentTerm}
+	if args.Term < n.currentTerm {
+		n.mutex.Unlock()
+		return reply
+	}
+	if args.Term > n.currentTerm || n.role != Follower {
+		n.becomeFollower(args.Term)
+	}
+	n.leaderID = args.LeaderID
+	n.resetElectionDeadline()
+	reply.Term = n.currentTerm
+
+	// nothing to do if we already applied everything it covers
+	if args.LastIncludedIndex <= n.lastApplied {
+		n.mutex.Unlock()
+		return reply
+	}
+
+	// keep whatever follows the snapshot, if our log agrees with it
+	snapshotEntry := Entry{Index: args.LastIncludedIndex, Term: args.LastIncludedTerm}
+	if args.LastIncludedIndex < n.lastIndex() && args.LastIncludedIndex >= n.log[0].Index &&
+		n.term(args.LastIncludedIndex) == args.LastIncludedTerm {
+		n.log = append([]Entry{snapshotEntry}, n.log[args.LastIncludedIndex-n.log[0].Index+1:]...)
+	} else {
+		n.log = []Entry{snapshotEntry}
+	}
+	n.snapshot = args.Data
+	n.commitIndex = max(n.commitIndex, args.LastIncludedIndex)
+	n.persistSnapshot()
+	n.mutex.Unlock()
+
+	if err := n.sm.Restore(args.Data); err != nil {
+		fmt.Println("ERROR: failed to restore snapshot from leader,", err)
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.lastApplied = args.LastIncludedIndex
+	for index, w := range n.waiters {
+		if index <= args.LastIncludedIndex {
+			delete(n.waiters, index)
+			w.done <- proposalResult{err: ErrLeadershipLost}
+		}
+	}
+	return reply
+}
+
+func (n *Node) IsLeader() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.role == Leader
+}
+
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return Status{
+		ID:          n.id,
+		Role:        n.role,
+		Term:        n.currentTerm,
+		Leader:      n.leaderID,
+		CommitIndex: n.commitIndex,
+		LastApplied: n.lastApplied,
+		LastIndex:   n.lastIndex(),
+	}
+}
@@ -0,0 +1,428 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TEST_STATE_MACHINE -------------------------------------------------------------------------
+// records every command applied to it, in order
+type testStateMachine struct {
+	applied []string
+	mutex   sync.Mutex
+}
+
+func (sm *testStateMachine) Apply(command []byte) []byte {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.applied = append(sm.applied, string(command))
+	return command
+}
+
+func (sm *testStateMachine) Snapshot() ([]byte, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(sm.applied)
+	return buf.Bytes(), err
+}
+
+func (sm *testStateMachine) Restore(snapshot []byte) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.applied = nil
+	return gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&sm.applied)
+}
+
+func (sm *testStateMachine) commands() []string {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	return slices.Clone(sm.applied)
+}
+
+// TEST_CLUSTER -------------------------------------------------------------------------------
+// nodes on a MemoryNetwork, each keeping its state in a MemoryPersister that outlives it, so a
+// crashed node can be started again from whatever it persisted
+type testCluster struct {
+	t          *testing.T
+	config     Config
+	network    *MemoryNetwork
+	ids        []string
+	nodes      map[string]*Node
+	sms        map[string]*testStateMachine
+	persisters map[string]*MemoryPersister
+}
+
+func testConfig() Config {
+	return Config{
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		SnapshotThreshold: 1000,
+		MaxBatch:          64,
+	}
+}
+
+func newTestCluster(t *testing.T, size int, config Config) *testCluster {
+	c := &testCluster{
+		t:          t,
+		config:     config,
+		network:    NewMemoryNetwork(),
+		nodes:      map[string]*Node{},
+		sms:        map[string]*testStateMachine{},
+		persisters: map[string]*MemoryPersister{},
+	}
+	for i := 1; i <= size; i++ {
+		id := fmt.Sprintf("n%d", i)
+		c.ids = append(c.ids, id)
+		c.persisters[id] = NewMemoryPersister()
+	}
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Stop()
+		}
+	})
+	return c
+}
+
+// starts id from what it persisted, with a fresh state machine
+func (c *testCluster) start(id string) {
+	peers := []string{}
+	for _, peer := range c.ids {
+		if peer != id {
+			peers = append(peers, peer)
+		}
+	}
+	sm := &testStateMachine{}
+	node, err := NewNode(id, peers, c.network.Transport(id), sm, c.persisters[id], c.config)
+	if err != nil {
+		c.t.Fatalf("failed to start %s: %v", id, err)
+	}
+	c.nodes[id], c.sms[id] = node, sm
+	c.network.Add(id, node)
+	c.network.Reconnect(id)
+	node.Start()
+}
+
+func (c *testCluster) crash(id string) {
+	c.network.Disconnect(id)
+	c.nodes[id].Stop()
+}
+
+// waits until cond holds, failing the test if it doesn't within a few seconds
+func (c *testCluster) waitFor(what string, cond func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// the one leader among ids in the newest term any of them is in, once there is one
+func (c *testCluster) leader(ids ...string) string {
+	c.t.Helper()
+	if len(ids) == 0 {
+		ids = c.ids
+	}
+	leader := ""
+	c.waitFor("a leader to be elected", func() bool {
+		newest, leaders := 0, map[int][]string{}
+		for _, id := range ids {
+			status := c.nodes[id].Status()
+			newest = max(newest, status.Term)
+			if status.Role == Leader {
+				leaders[status.Term] = append(leaders[status.Term], id)
+			}
+		}
+		if len(leaders[newest]) > 1 {
+			c.t.Fatalf("%v all lead term %d", leaders[newest], newest)
+		}
+		if len(leaders[newest]) == 1 {
+			leader = leaders[newest][0]
+			return true
+		}
+		return false
+	})
+	return leader
+}
+
+// proposes command to the leader among ids until one commits it
+func (c *testCluster) propose(command string, ids ...string) {
+	c.t.Helper()
+	c.waitFor(fmt.Sprintf("%q to be committed", command), func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		response, err := c.nodes[c.leader(ids...)].Propose(ctx, []byte(command))
+		if err != nil {
+			return false
+		}
+		if string(response) != command {
+			c.t.Fatalf("proposing %q got %q back", command, response)
+		}
+		return true
+	})
+}
+
+// waits until every one of ids has applied exactly want
+func (c *testCluster) waitApplied(want []string, ids ...string) {
+	c.t.Helper()
+	if len(ids) == 0 {
+		ids = c.ids
+	}
+	for _, id := range ids {
+		c.waitFor(fmt.Sprintf("%s to apply %v", id, want), func() bool {
+			return slices.Equal(c.sms[id].commands(), want)
+		})
+	}
+}
+
+// the commands in id's log (not counting any in its snapshot)
+func (c *testCluster) logCommands(id string) []string {
+	node := c.nodes[id]
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	commands := []string{}
+	for _, entry := range node.log[1:] {
+		if len(entry.Command) > 0 {
+			commands = append(commands, string(entry.Command))
+		}
+	}
+	return commands
+}
+
+func commandRange(prefix string, from int, to int) []string {
+	commands := []string{}
+	for i := from; i < to; i++ {
+		commands = append(commands, fmt.Sprintf("%s%d", prefix, i))
+	}
+	return commands
+}
+
+func without(ids []string, drop ...string) []string {
+	return slices.DeleteFunc(slices.Clone(ids), func(id string) bool { return slices.Contains(drop, id) })
+}
+
+// TESTS --------------------------------------------------------------------------------------
+func TestElection(t *testing.T) {
+	c := newTestCluster(t, 3, testConfig())
+	leader := c.leader()
+	term := c.nodes[leader].Status().Term
+
+	// with heartbeats flowing, nobody stands for election again
+	time.Sleep(10 * c.config.ElectionTimeout)
+	if now := c.leader(); now != leader || c.nodes[now].Status().Term != term {
+		t.Fatalf("leadership moved from %s (term %d) to %s (term %d) without a failure", leader, term, now, c.nodes[now].Status().Term)
+	}
+	for _, id := range c.ids {
+		if status := c.nodes[id].Status(); status.Leader != leader {
+			t.Errorf("%s thinks the leader is %q, not %s", id, status.Leader, leader)
+		}
+	}
+
+	var notLeader *NotLeaderError
+	follower := without(c.ids, leader)[0]
+	if _, err := c.nodes[follower].Propose(context.Background(), []byte("x")); !errors.As(err, &notLeader) || notLeader.Leader != leader {
+		t.Errorf("proposing to follower %s: got %v, want a NotLeaderError naming %s", follower, err, leader)
+	}
+}
+
+func TestReplicationAndCommit(t *testing.T) {
+	c := newTestCluster(t, 3, testConfig())
+	want := commandRange("set", 0, 20)
+	for _, command := range want {
+		c.propose(command)
+	}
+	c.waitApplied(want)
+
+	// a majority is enough to commit
+	leader := c.leader()
+	follower := without(c.ids, leader)[0]
+	c.crash(follower)
+	c.propose("while one is down")
+	want = append(want, "while one is down")
+	c.waitApplied(want, without(c.ids, follower)...)
+	if slices.Contains(c.sms[follower].commands(), "while one is down") {
+		t.Errorf("crashed %s applied a command proposed after it crashed", follower)
+	}
+
+	// but the leader on its own commits nothing
+	c.network.Disconnect(without(c.ids, leader, follower)[0])
+	ctx, cancel := context.WithTimeout(context.Background(), 10*c.config.ElectionTimeout)
+	defer cancel()
+	if _, err := c.nodes[leader].Propose(ctx, []byte("without a majority")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("proposing without a majority: got %v, want it to time out", err)
+	}
+	if status := c.nodes[leader].Status(); status.CommitIndex >= status.LastIndex {
+		t.Errorf("%s committed up to %d without a majority", leader, status.CommitIndex)
+	}
+}
+
+func TestLeaderCrashAndReelection(t *testing.T) {
+	c := newTestCluster(t, 3, testConfig())
+	want := commandRange("before", 0, 5)
+	for _, command := range want {
+		c.propose(command)
+	}
+	old := c.leader()
+	oldTerm := c.nodes[old].Status().Term
+	c.crash(old)
+
+	rest := without(c.ids, old)
+	leader := c.leader(rest...)
+	if term := c.nodes[leader].Status().Term; term <= oldTerm {
+		t.Fatalf("new leader %s is in term %d, not after the old leader's term %d", leader, term, oldTerm)
+	}
+	// everything committed under the old leader survives it
+	after := commandRange("after", 0, 5)
+	for _, command := range after {
+		c.propose(command, rest...)
+	}
+	want = append(want, after...)
+	c.waitApplied(want, rest...)
+
+	// the old leader comes back as a follower, and catches up
+	c.start(old)
+	c.waitApplied(want)
+	if c.leader() != leader {
+		t.Errorf("the old leader %s took over again from %s", old, leader)
+	}
+}
+
+func TestPartitionAndHeal(t *testing.T) {
+	c := newTestCluster(t, 5, testConfig())
+	want := commandRange("agreed", 0, 5)
+	for _, command := range want {
+		c.propose(command)
+	}
+	c.waitApplied(want)
+
+	// the leader is cut off from the rest, and keeps taking proposals it can never commit
+	old := c.leader()
+	c.network.Disconnect(old)
+	lost := commandRange("lost", 0, 3)
+	for _, command := range lost {
+		ctx, cancel := context.WithTimeout(context.Background(), c.config.ElectionTimeout)
+		if _, err := c.nodes[old].Propose(ctx, []byte(command)); err == nil {
+			t.Fatalf("isolated leader %s committed %q", old, command)
+		}
+		cancel()
+	}
+	if got := c.logCommands(old); !slices.Contains(got, lost[0]) {
+		t.Fatalf("isolated leader %s's log %v doesn't have the proposals it took", old, got)
+	}
+
+	// the majority side elects a leader of its own, and writes over the same indexes
+	majority := without(c.ids, old)
+	leader := c.leader(majority...)
+	kept := commandRange("kept", 0, 5)
+	for _, command := range kept {
+		c.propose(command, majority...)
+	}
+	want = append(want, kept...)
+	c.waitApplied(want, majority...)
+
+	// once healed, the old leader steps down and its conflicting entries are replaced by the new leader's
+	c.network.Reconnect(old)
+	c.waitApplied(want)
+	c.waitFor(old+" to drop its uncommitted entries", func() bool {
+		return !slices.ContainsFunc(c.logCommands(old), func(command string) bool { return slices.Contains(lost, command) })
+	})
+	if c.nodes[old].IsLeader() {
+		t.Errorf("%s still thinks it leads after the partition healed", old)
+	}
+	if got := c.leader(); got != leader {
+		t.Errorf("leader after healing is %s, want %s", got, leader)
+	}
+}
+
+func TestSnapshotInstall(t *testing.T) {
+	config := testConfig()
+	config.SnapshotThreshold = 10
+	config.MaxBatch = 4
+	c := newTestCluster(t, 3, config)
+	want := commandRange("early", 0, 3)
+	for _, command := range want {
+		c.propose(command)
+	}
+	c.waitApplied(want)
+
+	// a follower falls behind while the leader compacts the entries it is missing into a snapshot
+	leader := c.leader()
+	lagging := without(c.ids, leader)[0]
+	c.crash(lagging)
+	missed := commandRange("missed", 0, 40)
+	for _, command := range missed {
+		c.propose(command)
+	}
+	want = append(want, missed...)
+	laggingLast := c.nodes[lagging].Status().LastIndex
+	c.waitFor(leader+" to compact its log", func() bool {
+		c.nodes[leader].mutex.Lock()
+		defer c.nodes[leader].mutex.Unlock()
+		return c.nodes[leader].log[0].Index > laggingLast
+	})
+
+	// so it can only catch up from the snapshot
+	c.start(lagging)
+	c.waitApplied(want)
+	node := c.nodes[lagging]
+	node.mutex.Lock()
+	base := node.log[0].Index
+	node.mutex.Unlock()
+	if base <= laggingLast {
+		t.Errorf("%s's log starts at %d, it should have been replaced by a snapshot past %d", lagging, base, laggingLast)
+	}
+	if snapshot, _ := c.persisters[lagging].LoadSnapshot(); snapshot == nil {
+		t.Errorf("%s didn't persist the snapshot it installed", lagging)
+	}
+
+	// and it carries on from there like any other follower
+	c.propose("after the snapshot")
+	c.waitApplied(append(want, "after the snapshot"))
+}
+
+func TestRestartFromPersister(t *testing.T) {
+	config := testConfig()
+	config.SnapshotThreshold = 10
+	c := newTestCluster(t, 3, config)
+	want := commandRange("set", 0, 25)
+	for _, command := range want {
+		c.propose(command)
+	}
+	c.waitApplied(want)
+	terms := map[string]int{}
+	lastIndexes := map[string]int{}
+	for _, id := range c.ids {
+		status := c.nodes[id].Status()
+		terms[id], lastIndexes[id] = status.Term, status.LastIndex
+	}
+
+	// everything goes down at once, and comes back with nothing but what it persisted
+	for _, id := range c.ids {
+		c.crash(id)
+	}
+	for _, id := range c.ids {
+		c.start(id)
+		status := c.nodes[id].Status()
+		if status.Term != terms[id] || status.LastIndex != lastIndexes[id] {
+			t.Errorf("%s restarted in term %d with %d entries, want term %d with %d", id, status.Term, status.LastIndex, terms[id], lastIndexes[id])
+		}
+	}
+
+	// the snapshot is restored straight away, the rest of the log once a leader commits it again
+	c.leader()
+	c.propose("after the restart")
+	c.waitApplied(append(want, "after the restart"))
+}
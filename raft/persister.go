@@ -0,0 +1,151 @@
+package raft
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// durable storage for a node's state (term, vote and log) and its latest snapshot.
+// a snapshot is always saved before the state that refers to it.
+type Persister interface {
+	SaveState(state []byte) error
+	AppendState(data []byte) error // adds to the end of the saved state, so new entries don't rewrite the whole log
+	SaveSnapshot(snapshot []byte, state []byte) error
+	LoadState() ([]byte, error)    // what was saved followed by everything appended since, nil if nothing was saved yet
+	LoadSnapshot() ([]byte, error) // nil if nothing was saved yet
+}
+
+// MEMORY_PERSISTER ---------------------------------------------------------------------------
+// keeps everything in memory, for nodes that don't need to survive a restart (e.g. in tests)
+type MemoryPersister struct {
+	state    []byte
+	snapshot []byte
+	mutex    sync.Mutex
+}
+
+func NewMemoryPersister() *MemoryPersister {
+	return &MemoryPersister{}
+}
+
+func (p *MemoryPersister) SaveState(state []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.state = state
+	return nil
+}
+
+func (p *MemoryPersister) AppendState(data []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.state = append(p.state[:len(p.state):len(p.state)], data...) // never writes into a slice LoadState returned
+	return nil
+}
+
+func (p *MemoryPersister) SaveSnapshot(snapshot []byte, state []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.snapshot, p.state = snapshot, state
+	return nil
+}
+
+func (p *MemoryPersister) LoadState() ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.state, nil
+}
+
+func (p *MemoryPersister) LoadSnapshot() ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.snapshot, nil
+}
+
+// FILE_PERSISTER -----------------------------------------------------------------------------
+// keeps the state and snapshot in two files, each replaced atomically (temp file, fsync, rename).
+// appends go straight to the end of the state file, and are fsynced before returning.
+type FilePersister struct {
+	stateFile    string
+	snapshotFile string
+}
+
+func NewFilePersister(stateFile string, snapshotFile string) *FilePersister {
+	return &FilePersister{stateFile: stateFile, snapshotFile: snapshotFile}
+}
+
+func (p *FilePersister) SaveState(state []byte) error {
+	return writeFileAtomic(p.stateFile, state)
+}
+
+func (p *FilePersister) AppendState(data []byte) error {
+	f, err := os.OpenFile(p.stateFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", p.stateFile)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return errors.Wrapf(err, "failed to append to %s", p.stateFile)
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to fsync %s", p.stateFile)
+	}
+	return f.Close()
+}
+
+func (p *FilePersister) SaveSnapshot(snapshot []byte, state []byte) error {
+	if err := writeFileAtomic(p.snapshotFile, snapshot); err != nil {
+		return err
+	}
+	return writeFileAtomic(p.stateFile, state)
+}
+
+func (p *FilePersister) LoadState() ([]byte, error) {
+	return readFileIfExists(p.stateFile)
+}
+
+func (p *FilePersister) LoadSnapshot() ([]byte, error) {
+	return readFileIfExists(p.snapshotFile)
+}
+
+func writeFileAtomic(filename string, data []byte) error {
+	tempFilename := filename + ".tmp"
+	f, err := os.OpenFile(tempFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", tempFilename)
+	}
+	defer os.Remove(tempFilename) // no-op once renamed
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return errors.Wrapf(err, "failed to write %s", tempFilename)
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to fsync %s", tempFilename)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close %s", tempFilename)
+	}
+	if err := os.Rename(tempFilename, filename); err != nil {
+		return errors.Wrapf(err, "failed to rename %s into place", filename)
+	}
+
+	// fsync the directory so the rename itself survives a crash
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func readFileIfExists(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", filename)
+	}
+	return data, nil
+}
@@ -0,0 +1,159 @@
+package raft
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// the saved state of a node that isn't started, split into its records
+func stateRecords(t *testing.T, p Persister) [][]byte {
+	t.Helper()
+	data, err := p.LoadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, torn := splitRecords(data)
+	if torn {
+		t.Fatal("saved state ends in half a record")
+	}
+	return records
+}
+
+func logTerms(n *Node) []int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	terms := []int{}
+	for _, entry := range n.log[1:] {
+		terms = append(terms, entry.Term)
+	}
+	return terms
+}
+
+func TestFilePersister(t *testing.T) {
+	dir := t.TempDir()
+	p := NewFilePersister(filepath.Join(dir, "state"), filepath.Join(dir, "snapshot"))
+	load := func(what string, load func() ([]byte, error), want []byte) {
+		t.Helper()
+		data, err := load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Fatalf("%s is %q, want %q", what, data, want)
+		}
+	}
+
+	load("state", p.LoadState, nil)
+	load("snapshot", p.LoadSnapshot, nil)
+
+	steps := []struct {
+		name     string
+		do       func() error
+		state    string
+		snapshot []byte
+	}{
+		{"append before anything is saved", func() error { return p.AppendState([]byte("a")) }, "a", nil},
+		{"save replaces", func() error { return p.SaveState([]byte("state")) }, "state", nil},
+		{"append", func() error { return p.AppendState([]byte("+1")) }, "state+1", nil},
+		{"append again", func() error { return p.AppendState([]byte("+2")) }, "state+1+2", nil},
+		{"snapshot replaces both", func() error { return p.SaveSnapshot([]byte("snap"), []byte("new")) }, "new", []byte("snap")},
+		{"append after snapshot", func() error { return p.AppendState([]byte("+3")) }, "new+3", []byte("snap")},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		load(step.name+": state", p.LoadState, []byte(step.state))
+		load(step.name+": snapshot", p.LoadSnapshot, step.snapshot)
+	}
+}
+
+func TestProposalsAppendToState(t *testing.T) {
+	c := newTestCluster(t, 3, testConfig())
+	c.propose("first")
+	c.waitApplied([]string{"first"})
+	before := map[string][]byte{}
+	for _, id := range c.ids {
+		before[id], _ = c.persisters[id].LoadState()
+	}
+
+	want := append([]string{"first"}, commandRange("set", 0, 10)...)
+	for _, command := range want[1:] {
+		c.propose(command)
+	}
+	c.waitApplied(want)
+
+	// the log is only ever added to, so every node still has what it saved before, with the new entries after it
+	for _, id := range c.ids {
+		after, _ := c.persisters[id].LoadState()
+		if !bytes.HasPrefix(after, before[id]) {
+			t.Fatalf("%s rewrote its state for entries that were only appended", id)
+		}
+		if records, _ := splitRecords(after); len(records) < 2 {
+			t.Fatalf("%s saved %d records, want the state and appended entries", id, len(records))
+		}
+	}
+}
+
+func TestStateRewrittenOnTruncation(t *testing.T) {
+	p := NewMemoryPersister()
+	n, err := NewNode("n1", []string{"n2"}, NewMemoryNetwork().Transport("n1"), &testStateMachine{}, p, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the leader of term 2 sends entries an earlier leader left behind
+	n.HandleAppendEntries(AppendEntriesArgs{Term: 2, LeaderID: "n2", Entries: []Entry{
+		{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1},
+	}})
+	if records := stateRecords(t, p); len(records) != 2 {
+		t.Fatalf("saved %d records, want the state and the appended entries", len(records))
+	}
+
+	// then overwrites everything after the first one, in the same term
+	n.HandleAppendEntries(AppendEntriesArgs{Term: 2, LeaderID: "n2", PrevLogIndex: 1, PrevLogTerm: 1, Entries: []Entry{
+		{Index: 2, Term: 2},
+	}})
+	if records := stateRecords(t, p); len(records) != 1 {
+		t.Fatalf("saved %d records after dropping entries, want the whole state rewritten", len(records))
+	}
+
+	restarted, err := NewNode("n1", []string{"n2"}, NewMemoryNetwork().Transport("n1"), &testStateMachine{}, p, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if terms := logTerms(restarted); !slices.Equal(terms, []int{1, 2}) {
+		t.Fatalf("restarted with entries of terms %v, want [1 2]", terms)
+	}
+}
+
+func TestTornAppend(t *testing.T) {
+	p := NewMemoryPersister()
+	n, err := NewNode("n1", []string{"n2"}, NewMemoryNetwork().Transport("n1"), &testStateMachine{}, p, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		n.HandleAppendEntries(AppendEntriesArgs{Term: 1, LeaderID: "n2", PrevLogIndex: i - 1, PrevLogTerm: min(i-1, 1), Entries: []Entry{
+			{Index: i, Term: 1},
+		}})
+	}
+
+	// a crash in the middle of the last append
+	data, _ := p.LoadState()
+	p.SaveState(data[:len(data)-3])
+
+	restarted, err := NewNode("n1", []string{"n2"}, NewMemoryNetwork().Transport("n1"), &testStateMachine{}, p, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := restarted.Status(); status.LastIndex != 2 || status.Term != 1 {
+		t.Fatalf("restarted in term %d with %d entries, want term 1 with 2", status.Term, status.LastIndex)
+	}
+	// the half written record is gone, so what is appended next can be read back
+	if records := stateRecords(t, p); len(records) != 1 {
+		t.Fatalf("saved %d records after restoring, want the whole state rewritten", len(records))
+	}
+}
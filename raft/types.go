@@ -0,0 +1,106 @@
+package raft
+
+import (
+	"time"
+
+	"cadence/constants"
+
+	"github.com/pkg/errors"
+)
+
+// single entry of the replicated log. entries without a command are no-ops a new leader appends
+// to commit whatever its predecessors left behind.
+type Entry struct {
+	Index   int
+	Term    int
+	Command []byte
+}
+
+// RPCS ---------------------------------------------------------------------------------------
+type RequestVoteArgs struct {
+	Term         int
+	CandidateID  string
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         int
+	LeaderID     string
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []Entry // empty for heartbeats
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term          int
+	Success       bool
+	ConflictIndex int // if not successful, where the leader should retry from
+}
+
+type InstallSnapshotArgs struct {
+	Term              int
+	LeaderID          string
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Data              []byte
+}
+
+type InstallSnapshotReply struct {
+	Term int
+}
+
+// carries RPCs to the other nodes, by id. an error means the RPC may or may not have been delivered.
+type Transport interface {
+	RequestVote(peer string, args RequestVoteArgs) (RequestVoteReply, error)
+	AppendEntries(peer string, args AppendEntriesArgs) (AppendEntriesReply, error)
+	InstallSnapshot(peer string, args InstallSnapshotArgs) (InstallSnapshotReply, error)
+}
+
+// whatever the log is replicating. commands are applied one at a time, in log order, on every node.
+type StateMachine interface {
+	Apply(command []byte) []byte
+	Snapshot() ([]byte, error)
+	Restore(snapshot []byte) error
+}
+
+// CONFIG -------------------------------------------------------------------------------------
+type Config struct {
+	ElectionTimeout   time.Duration // followers wait between this and twice this for a leader before standing for election
+	HeartbeatInterval time.Duration
+	SnapshotThreshold int // log entries kept before they are compacted into a snapshot
+	MaxBatch          int // most entries sent in one AppendEntries
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ElectionTimeout:   constants.RAFT_ELECTION_TIMEOUT,
+		HeartbeatInterval: constants.RAFT_HEARTBEAT_INTERVAL,
+		SnapshotThreshold: constants.RAFT_SNAPSHOT_THRESHOLD,
+		MaxBatch:          constants.RAFT_MAX_BATCH,
+	}
+}
+
+// ERRORS -------------------------------------------------------------------------------------
+var (
+	ErrStopped        = errors.New("raft node is stopped")
+	ErrLeadershipLost = errors.New("leadership was lost before the command was committed")
+)
+
+// returned when a command is proposed to a node that isn't the leader
+type NotLeaderError struct {
+	Leader string // id of the leader, if known
+}
+
+func (err *NotLeaderError) Error() string {
+	if err.Leader == "" {
+		return "not the leader, and no leader is known"
+	}
+	return "not the leader, the leader is " + err.Leader
+}
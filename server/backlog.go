@@ -0,0 +1,59 @@
+package server
+
+// REPLICATION_BACKLOG ------------------------------------------------------------------------
+// circular buffer holding the most recent bytes of the replication stream, so a replica that
+// reconnects can be sent just what it missed. the byte at replication offset o lives at buffer[o % size].
+type ReplicationBacklog struct {
+	buffer []byte
+	end    int // replication offset just past the newest byte held
+	length int // number of bytes held, at most len(buffer)
+}
+
+func NewReplicationBacklog(size int) *ReplicationBacklog {
+	if size <= 0 {
+		panic("Replication backlog size must be greater than 0.")
+	}
+	return &ReplicationBacklog{buffer: make([]byte, size)}
+}
+
+// public methods -------------
+func (backlog *ReplicationBacklog) Write(data []byte) {
+	size := len(backlog.buffer)
+
+	// only the last size bytes can ever be held
+	skipped := max(len(data)-size, 0)
+	backlog.end += skipped
+	data = data[skipped:]
+
+	for len(data) > 0 {
+		pos := backlog.end % size
+		n := copy(backlog.buffer[pos:], data)
+		data = data[n:]
+		backlog.end += n
+		backlog.length = min(backlog.length+n, size)
+	}
+}
+
+// returns everything from offset up to the end of the stream, false if offset is not held anymore (or never was)
+func (backlog *ReplicationBacklog) ReadFrom(offset int) ([]byte, bool) {
+	start := backlog.end - backlog.length
+	if offset < start || offset > backlog.end {
+		return nil, false
+	}
+
+	size := len(backlog.buffer)
+	data := make([]byte, 0, backlog.end-offset)
+	for offset < backlog.end {
+		pos := offset % size
+		n := min(size-pos, backlog.end-offset)
+		data = append(data, backlog.buffer[pos:pos+n]...)
+		offset += n
+	}
+	return data, true
+}
+
+// empties the backlog, and continues the stream from offset
+func (backlog *ReplicationBacklog) Reset(offset int) {
+	backlog.end = offset
+	backlog.length = 0
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+// checks every offset around what backlog should hold: the stream written since start, of which only
+// the last size bytes are kept
+func checkBacklog(t *testing.T, backlog *ReplicationBacklog, size int, start int, stream string) {
+	t.Helper()
+	end := start + len(stream)
+	oldest := max(start, end-size)
+	for offset := oldest - 3; offset <= end+3; offset++ {
+		data, ok := backlog.ReadFrom(offset)
+		wantOK := offset >= oldest && offset <= end
+		if ok != wantOK {
+			t.Fatalf("ReadFrom(%d) ok is %v, want %v (holding %d to %d)", offset, ok, wantOK, oldest, end)
+		}
+		if !ok {
+			if data != nil {
+				t.Fatalf("ReadFrom(%d) = %q for an offset it doesn't hold", offset, data)
+			}
+			continue
+		}
+		if want := stream[offset-start:]; string(data) != want {
+			t.Fatalf("ReadFrom(%d) = %q, want %q", offset, data, want)
+		}
+	}
+}
+
+func TestReplicationBacklog(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		start  int // offset the stream continues from (Reset), 0 for a new backlog
+		writes []string
+	}{
+		{"nothing written", 8, 0, nil},
+		{"fits", 8, 0, []string{"abc", "de"}},
+		{"exactly full", 8, 0, []string{"abcdefgh"}},
+		{"wraps around", 8, 0, []string{"abcde", "fghij", "klm"}},
+		{"wraps many times", 3, 0, []string{"ab", "cd", "ef", "g", "hijk", "l"}},
+		{"write bigger than the buffer", 8, 0, []string{"abc", "0123456789ABCDEF"}},
+		{"write ending on the edge", 8, 0, []string{"abc", "defgh", "ijklmnop"}},
+		{"empty writes", 4, 0, []string{"", "ab", "", "cdef", ""}},
+		{"one byte buffer", 1, 0, []string{"a", "bc", "d"}},
+		{"continues from a reset", 8, 1003, []string{"abc", "defghij"}},
+		{"reset onto the edge", 8, 16, []string{"abcdefgh", "i"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backlog := NewReplicationBacklog(tt.size)
+			backlog.Reset(tt.start)
+			stream := ""
+			checkBacklog(t, backlog, tt.size, tt.start, stream)
+			for _, data := range tt.writes {
+				backlog.Write([]byte(data))
+				stream += data
+				checkBacklog(t, backlog, tt.size, tt.start, stream)
+			}
+		})
+	}
+}
+
+func TestReplicationBacklogReset(t *testing.T) {
+	backlog := NewReplicationBacklog(8)
+	backlog.Write([]byte("abcdefghijk"))
+
+	// a full sync starts the stream over from wherever the master is, forgetting what came before
+	backlog.Reset(500)
+	checkBacklog(t, backlog, 8, 500, "")
+	backlog.Write([]byte("xyz"))
+	checkBacklog(t, backlog, 8, 500, "xyz")
+
+	// and it can go back too (a replica taking a new master's offset)
+	backlog.Reset(2)
+	checkBacklog(t, backlog, 8, 2, "")
+	backlog.Write([]byte(strings.Repeat("q", 20)))
+	checkBacklog(t, backlog, 8, 2, strings.Repeat("q", 20))
+}
+
+func TestReplicationBacklogSize(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("created a backlog that can't hold anything")
+		}
+	}()
+	NewReplicationBacklog(0)
+}
@@ -0,0 +1,454 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cadence/cluster"
+	"cadence/constants"
+	"cadence/protocol"
+	"cadence/utils"
+)
+
+// address (host:port) clients and other nodes reach this node at, which node serves each hash slot,
+// and the bus it gossips with the other nodes on. all are only set if the server runs in cluster mode -
+// slots and clusterBus are nil otherwise.
+var clusterAddress string
+var slots *cluster.SlotMap
+var clusterBus *cluster.Bus
+
+// keys in each slot (only kept in cluster mode), so listing or counting a slot's keys doesn't scan the whole cache
+var (
+	slotKeys      = map[int]map[string]struct{}{}
+	slotKeysMutex sync.Mutex
+)
+
+// keys a MIGRATE is sending to another node right now, writes to them wait on migrationDone until it is done
+var (
+	movingKeys    = map[string]bool{}
+	migrationDone = sync.NewCond(&writeMutex)
+)
+
+// connections that sent ASKING, so their next command with keys may touch a slot being imported
+var (
+	asking      = map[net.Conn]bool{}
+	askingMutex sync.Mutex
+)
+
+// CommandInfo.Keys for commands whose only key is the first argument
+func firstKey(args []string) []string {
+	return args[:1]
+}
+
+// REDIRECTION --------------------------------------------------------------------------------
+// checks this node should be the one running a command with the given keys, returning the error code
+// and message to reply with if not (or empty strings if it should):
+//   - MOVED slot host:port if another node serves the slot - the client should go there from now on
+//   - ASK slot host:port if the slot is being moved out of this node and a key has already gone -
+//     the client should send ASKING then the command to that node, but only for this one command
+//   - CROSSSLOT if the keys hash to different slots, CLUSTERDOWN if no node serves the slot
+func clusterRedirect(keys []string, conn net.Conn) (string, string) {
+	wasAsking := takeAsking(conn)
+	if len(keys) == 0 {
+		return "", ""
+	}
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			return utils.ErrorCodes.CROSSSLOT, "Keys in request don't hash to the same slot."
+		}
+	}
+
+	owner := slots.Owner(slot)
+	if owner == clusterAddress {
+		return askRedirect(slot, keys)
+	}
+	if _, importing := slots.Importing(slot); importing && wasAsking {
+		return "", ""
+	}
+	if owner == "" {
+		return utils.ErrorCodes.CLUSTERDOWN, fmt.Sprintf("Hash slot %d not served.", slot)
+	}
+	return utils.ErrorCodes.MOVED, fmt.Sprintf("%d %s", slot, owner)
+}
+
+// ASK slot host:port if slot is being moved out of this node and one of keys has already gone
+func askRedirect(slot int, keys []string) (string, string) {
+	if target, migrating := slots.Migrating(slot); migrating {
+		for _, key := range keys {
+			// (only routing the command, so don't touch the key)
+			if _, exists := cache.Peek(key); !exists {
+				return utils.ErrorCodes.ASK, fmt.Sprintf("%d %s", slot, target)
+			}
+		}
+	}
+	return "", ""
+}
+
+func setAsking(conn net.Conn) {
+	askingMutex.Lock()
+	defer askingMutex.Unlock()
+	asking[conn] = true
+}
+
+// whether conn sent ASKING since its last command with keys, clearing it - ASKING only covers one command
+func takeAsking(conn net.Conn) bool {
+	askingMutex.Lock()
+	defer askingMutex.Unlock()
+	wasAsking := asking[conn]
+	delete(asking, conn)
+	return wasAsking
+}
+
+func forgetAsking(conn net.Conn) {
+	takeAsking(conn)
+}
+
+// cluster section of INFO
+func clusterInfo() []string {
+	if slots == nil {
+		return []string{"cluster_enabled:0"}
+	}
+	status := clusterBus.Status()
+	state := "fail"
+	if status.Ok {
+		state = "ok"
+	}
+	return []string{
+		"cluster_enabled:1",
+		"cluster_state:" + state,
+		"cluster_my_id:" + status.ID,
+		"cluster_address:" + clusterAddress,
+		"cluster_known_nodes:" + strconv.Itoa(status.KnownNodes),
+		"cluster_current_epoch:" + strconv.Itoa(status.CurrentEpoch),
+		"cluster_my_epoch:" + strconv.Itoa(status.ConfigEpoch),
+		"cluster_my_slots:" + strconv.Itoa(len(slots.SlotsOf(clusterAddress))),
+		"cluster_unassigned_slots:" + strconv.Itoa(len(slots.SlotsOf(""))),
+	}
+}
+
+// CLUSTER_COMMAND ----------------------------------------------------------------------------
+func clusterCommand(args []string) []byte {
+	switch strings.ToUpper(args[0]) {
+	case "KEYSLOT":
+		return utils.IntegerSerialize(cluster.KeySlot(args[1]))
+	case "MYID":
+		return utils.BulkStringSerialize(clusterBus.Status().ID)
+	case "NODES":
+		return utils.BulkStringSerialize(clusterNodes())
+	case "SLOTS":
+		return clusterSlots()
+	case "MEET":
+		if err := clusterBus.Meet(net.JoinHostPort(args[1], args[2])); err != nil {
+			return utils.ErrorSerialize(utils.ErrorCodes.ERR, "Could not meet node, "+err.Error())
+		}
+	case "ADDSLOTS":
+		for _, arg := range args[1:] {
+			slot, _ := cluster.ParseSlot(arg)
+			if owner := slots.Owner(slot); owner != "" && owner != clusterAddress {
+				return utils.ErrorSerialize(utils.ErrorCodes.ERR, fmt.Sprintf("Slot %d is already served by %s.", slot, owner))
+			}
+		}
+		assignSlots(args[1:], clusterAddress)
+	case "DELSLOTS":
+		assignSlots(args[1:], "")
+	case "GETKEYSINSLOT":
+		slot, _ := cluster.ParseSlot(args[1])
+		count, _ := strconv.Atoi(args[2])
+		return utils.BulkStringArraySerialize(keysInSlot(slot, count))
+	case "COUNTKEYSINSLOT":
+		slot, _ := cluster.ParseSlot(args[1])
+		return utils.IntegerSerialize(len(keysInSlot(slot, -1)))
+	default: // SETSLOT
+		return setSlot(args[1:])
+	}
+	return utils.SimpleStringSerialize(protocol.Responses.OKAY)
+}
+
+// SETSLOT slot NODE host:port | MIGRATING host:port | IMPORTING host:port | STABLE
+func setSlot(args []string) []byte {
+	slot, _ := cluster.ParseSlot(args[0])
+	owner := slots.Owner(slot)
+	switch strings.ToUpper(args[1]) {
+	case "MIGRATING":
+		if owner != clusterAddress {
+			return utils.ErrorSerialize(utils.ErrorCodes.ERR, fmt.Sprintf("This node doesn't serve slot %d, so can't migrate it.", slot))
+		}
+		slots.SetMigrating(slot, args[2])
+	case "IMPORTING":
+		if owner == clusterAddress {
+			return utils.ErrorSerialize(utils.ErrorCodes.ERR, fmt.Sprintf("This node already serves slot %d.", slot))
+		}
+		slots.SetImporting(slot, args[2])
+	case "STABLE":
+		slots.SetStable(slot)
+	default: // NODE
+		_, importing := slots.Importing(slot)
+		slots.Assign(slot, args[2])
+		// a slot that was just moved here has to beat the old owner's claim on it
+		if importing && args[2] == clusterAddress {
+			clusterBus.BumpEpoch()
+		}
+	}
+	return utils.SimpleStringSerialize(protocol.Responses.OKAY)
+}
+
+// up to count keys (any number, if count is negative) in slot
+func keysInSlot(slot int, count int) []string {
+	slotKeysMutex.Lock()
+	candidates := make([]string, 0, len(slotKeys[slot]))
+	for key := range slotKeys[slot] {
+		candidates = append(candidates, key)
+	}
+	slotKeysMutex.Unlock()
+
+	// the index still has keys that expired but haven't been evicted yet
+	keys := []string{}
+	for _, key := range candidates {
+		if count >= 0 && len(keys) >= count {
+			break
+		}
+		if _, exists := cache.Peek(key); exists {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// called by the cache whenever a key is added or removed, to keep slotKeys up to date
+func indexSlotKey(key string, added bool) {
+	slotKeysMutex.Lock()
+	defer slotKeysMutex.Unlock()
+	slot := cluster.KeySlot(key)
+	if added {
+		if slotKeys[slot] == nil {
+			slotKeys[slot] = map[string]struct{}{}
+		}
+		slotKeys[slot][key] = struct{}{}
+	} else {
+		delete(slotKeys[slot], key)
+		if len(slotKeys[slot]) == 0 {
+			delete(slotKeys, slot)
+		}
+	}
+}
+
+// MIGRATE ------------------------------------------------------------------------------------
+// moves keys to the node at address: each one is written there (after an ASKING, as the slot is being
+// imported there) with its expiry, and once that node has all of them, deleted here. writes to the keys
+// being moved wait until it is done, so none can slip in between a key being copied and deleted - every
+// other write carries on while the keys are sent. keys that don't exist are skipped.
+func migrateKeys(address string, timeout time.Duration, keys []string) []byte {
+	writeMutex.Lock()
+	// another MIGRATE may send some of them off while this one waits, those are gone by the time it is done
+	// and skipped like any other key that isn't here
+	waitForMoves(keys)
+	request := []byte{}
+	moving := []string{}
+	for _, key := range keys {
+		// moving a key isn't a use of it, so it isn't made more recent (or expired) here
+		value, expiryTime, exists := cache.PeekWithExpiry(key)
+		if !exists || slices.Contains(moving, key) {
+			continue
+		}
+		set := []string{protocol.Commands.SET, key, value}
+		if !expiryTime.IsZero() {
+			set = append(set, "PXAT", strconv.FormatInt(expiryTime.UnixMilli(), 10))
+		}
+		request = append(request, utils.BulkStringArraySerialize([]string{protocol.Commands.ASKING})...)
+		request = append(request, utils.BulkStringArraySerialize(set)...)
+		moving = append(moving, key)
+		movingKeys[key] = true
+	}
+	writeMutex.Unlock()
+	if len(moving) == 0 {
+		return utils.SimpleStringSerialize("NOKEY")
+	}
+
+	failed := sendKeys(address, timeout, request, len(moving))
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	for _, key := range moving {
+		if failed == nil {
+			del := NewInstruction([]string{protocol.Commands.DELETE, key})
+			del.applyWriteLocked(cmdMap[protocol.Commands.DELETE], nil, false)
+		}
+		delete(movingKeys, key)
+	}
+	migrationDone.Broadcast()
+	if failed != nil {
+		return failed
+	}
+	return utils.SimpleStringSerialize(protocol.Responses.OKAY)
+}
+
+// writes the ASKING and SET pairs in request to the node at address, returns the error to reply
+// with if it didn't take all count of them (nil if it did)
+func sendKeys(address string, timeout time.Duration, request []byte, count int) []byte {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return utils.ErrorSerialize(utils.ErrorCodes.IOERR, "could not connect to target node, "+err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	responses := utils.ReadRepliesFromConn(conn, protocol.NewResponse)
+	if _, err := conn.Write(request); err != nil {
+		return utils.ErrorSerialize(utils.ErrorCodes.IOERR, "could not send keys to target node, "+err.Error())
+	}
+	for range 2 * count {
+		response, ok := <-responses
+		if !ok {
+			return utils.ErrorSerialize(utils.ErrorCodes.IOERR, "target node closed the connection or timed out.")
+		}
+		if response.Err != nil {
+			return utils.ErrorSerialize(utils.ErrorCodes.ERR, "target node refused a key, "+response.Err.Error())
+		}
+	}
+	return nil
+}
+
+// must hold writeMutex. waits until no MIGRATE is moving any of keys (other writes can go ahead meanwhile).
+// the write was routed here before it waited, so if one of its keys moved out in the meantime this
+// returns the ASK to reply with instead (nil otherwise).
+func waitForMigration(keys []string) []byte {
+	if waitForMoves(keys) {
+		if code, redirect := askRedirect(cluster.KeySlot(keys[0]), keys); code != "" {
+			return utils.ErrorSerialize(code, redirect)
+		}
+	}
+	return nil
+}
+
+// must hold writeMutex. waits until no MIGRATE is moving any of keys, returns whether it had to
+func waitForMoves(keys []string) bool {
+	waited := false
+	for slices.ContainsFunc(keys, func(key string) bool { return movingKeys[key] }) {
+		migrationDone.Wait()
+		waited = true
+	}
+	return waited
+}
+
+func assignSlots(args []string, address string) {
+	for _, arg := range args {
+		slot, _ := cluster.ParseSlot(arg)
+		slots.Assign(slot, address)
+	}
+}
+
+func validateClusterCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	validSlots := func(args []string) bool {
+		for _, arg := range args {
+			if _, err := cluster.ParseSlot(arg); err != nil {
+				return false
+			}
+		}
+		return len(args) > 0
+	}
+	switch strings.ToUpper(args[0]) {
+	case "MYID", "NODES", "SLOTS":
+		return len(args) == 1
+	case "MEET":
+		if len(args) != 3 {
+			return false
+		}
+		_, err := strconv.Atoi(args[2])
+		return err == nil
+	case "KEYSLOT":
+		return len(args) == 2
+	case "ADDSLOTS", "DELSLOTS":
+		return validSlots(args[1:])
+	case "GETKEYSINSLOT":
+		if len(args) != 3 || !validSlots(args[1:2]) {
+			return false
+		}
+		count, err := strconv.Atoi(args[2])
+		return err == nil && count >= 0
+	case "COUNTKEYSINSLOT":
+		return len(args) == 2 && validSlots(args[1:])
+	case "SETSLOT":
+		if len(args) < 3 || !validSlots(args[1:2]) {
+			return false
+		}
+		switch strings.ToUpper(args[2]) {
+		case "NODE", "MIGRATING", "IMPORTING":
+			return len(args) == 4
+		case "STABLE":
+			return len(args) == 3
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+}
+
+// one line per node: id host:port@busport flags - ping-sent pong-received config-epoch link-state slots...
+// (flags are myself, master, fail? if this node suspects it is failing and fail if it has failed,
+// ping and pong times are unix millis, 0 if none)
+func clusterNodes() string {
+	millis := func(t time.Time) string {
+		if t.IsZero() {
+			return "0"
+		}
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	lines := []string{}
+	for _, node := range clusterBus.Nodes() {
+		flags := []string{"master"}
+		if node.Myself {
+			flags = []string{"myself", "master"}
+		}
+		if node.Fail {
+			flags = append(flags, "fail")
+		} else if node.PFail {
+			flags = append(flags, "fail?")
+		}
+		// a ping is almost always in flight, so go by whether the node has answered recently
+		linkState := "connected"
+		if !node.Myself && time.Since(node.PongReceived) > constants.CLUSTER_NODE_TIMEOUT {
+			linkState = "disconnected"
+		}
+		_, busPort, _ := net.SplitHostPort(node.BusAddress)
+		fields := []string{
+			node.ID, node.Address + "@" + busPort, strings.Join(flags, ","), "-",
+			millis(node.PingSent), millis(node.PongReceived), strconv.Itoa(node.ConfigEpoch), linkState,
+		}
+		for _, r := range node.Slots {
+			if r.Start == r.End {
+				fields = append(fields, strconv.Itoa(r.Start))
+			} else {
+				fields = append(fields, fmt.Sprintf("%d-%d", r.Start, r.End))
+			}
+		}
+		lines = append(lines, strings.Join(fields, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// one entry per run of slots served by the same node: [start, end, [host, port, id]]
+func clusterSlots() []byte {
+	ids := map[string]string{}
+	for _, node := range clusterBus.Nodes() {
+		ids[node.Address] = node.ID
+	}
+	entries := [][]byte{}
+	for _, r := range slots.Ranges() {
+		host, port, _ := net.SplitHostPort(r.Owner)
+		portNumber, _ := strconv.Atoi(port)
+		owner := utils.ArraySerialize([][]byte{
+			utils.BulkStringSerialize(host), utils.IntegerSerialize(portNumber), utils.BulkStringSerialize(ids[r.Owner]),
+		})
+		entries = append(entries, utils.ArraySerialize([][]byte{utils.IntegerSerialize(r.Start), utils.IntegerSerialize(r.End), owner}))
+	}
+	return utils.ArraySerialize(entries)
+}
@@ -1,105 +1,92 @@
 package server
 
 import (
+	"fmt"
 	"net"
-	"os"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
+	"cadence/protocol"
+	"cadence/raft"
 	"cadence/utils"
 )
 
-type Replica struct {
-	host       string
-	port       string
-	connection net.Conn
-}
-
-var replicas = []*Replica{}
-
 //TODO: each conn.Write can return error, handle it
 /*
-Commands supported:
+protocol.Commands supported:
 
 PING
 INFO
 ECHO value
 GET key value
-SET key value [PX number]
+SET key value [PX number | PXAT unix_time_millis]
 PRINT - prints the contents of the entire db
+BGREWRITEAOF - compacts the append only log in the background
+SAVE - takes a snapshot, blocking until it is written
+BGSAVE - takes a snapshot in the background
+LASTSAVE - unix time of the last successful snapshot
 
-REPLSYNC
-FULLSYNC rdb_file - RDB file encoded as bulk string
-
-Note: anything in brackets means its optional.
-*/
+REPLSYNC [replication_id offset]
+FULLSYNC snapshot replication_id offset - the master's reply to REPLSYNC with a snapshot encoded as bulk string (only read during the handshake, never run as a command)
+CONTINUE replication_id - the master's reply to REPLSYNC, followed by the part of the replication stream the replica missed (also only read during the handshake)
+REPLCONF listening-port port | ACK offset | GETACK * - replica configuration and acknowledgements
+WAIT numreplicas timeout - blocks until numreplicas replicas have every write so far (or timeout millis pass)
+REPLICAOF host port | REPLICAOF NO ONE - follows a new master (with a full sync), or stops following one and takes writes
 
-// defined an explicit struct so the command names can easily be changed to make it more customizable
-var Commands = struct {
-	STATUS       string
-	INFO         string
-	ECHO         string
-	GET          string
-	SET          string
-	DELETE       string
-	PRINT        string
-	REPLICA_SYNC string
-	FULL_SYNC    string
-}{
-	STATUS:       "PING",
-	INFO:         "INFO",
-	ECHO:         "ECHO",
-	GET:          "GET",
-	SET:          "SET",
-	DELETE:       "DELETE",
-	PRINT:        "PRINT",
-	REPLICA_SYNC: "REPLSYNC",
-	FULL_SYNC:    "FULLSYNC",
-}
+RAFTVOTE payload | RAFTAPPEND payload | RAFTSNAPSHOT payload - raft RPCs between nodes in raft mode, the payload is JSON
 
-var Responses = struct {
-	ALL_GOOD string
-	OKAY     string
-}{
-	ALL_GOOD: "PONG",
-	OKAY:     "OK",
-}
+CLUSTER KEYSLOT key - hash slot key belongs to
+CLUSTER MEET host port - introduces this node to the node at host:port, and through it to the rest of the cluster
+CLUSTER NODES - every node this node knows of, one per line
+CLUSTER SLOTS - which node serves each run of slots, as an array of [start, end, [host, port, id]]
+CLUSTER MYID - this node's id in the cluster
+CLUSTER ADDSLOTS slot [slot ...] | CLUSTER DELSLOTS slot [slot ...] - start or stop serving slots on this node
+CLUSTER SETSLOT slot NODE host:port - record which node serves slot
+CLUSTER SETSLOT slot MIGRATING host:port | IMPORTING host:port | STABLE - start moving slot to (or from) another node, or call it off
+CLUSTER GETKEYSINSLOT slot count | CLUSTER COUNTKEYSINSLOT slot - keys in a slot, or how many there are
+ASKING - lets the next command touch a slot being imported, after an ASK redirect
+MIGRATE host port timeout key [key ...] - moves keys to the node at host:port (timeout millis), deleting them here once it has them
 
-// list of commands to propagate to replicas
-var commandsToPropagate = []string{Commands.SET}
+Note: anything in brackets means its optional.
+*/
 
 // Command struct
 type CommandInfo struct {
 	DocString string
+	IsWrite  bool // mutates the cache, so gets logged and propagated to replicas
+	Keys     func(args []string) []string // keys the command touches, in cluster mode they decide which node runs it (nil if none)
 	Execute  func(args []string, conn net.Conn) []byte
 	Validate func(args []string) bool
 }
 
 // map of commands to CommandInfo
 var cmdMap = map[string]CommandInfo{
-	Commands.STATUS: {
+	protocol.Commands.STATUS: {
 		DocString: "Ping the server",
 		Execute: func(args []string, conn net.Conn) []byte {
-			return utils.SimpleStringSerialize(Responses.ALL_GOOD)
+			return utils.SimpleStringSerialize(protocol.Responses.ALL_GOOD)
 		},
 		Validate: func(args []string) bool {
 			return len(args) == 0
 		},
 	},
-	Commands.INFO: {
+	protocol.Commands.INFO: {
 		DocString: "Get information about the server",
 		Execute: func(args []string, conn net.Conn) []byte {
-			if ServerInfo.IsReplica {
-				return utils.BulkStringSerialize("role:slave")//\nmaster_replid:" + replID + "\nmaster_repl_offset:" + strconv.Itoa(repOffset) + "\n"))
+			info := append(replicationInfo(), snapshots.Info()...)
+			if raftNode != nil {
+				info = append(info, raftInfo()...)
 			}
-			return utils.BulkStringSerialize("role:master")
+			info = append(info, clusterInfo()...)
+			return utils.BulkStringSerialize(strings.Join(info, "\r\n"))
 		},
 		Validate: func(args []string) bool {
 			return len(args) == 0
 		},
 	},
-	Commands.ECHO: {
+	protocol.Commands.ECHO: {
 		DocString: "Echo the given message",
 		Execute: func(args []string, conn net.Conn) []byte {
 			return utils.BulkStringSerialize(strings.Join(args, " "))
@@ -108,8 +95,9 @@ var cmdMap = map[string]CommandInfo{
 			return len(args) > 0
 		},
 	},
-	Commands.GET: {
+	protocol.Commands.GET: {
 		DocString: "Get the value of a key",
+		Keys:      firstKey,
 		Execute: func(args []string, conn net.Conn) []byte {
 			value, exists := cache.Get(args[0])
 			if exists {
@@ -121,89 +109,285 @@ var cmdMap = map[string]CommandInfo{
 			return len(args) == 1
 		},
 	},
-	Commands.SET: {
+	protocol.Commands.SET: {
 		DocString: "Set the value of a key",
+		IsWrite:   true,
+		Keys:      firstKey,
 		Execute: func(args []string, conn net.Conn) []byte {
 			var n = len(args)
+			option := strings.ToUpper(args[n-2])
 
-			if n < 4 || strings.ToUpper(args[len(args)-2]) != "PX" {
+			if n < 4 || (option != "PX" && option != "PXAT") {
 				cache.Set(args[0], args[1], -1)
 			} else {
-				duration, err := strconv.Atoi(args[3])
+				duration, err := strconv.ParseInt(args[n-1], 10, 64)
 				if err != nil {
 					// it fails, write back an error
-					return utils.BulkStringSerialize("ERROR: An error occurred reading the expiry, please try again.")
+					return utils.ErrorSerialize(utils.ErrorCodes.ERR, "An error occurred reading the expiry, please try again.")
+				}
+				if option == "PXAT" {
+					cache.SetWithExpiry(args[0], args[1], time.UnixMilli(duration))
+				} else {
+					cache.Set(args[0], args[1], int(duration))
 				}
-				cache.Set(args[0], args[1], duration)
-			}
-
-			if !ServerInfo.IsReplica {
-				return utils.SimpleStringSerialize(Responses.OKAY)
 			}
-			return nil
+			return utils.SimpleStringSerialize(protocol.Responses.OKAY)
 		},
 		Validate: func(args []string) bool {
 			if len(args) < 2 {
 				return false
 			}
-			exIndex := slices.Index(args, "PX")
+			// (the key and value can be anything, PX included)
+			exIndex := slices.IndexFunc(args[2:], func(arg string) bool {
+				return strings.ToUpper(arg) == "PX" || strings.ToUpper(arg) == "PXAT"
+			})
 
-			// if sent PX option, better be longer than 4 args and last two args should be: PX number
+			// if sent PX (or PXAT) option, better be longer than 4 args and last two args should be: PX number
 			if exIndex == -1 {
 				return true
-			} else if len(args) >= 4 && exIndex == len(args)-2 {
-				_, err := strconv.Atoi(args[len(args)-1])
+			} else if len(args) >= 4 && exIndex+2 == len(args)-2 {
+				_, err := strconv.ParseInt(args[len(args)-1], 10, 64)
 				return err == nil
 			} else {
 				return false
 			}
 		},
 	},
-	Commands.DELETE: {
+	protocol.Commands.DELETE: {
 		DocString: "Delete entry from cache",
+		IsWrite:   true,
+		Keys:      firstKey,
 		Execute: func(args []string, conn net.Conn) []byte {
 			cache.Delete(args[0])
-			if !ServerInfo.IsReplica {
-				return utils.SimpleStringSerialize(Responses.OKAY)
-			}
-			return nil
+			return utils.SimpleStringSerialize(protocol.Responses.OKAY)
 		},
 		Validate: func(args []string) bool {
 			return len(args) == 1
 		},
 	},
-	Commands.REPLICA_SYNC: {
-		DocString: "Synchronize with a replica",
+	protocol.Commands.REPLICA_CONF: {
+		DocString: "Configure replication, and acknowledge replication offsets",
 		Execute: func(args []string, conn net.Conn) []byte {
-			// REPLICA handshake is going to only be simple handshake - replica sends ask to sync with port, master replies with RDB file (full resync)
-			host, port, err := net.SplitHostPort(conn.RemoteAddr().String())
-			if err != nil {
-				return utils.BulkStringArraySerialize([]string{"ERROR: could not add replica, try again"})
-			} else {
-				replicas = append(replicas, &Replica{host: host, port: port, connection: conn})
-				data, err := os.ReadFile("snapshot.txt")
-				if err != nil {
-					return utils.BulkStringArraySerialize([]string{"ERROR: could not add replica, try again"})
+			switch strings.ToUpper(args[0]) {
+			case "LISTENING-PORT":
+				announceReplicaPort(conn, args[1])
+				return utils.SimpleStringSerialize(protocol.Responses.OKAY)
+			case "ACK":
+				// replicas don't expect a reply to acknowledgements
+				offset, _ := strconv.Atoi(args[1])
+				acknowledgeOffset(conn, offset)
+				return nil
+			default:
+				// GETACK comes from the master, which never gets replies, so acknowledge explicitly
+				if err := sendAcknowledgement(conn); err != nil {
+					fmt.Println("ERROR: could not acknowledge offset to master,", err)
 				}
-				return utils.BulkStringArraySerialize([]string{"FULLSYNC", string(data)}) // TODO: make this more efficient
+				return nil
 			}
 		},
+		Validate: func(args []string) bool {
+			if len(args) != 2 {
+				return false
+			}
+			switch strings.ToUpper(args[0]) {
+			case "LISTENING-PORT", "ACK":
+				_, err := strconv.Atoi(args[1])
+				return err == nil
+			case "GETACK":
+				return true
+			default:
+				return false
+			}
+		},
+	},
+	protocol.Commands.WAIT: {
+		DocString: "Wait until a number of replicas have acknowledged every write so far",
+		Execute: func(args []string, conn net.Conn) []byte {
+			if isReplica() {
+				return utils.ErrorSerialize(utils.ErrorCodes.ERR, "WAIT cannot be used with replica instances.")
+			}
+			numReplicas, _ := strconv.Atoi(args[0])
+			timeout, _ := strconv.Atoi(args[1])
+			acked := waitForReplicas(numReplicas, time.Duration(timeout)*time.Millisecond)
+			return utils.IntegerSerialize(acked)
+		},
+		Validate: func(args []string) bool {
+			if len(args) != 2 {
+				return false
+			}
+			numReplicas, err1 := strconv.Atoi(args[0])
+			timeout, err2 := strconv.Atoi(args[1])
+			return err1 == nil && err2 == nil && numReplicas >= 0 && timeout >= 0
+		},
+	},
+	protocol.Commands.CLUSTER: {
+		DocString: "Inspect or change which node serves each hash slot in cluster mode",
+		Execute: func(args []string, conn net.Conn) []byte {
+			if slots == nil {
+				return utils.ErrorSerialize(utils.ErrorCodes.ERR, "This instance has cluster support disabled.")
+			}
+			return clusterCommand(args)
+		},
+		Validate: validateClusterCommand,
+	},
+	protocol.Commands.ASKING: {
+		DocString: "Let the next command touch a slot this node is importing",
+		Execute: func(args []string, conn net.Conn) []byte {
+			if slots == nil {
+				return utils.ErrorSerialize(utils.ErrorCodes.ERR, "This instance has cluster support disabled.")
+			}
+			setAsking(conn)
+			return utils.SimpleStringSerialize(protocol.Responses.OKAY)
+		},
 		Validate: func(args []string) bool {
 			return len(args) == 0
 		},
 	},
-	Commands.FULL_SYNC: {
-		DocString: "Perform a full synchronization",
+	protocol.Commands.RAFT_VOTE: {
+		DocString: "Ask for this node's vote in a raft election",
 		Execute: func(args []string, conn net.Conn) []byte {
-			// REPLICA handshake is going to only be simple handshake - replica sends ask to sync with port, master replies with RDB file
-			// get the port, do something with it (store it)
-			// return back full resync - WHAT?
-			return utils.BulkStringArraySerialize([]string{"FULLSYNC", ""})
+			return handleRaftRPC(conn, args[0], func(rpc raft.RequestVoteArgs) raft.RequestVoteReply {
+				return raftNode.HandleRequestVote(rpc)
+			})
 		},
 		Validate: func(args []string) bool {
-			//TODO: type should be a file
 			return len(args) == 1
 		},
 	},
+	protocol.Commands.RAFT_APPEND: {
+		DocString: "Append entries to this node's raft log (or just heartbeat)",
+		Execute: func(args []string, conn net.Conn) []byte {
+			return handleRaftRPC(conn, args[0], func(rpc raft.AppendEntriesArgs) raft.AppendEntriesReply {
+				return raftNode.HandleAppendEntries(rpc)
+			})
+		},
+		Validate: func(args []string) bool {
+			return len(args) == 1
+		},
+	},
+	protocol.Commands.RAFT_INSTALL: {
+		DocString: "Replace this node's raft log and cache with the leader's snapshot",
+		Execute: func(args []string, conn net.Conn) []byte {
+			return handleRaftRPC(conn, args[0], func(rpc raft.InstallSnapshotArgs) raft.InstallSnapshotReply {
+				return raftNode.HandleInstallSnapshot(rpc)
+			})
+		},
+		Validate: func(args []string) bool {
+			return len(args) == 1
+		},
+	},
+	protocol.Commands.REWRITE_LOG: {
+		DocString: "Compact the append only log in the background",
+		Execute: func(args []string, conn net.Conn) []byte {
+			if aof == nil {
+				return utils.ErrorSerialize(utils.ErrorCodes.ERR, "append only logging is disabled.")
+			}
+			if err := aof.StartRewrite(); err != nil {
+				return utils.ErrorSerialize(utils.ErrorCodes.ERR, err.Error())
+			}
+			return utils.SimpleStringSerialize(protocol.Responses.REWRITE_STARTED)
+		},
+		Validate: func(args []string) bool {
+			return len(args) == 0
+		},
+	},
+	protocol.Commands.SAVE: {
+		DocString: "Take a snapshot, blocking until it is written",
+		Execute: func(args []string, conn net.Conn) []byte {
+			if err := snapshots.Save(); err != nil {
+				return utils.ErrorSerialize(utils.ErrorCodes.ERR, err.Error())
+			}
+			return utils.SimpleStringSerialize(protocol.Responses.OKAY)
+		},
+		Validate: func(args []string) bool {
+			return len(args) == 0
+		},
+	},
+	protocol.Commands.BG_SAVE: {
+		DocString: "Take a snapshot in the background",
+		Execute: func(args []string, conn net.Conn) []byte {
+			if err := snapshots.BackgroundSave(); err != nil {
+				return utils.ErrorSerialize(utils.ErrorCodes.ERR, err.Error())
+			}
+			return utils.SimpleStringSerialize(protocol.Responses.BG_SAVE_STARTED)
+		},
+		Validate: func(args []string) bool {
+			return len(args) == 0
+		},
+	},
+	protocol.Commands.LAST_SAVE: {
+		DocString: "Get the unix time of the last successful snapshot",
+		Execute: func(args []string, conn net.Conn) []byte {
+			return utils.IntegerSerialize(int(snapshots.LastSave().Unix()))
+		},
+		Validate: func(args []string) bool {
+			return len(args) == 0
+		},
+	},
+	protocol.Commands.REPLICA_SYNC: {
+		DocString: "Synchronize with a replica",
+		Execute: func(args []string, conn net.Conn) []byte {
+			// REPLICA handshake is going to only be simple handshake - replica sends ask to sync (with where it got up to, if anywhere),
+			// master replies with either the part of the stream it missed (partial resync) or a snapshot (full resync)
+			if err := syncReplica(conn, args); err != nil {
+				fmt.Println("ERROR: full sync with replica failed,", err)
+				return utils.ErrorSerialize(utils.ErrorCodes.ERR, "could not add replica, try again")
+			}
+			return nil
+		},
+		Validate: func(args []string) bool {
+			if len(args) == 2 {
+				_, err := strconv.Atoi(args[1])
+				return err == nil
+			}
+			return len(args) == 0
+		},
+	},
 }
 
+// REPLICAOF ends up running instructions from the new master, and MIGRATE deletes the keys it moves
+// (both through cmdMap), so they are added here rather than in the literal above to break the initialization cycle
+func init() {
+	cmdMap[protocol.Commands.MIGRATE] = CommandInfo{
+		DocString: "Move keys to another node in the cluster",
+		Execute: func(args []string, conn net.Conn) []byte {
+			if slots == nil {
+				return utils.ErrorSerialize(utils.ErrorCodes.ERR, "This instance has cluster support disabled.")
+			}
+			timeout, _ := strconv.Atoi(args[2])
+			return migrateKeys(net.JoinHostPort(args[0], args[1]), time.Duration(timeout)*time.Millisecond, args[3:])
+		},
+		Validate: func(args []string) bool {
+			if len(args) < 4 {
+				return false
+			}
+			_, err1 := strconv.Atoi(args[1])
+			timeout, err2 := strconv.Atoi(args[2])
+			return err1 == nil && err2 == nil && timeout > 0
+		},
+	}
+	cmdMap[protocol.Commands.REPLICA_OF] = CommandInfo{
+		DocString: "Follow a new master, or with NO ONE, stop following one and become a master",
+		Execute: func(args []string, conn net.Conn) []byte {
+			if raftNode != nil {
+				return utils.ErrorSerialize(utils.ErrorCodes.ERR, "REPLICAOF cannot be used in raft mode.")
+			}
+			if strings.EqualFold(args[0], "NO") && strings.EqualFold(args[1], "ONE") {
+				promoteToMaster()
+			} else {
+				followMaster(net.JoinHostPort(args[0], args[1]))
+			}
+			return utils.SimpleStringSerialize(protocol.Responses.OKAY)
+		},
+		Validate: func(args []string) bool {
+			if len(args) != 2 {
+				return false
+			}
+			if strings.EqualFold(args[0], "NO") && strings.EqualFold(args[1], "ONE") {
+				return true
+			}
+			_, err := strconv.Atoi(args[1])
+			return err == nil
+		},
+	}
+}
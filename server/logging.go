@@ -1,48 +1,317 @@
 package server
 
-// import (
-// 	"cadence/utils"
-// 	"os"
-
-// 	"github.com/pkg/errors"
-// )
-
-// const log1 = "log1.txt"
-// const log2 = "log2.txt"
-
-// var currLog = log1
-// var notCurrLog = log2
-
-// func flipCurrLog() {
-// 	if currLog == log1 {
-// 		currLog = log2
-// 		notCurrLog = log1
-// 	} else {
-// 		currLog = log1
-// 		notCurrLog = log2
-// 	}
-// }
-
-// // what we want here
-// // this is going to be an append only log
-// // functions required:
-// // append to log, compact log (runs infrequently), read log, encrypt log + return, create log based on encrypted log
-
-// // TODO: keep the connection open so don't have do it a bunch of times
-// func AppendToLog(inst utils.Instruction) error {
-// 	file, err := os.OpenFile(currLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-// 	if err != nil {
-// 		return errors.Wrap(err, "Failed to log.")
-// 	}
-// 	defer file.Close()
-
-// 	_, err = file.WriteString(inst.String())
-// 	return err
-// }
-
-// func CompactLog() error {
-// 	file, err := os.Create(notCurrLog)
-// 	// read the contents backwards so the ones that are now evicted aren't added
-// 	// add the ones that aren't evicted
-// 	// switch current file name
-// }
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cadence/constants"
+	"cadence/protocol"
+	"cadence/utils"
+
+	"github.com/pkg/errors"
+)
+
+// append only log of every write command, so writes accepted between snapshots survive a crash.
+// each entry is the instruction serialized exactly as it would be sent over the wire.
+
+// fsync policies - how often the log is forced onto disk
+const (
+	FsyncAlways   = "always"   // after every write (safest, slowest)
+	FsyncEverySec = "everysec" // at most once a second (lose at most ~1s of writes)
+	FsyncNever    = "never"    // leave it to the OS
+)
+
+var fsyncPolicies = []string{FsyncAlways, FsyncEverySec, FsyncNever}
+
+// nil if append only logging is disabled
+var aof *AppendOnlyLog
+
+// APPEND_ONLY_LOG ----------------------------------------------------------------------------
+type AppendOnlyLog struct {
+	filename    string
+	file        *os.File
+	fsyncPolicy string
+	dirty       bool // written to since last fsync
+	stopJob     chan struct{}
+	mutex       sync.Mutex
+
+	// rewrite state
+	size          int64 // current size of the log in bytes
+	baseSize      int64 // size right after the last rewrite (or on open), used for the growth threshold
+	rewriting     bool
+	rewriteAgain  bool   // the cache was replaced while a rewrite was running, so run another once it is done
+	bufferWrites  bool   // set once the rewrite has frozen the cache it is writing out
+	rewriteBuffer []byte // writes that arrive after that point, to be added to the rewritten log
+}
+
+func OpenAppendOnlyLog(filename string, fsyncPolicy string) (*AppendOnlyLog, error) {
+	if !slices.Contains(fsyncPolicies, fsyncPolicy) {
+		return nil, errors.Errorf("invalid fsync policy %q, expected one of %s", fsyncPolicy, strings.Join(fsyncPolicies, ", "))
+	}
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open append only log")
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "failed to stat append only log")
+	}
+
+	log := AppendOnlyLog{
+		filename:    filename,
+		file:        file,
+		fsyncPolicy: fsyncPolicy,
+		stopJob:     make(chan struct{}),
+		size:        info.Size(),
+		baseSize:    info.Size(),
+	}
+
+	if fsyncPolicy == FsyncEverySec {
+		log.startSyncer()
+	}
+
+	return &log, nil
+}
+
+// private methods -------------
+func (log *AppendOnlyLog) startSyncer() {
+	// start background worker that fsyncs once a second if anything was written
+	t := time.NewTicker(constants.AOF_FSYNC_INTERVAL)
+	go func() {
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				log.mutex.Lock()
+				if log.dirty {
+					if err := log.file.Sync(); err != nil {
+						fmt.Println("ERROR: failed to fsync append only log:", err)
+					} else {
+						log.dirty = false
+					}
+				}
+				log.mutex.Unlock()
+			case <-log.stopJob:
+				return
+			}
+		}
+	}()
+}
+
+func (log *AppendOnlyLog) shouldRewrite() bool {
+	return !log.rewriting && log.size >= constants.AOF_REWRITE_MIN_SIZE &&
+		log.size >= log.baseSize*(100+constants.AOF_REWRITE_PERCENT)/100
+}
+
+// builds a minimal log from a point in time view of the cache, and swaps it in for the current log.
+// writes after that point still go to the old log, and are also buffered to be added to the new one.
+func (log *AppendOnlyLog) rewrite() {
+	err := log.writeRewrite()
+
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.rewriting = false
+	log.bufferWrites = false
+	log.rewriteBuffer = nil
+	if err != nil {
+		os.Remove(log.tempFilename())
+		fmt.Println("ERROR: append only log rewrite failed:", err)
+	} else {
+		fmt.Printf("Append only log rewritten, now %d bytes.\n", log.size)
+	}
+	if log.rewriteAgain {
+		log.rewriteAgain = false
+		log.rewriting = true
+		go log.rewrite()
+	}
+}
+
+func (log *AppendOnlyLog) writeRewrite() error {
+	temp, err := os.OpenFile(log.tempFilename(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp file")
+	}
+	defer temp.Close()
+
+	// use 64KB buffered writer, one SET per key (with when it expires, if it does)
+	bw := bufio.NewWriterSize(temp, 64<<10)
+	var writeErr error
+	startBuffering := func() {
+		log.mutex.Lock()
+		defer log.mutex.Unlock()
+		log.bufferWrites = true
+	}
+	cache.RangeFrozen(startBuffering, func(key string, value string, expiryTime time.Time) {
+		args := []string{key, value}
+		if !expiryTime.IsZero() {
+			args = append(args, "PXAT", strconv.FormatInt(expiryTime.UnixMilli(), 10))
+		}
+		inst := Instruction{Command: protocol.Commands.SET, Args: args}
+		if _, err := bw.Write(inst.Serialize()); err != nil && writeErr == nil {
+			writeErr = err
+		}
+	})
+	if writeErr != nil {
+		return errors.Wrap(writeErr, "failed to write rewritten log")
+	}
+	if err := bw.Flush(); err != nil {
+		return errors.Wrap(err, "failed to write rewritten log")
+	}
+	if err := temp.Sync(); err != nil {
+		return errors.Wrap(err, "failed to fsync rewritten log")
+	}
+
+	// block writers while the buffered writes are added and the files are swapped
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	if _, err := temp.Write(log.rewriteBuffer); err != nil {
+		return errors.Wrap(err, "failed to write buffered writes to rewritten log")
+	}
+	if err := temp.Sync(); err != nil {
+		return errors.Wrap(err, "failed to fsync rewritten log")
+	}
+	info, err := temp.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat rewritten log")
+	}
+	if err := os.Rename(log.tempFilename(), log.filename); err != nil {
+		return errors.Wrap(err, "failed to swap in rewritten log")
+	}
+
+	// the old file is now unlinked, point at the new one
+	file, err := os.OpenFile(log.filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to reopen rewritten log")
+	}
+	log.file.Close()
+	log.file = file
+	log.size = info.Size()
+	log.baseSize = info.Size()
+	log.dirty = false
+	return nil
+}
+
+func (log *AppendOnlyLog) tempFilename() string {
+	return log.filename + ".rewrite.tmp"
+}
+
+// public methods -------------
+func (log *AppendOnlyLog) Append(inst *Instruction) error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	// a relative TTL would start over every time the log is replayed, so log when the key expires instead
+	logged := absoluteExpiry(*inst)
+	data := logged.Serialize()
+	n, err := log.file.Write(data)
+	log.size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "failed to append to log")
+	}
+	if log.bufferWrites {
+		log.rewriteBuffer = append(log.rewriteBuffer, data...)
+	}
+
+	// kick off a rewrite once the log has grown enough
+	if log.shouldRewrite() {
+		log.rewriting = true
+		go log.rewrite()
+	}
+
+	if log.fsyncPolicy == FsyncAlways {
+		return log.file.Sync()
+	}
+	log.dirty = true
+	return nil
+}
+
+// starts a rewrite in the background, errors if one is already running
+func (log *AppendOnlyLog) StartRewrite() error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	if log.rewriting {
+		return errors.New("append only log rewrite already in progress")
+	}
+	log.rewriting = true
+	go log.rewrite()
+	return nil
+}
+
+// rewrites the log once the whole cache has been replaced (e.g. by a full sync), so a restart doesn't
+// replay the old contents. a rewrite that is already running saw those, so another follows it.
+func (log *AppendOnlyLog) RewriteReplaced() {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	if log.rewriting {
+		log.rewriteAgain = true
+		return
+	}
+	log.rewriting = true
+	go log.rewrite()
+}
+
+func (log *AppendOnlyLog) Close() error {
+	close(log.stopJob)
+
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	if err := log.file.Sync(); err != nil {
+		log.file.Close()
+		return err
+	}
+	return log.file.Close()
+}
+
+// replays every instruction in the log against the cache, returns the number of instructions applied.
+// a truncated last entry (e.g. crash mid-write) is dropped from the file so future appends stay readable.
+func ReplayAppendOnlyLog(filename string) (int, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "failed to open append only log")
+	}
+	defer file.Close()
+
+	// apply exactly what was logged - expiries and evictions were logged as DELETEs of their own
+	cache.SetPassive(true)
+	defer cache.SetPassive(isReplica())
+
+	reader := bufio.NewReader(file)
+	applied := 0
+	validBytes := int64(0)
+	for {
+		parts, err := utils.ReadBulkStringArray(reader)
+		if err == io.EOF {
+			return applied, nil
+		} else if err == io.ErrUnexpectedEOF {
+			fmt.Printf("WARNING: append only log ends with a truncated entry, truncating to %d bytes\n", validBytes)
+			return applied, file.Truncate(validBytes)
+		} else if err != nil {
+			return applied, errors.Wrapf(err, "append only log is corrupt after %d bytes", validBytes)
+		}
+
+		inst := NewInstruction(parts)
+		if valid, errorMsg := inst.Validate(); !valid {
+			return applied, errors.Errorf("append only log contains bad instruction %q: %s", inst.String(), errorMsg)
+		}
+		cmdMap[strings.ToUpper(inst.Command)].Execute(inst.Args, nil)
+
+		applied++
+		validBytes += int64(len(inst.Serialize()))
+	}
+}
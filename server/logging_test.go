@@ -0,0 +1,394 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cadence/constants"
+	"cadence/lru"
+	"cadence/protocol"
+)
+
+// swaps in an empty cache for the test, big enough that rewriting it takes a while
+func newTestCache(t *testing.T) {
+	c := lru.NewShardedLRU(1<<14, 16)
+	cache = c
+	t.Cleanup(c.Cleanup)
+}
+
+func openTestLog(t *testing.T, filename string, fsyncPolicy string) *AppendOnlyLog {
+	t.Helper()
+	log, err := OpenAppendOnlyLog(filename, fsyncPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return log
+}
+
+// appends each command (split on spaces) to the log at filename, and closes it
+func writeTestLog(t *testing.T, filename string, commands ...string) {
+	t.Helper()
+	log := openTestLog(t, filename, FsyncNever)
+	for _, command := range commands {
+		inst := NewInstruction(strings.Fields(command))
+		if err := log.Append(&inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectValue(t *testing.T, key string, want string, ok bool) {
+	t.Helper()
+	value, exists := cache.Peek(key)
+	if exists != ok || value != want {
+		t.Fatalf("%s is %q (set: %v), want %q (set: %v)", key, value, exists, want, ok)
+	}
+}
+
+func TestReplayRoundTrip(t *testing.T) {
+	newTestCache(t)
+	filename := filepath.Join(t.TempDir(), constants.AOF_FILE)
+	writeTestLog(t, filename, "SET a 1", "SET b 2 PX 60000", "SET c 3", "SET a 4", "DELETE c")
+
+	// relative TTLs are logged as when the key expires, so replaying later doesn't extend them
+	data, _ := os.ReadFile(filename)
+	if strings.Contains(string(data), "\r\nPX\r\n") || !strings.Contains(string(data), "\r\nPXAT\r\n") {
+		t.Fatalf("expiry not logged as PXAT:\n%q", data)
+	}
+
+	applied, err := ReplayAppendOnlyLog(filename)
+	if err != nil || applied != 5 {
+		t.Fatalf("replayed %d instructions (%v), want 5", applied, err)
+	}
+	expectValue(t, "a", "4", true)
+	expectValue(t, "b", "2", true)
+	expectValue(t, "c", "", false)
+	_, expiry, _ := cache.GetWithExpiry("b")
+	if until := time.Until(expiry); until <= 0 || until > time.Minute {
+		t.Fatalf("b expires in %v, want within a minute", until)
+	}
+}
+
+func TestReplayMissingFile(t *testing.T) {
+	newTestCache(t)
+	applied, err := ReplayAppendOnlyLog(filepath.Join(t.TempDir(), constants.AOF_FILE))
+	if err != nil || applied != 0 {
+		t.Fatalf("replayed %d instructions (%v) from a log that doesn't exist", applied, err)
+	}
+}
+
+func TestReplayTruncatedTail(t *testing.T) {
+	tails := []string{
+		"*",
+		"*3\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\nz",
+		"*3\r\n$3\r\nSET\r\n$1\r\nz\r\n$1\r\n9\r",
+	}
+	for _, tail := range tails {
+		t.Run(strings.ReplaceAll(tail, "\r\n", " "), func(t *testing.T) {
+			newTestCache(t)
+			filename := filepath.Join(t.TempDir(), constants.AOF_FILE)
+			writeTestLog(t, filename, "SET a 1", "SET b 2")
+			info, _ := os.Stat(filename)
+			validSize := info.Size()
+
+			// a crash in the middle of writing the next entry
+			f, _ := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+			f.WriteString(tail)
+			f.Close()
+
+			applied, err := ReplayAppendOnlyLog(filename)
+			if err != nil || applied != 2 {
+				t.Fatalf("replayed %d instructions (%v), want 2", applied, err)
+			}
+			if info, _ := os.Stat(filename); info.Size() != validSize {
+				t.Fatalf("log is %d bytes, want it truncated to %d", info.Size(), validSize)
+			}
+
+			// so what is appended next can be replayed
+			writeTestLog(t, filename, "SET c 3")
+			newTestCache(t)
+			if applied, err := ReplayAppendOnlyLog(filename); err != nil || applied != 3 {
+				t.Fatalf("replayed %d instructions (%v) after appending, want 3", applied, err)
+			}
+			expectValue(t, "c", "3", true)
+		})
+	}
+}
+
+func TestReplayBadLog(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+		err   string
+	}{
+		{"unknown command", "*2\r\n$4\r\nNOPE\r\n$1\r\na\r\n", "bad instruction"},
+		{"invalid use", "*2\r\n$3\r\nSET\r\n$1\r\na\r\n", "bad instruction"},
+		{"invalid expiry", "*5\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n$4\r\nPXAT\r\n$4\r\nsoon\r\n", "bad instruction"},
+		{"not an array", "+OK\r\n", "corrupt"},
+		{"bad length", "*2\r\n$x\r\nSET\r\n", "corrupt"},
+		{"missing CRLF", "*1\r\n$3\r\nSETxx", "corrupt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestCache(t)
+			filename := filepath.Join(t.TempDir(), constants.AOF_FILE)
+			writeTestLog(t, filename, "SET a 1")
+			f, _ := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+			f.WriteString(tt.entry + "*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n")
+			f.Close()
+			info, _ := os.Stat(filename)
+
+			applied, err := ReplayAppendOnlyLog(filename)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want one saying %q", err, tt.err)
+			}
+			if applied != 1 {
+				t.Fatalf("applied %d instructions, want only the one before the bad entry", applied)
+			}
+			// nothing after it is applied, and the log is left as it is for someone to look at
+			expectValue(t, "b", "", false)
+			if after, _ := os.Stat(filename); after.Size() != info.Size() {
+				t.Fatalf("log went from %d to %d bytes", info.Size(), after.Size())
+			}
+		})
+	}
+}
+
+func TestFsyncPolicies(t *testing.T) {
+	if _, err := OpenAppendOnlyLog(filepath.Join(t.TempDir(), constants.AOF_FILE), "sometimes"); err == nil {
+		t.Fatal("opened a log with an invalid fsync policy")
+	}
+
+	tests := []struct {
+		policy    string
+		dirty     bool // right after a write
+		syncedBy  time.Duration
+		neverSync bool
+	}{
+		{FsyncAlways, false, 0, false},
+		{FsyncEverySec, true, 3 * constants.AOF_FSYNC_INTERVAL, false},
+		{FsyncNever, true, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			log := openTestLog(t, filepath.Join(t.TempDir(), constants.AOF_FILE), tt.policy)
+			defer log.Close()
+			dirty := func() bool {
+				log.mutex.Lock()
+				defer log.mutex.Unlock()
+				return log.dirty
+			}
+
+			inst := Instruction{Command: protocol.Commands.SET, Args: []string{"a", "1"}}
+			if err := log.Append(&inst); err != nil {
+				t.Fatal(err)
+			}
+			if dirty() != tt.dirty {
+				t.Fatalf("dirty is %v right after a write, want %v", dirty(), tt.dirty)
+			}
+			if tt.syncedBy > 0 {
+				deadline := time.Now().Add(tt.syncedBy)
+				for dirty() && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				if dirty() {
+					t.Fatalf("not fsynced within %v", tt.syncedBy)
+				}
+			}
+			if tt.neverSync {
+				time.Sleep(constants.AOF_FSYNC_INTERVAL + 100*time.Millisecond)
+				if !dirty() {
+					t.Fatal("fsynced in the background with fsync policy never")
+				}
+			}
+		})
+	}
+}
+
+// waits for the rewrite (and any that follows it) to finish
+func waitRewritten(t *testing.T, log *AppendOnlyLog) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		log.mutex.Lock()
+		rewriting := log.rewriting
+		log.mutex.Unlock()
+		if !rewriting {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("append only log rewrite didn't finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func fillTestCache(prefix string, count int) {
+	for i := 0; i < count; i++ {
+		cache.Set(fmt.Sprintf("%s%d", prefix, i), fmt.Sprint(i), -1)
+	}
+}
+
+func TestRewriteKeepsWritesMadeDuringIt(t *testing.T) {
+	newTestCache(t)
+	fillTestCache("key", 100000)
+	filename := filepath.Join(t.TempDir(), constants.AOF_FILE)
+	log := openTestLog(t, filename, FsyncNever)
+	defer log.Close()
+
+	// writes keep coming while it runs, applied and then logged like the server does
+	stop := make(chan struct{})
+	var writer sync.WaitGroup
+	written, buffered := 0, 0
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		for ; ; written++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key, value := fmt.Sprintf("during%d", written%500), fmt.Sprint(written)
+			cache.Set(key, value, -1)
+			log.mutex.Lock()
+			if log.bufferWrites {
+				buffered++
+			}
+			log.mutex.Unlock()
+			inst := Instruction{Command: protocol.Commands.SET, Args: []string{key, value}}
+			if err := log.Append(&inst); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	if err := log.StartRewrite(); err != nil {
+		t.Fatal(err)
+	}
+	waitRewritten(t, log)
+	close(stop)
+	writer.Wait()
+	if buffered == 0 {
+		t.Fatal("no write came in while the rewrite was running")
+	}
+
+	// whatever the log restores is exactly what the cache had, old keys and new writes alike
+	want := map[string]string{}
+	cache.Range(func(key string, value string, expiryTime time.Time) { want[key] = value })
+	newTestCache(t)
+	if _, err := ReplayAppendOnlyLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	got := 0
+	cache.Range(func(key string, value string, expiryTime time.Time) {
+		got++
+		if want[key] != value {
+			t.Fatalf("%s replayed as %q, want %q", key, value, want[key])
+		}
+	})
+	if got != len(want) {
+		t.Fatalf("replayed %d keys, want %d", got, len(want))
+	}
+}
+
+func TestRewriteSwapsFile(t *testing.T) {
+	newTestCache(t)
+	filename := filepath.Join(t.TempDir(), constants.AOF_FILE)
+	log := openTestLog(t, filename, FsyncNever)
+	defer log.Close()
+	for i := 0; i < 100; i++ {
+		cache.Set("counter", fmt.Sprint(i), -1)
+		inst := Instruction{Command: protocol.Commands.SET, Args: []string{"counter", fmt.Sprint(i)}}
+		log.Append(&inst)
+	}
+	cache.Set("expiring", "1", 60000)
+	inst := Instruction{Command: protocol.Commands.SET, Args: []string{"expiring", "1", "PX", "60000"}}
+	log.Append(&inst)
+	before, _ := os.Stat(filename)
+
+	if err := log.StartRewrite(); err != nil {
+		t.Fatal(err)
+	}
+	waitRewritten(t, log)
+
+	after, _ := os.Stat(filename)
+	if os.SameFile(before, after) || after.Size() >= before.Size() {
+		t.Fatalf("log is still the %d byte file it was, want it replaced by a smaller one (%d bytes now)", before.Size(), after.Size())
+	}
+	if _, err := os.Stat(log.tempFilename()); !os.IsNotExist(err) {
+		t.Fatalf("temp file left behind (%v)", err)
+	}
+	log.mutex.Lock()
+	size, baseSize := log.size, log.baseSize
+	log.mutex.Unlock()
+	if size != after.Size() || baseSize != after.Size() {
+		t.Fatalf("size %d and base size %d, want both %d", size, baseSize, after.Size())
+	}
+	data, _ := os.ReadFile(filename)
+	if !strings.Contains(string(data), "\r\nPXAT\r\n") {
+		t.Fatalf("expiry lost in rewritten log:\n%q", data)
+	}
+
+	// the log was reopened, so writes go to the new file
+	inst = Instruction{Command: protocol.Commands.SET, Args: []string{"after", "1"}}
+	if err := log.Append(&inst); err != nil {
+		t.Fatal(err)
+	}
+	newTestCache(t)
+	applied, err := ReplayAppendOnlyLog(filename)
+	if err != nil || applied != 3 {
+		t.Fatalf("replayed %d instructions (%v), want 3", applied, err)
+	}
+	expectValue(t, "counter", "99", true)
+	expectValue(t, "expiring", "1", true)
+	expectValue(t, "after", "1", true)
+}
+
+func TestRewriteAgainOnceReplaced(t *testing.T) {
+	newTestCache(t)
+	fillTestCache("old", 100000)
+	filename := filepath.Join(t.TempDir(), constants.AOF_FILE)
+	log := openTestLog(t, filename, FsyncNever)
+	defer log.Close()
+
+	if err := log.StartRewrite(); err != nil {
+		t.Fatal(err)
+	}
+	// a full sync replaces the cache while that rewrite is writing out the old one
+	for frozen := false; !frozen; {
+		log.mutex.Lock()
+		frozen = log.bufferWrites
+		log.mutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	cache.Flush()
+	fillTestCache("new", 10)
+	log.RewriteReplaced()
+	log.mutex.Lock()
+	again := log.rewriteAgain
+	log.mutex.Unlock()
+	if !again {
+		t.Fatal("no rewrite queued to follow the running one")
+	}
+	waitRewritten(t, log)
+
+	newTestCache(t)
+	applied, err := ReplayAppendOnlyLog(filename)
+	if err != nil || applied != 10 {
+		t.Fatalf("replayed %d instructions (%v), want only the 10 keys of the new cache", applied, err)
+	}
+	expectValue(t, "new9", "9", true)
+	expectValue(t, "old0", "", false)
+}
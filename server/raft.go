@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cadence/constants"
+	"cadence/protocol"
+	"cadence/raft"
+	"cadence/utils"
+
+	"github.com/pkg/errors"
+)
+
+// raft node this server belongs to, nil unless it runs in raft mode. in raft mode every write goes
+// through the raft log and is only acknowledged once a majority of nodes have it.
+var raftNode *raft.Node
+
+// host:port of every other raft node, the only ones raft RPCs are taken from
+var raftPeerAddresses []string
+
+// CACHE_STATE_MACHINE ------------------------------------------------------------------------
+// applies committed writes to the cache, snapshots are the same format SAVE writes
+type cacheStateMachine struct{}
+
+func (sm cacheStateMachine) Apply(command []byte) []byte {
+	parts, err := utils.ReadBulkStringArray(bufio.NewReader(bytes.NewReader(command)))
+	if err != nil || len(parts) == 0 {
+		fmt.Println("ERROR: could not decode committed command,", err)
+		return utils.ErrorSerialize(utils.ErrorCodes.ERR, "could not decode command.")
+	}
+	inst := NewInstruction(parts)
+	commandInfo, exists := cmdMap[strings.ToUpper(inst.Command)]
+	if !exists || !commandInfo.Validate(inst.Args) {
+		return utils.ErrorSerialize(utils.ErrorCodes.ERR, "Invalid use of command.")
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	return commandInfo.Execute(inst.Args, nil)
+}
+
+func (sm cacheStateMachine) Snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := cache.WriteSnapshot(&buf, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (sm cacheStateMachine) Restore(snapshot []byte) error {
+	cache.Flush()
+	_, err := cache.ReadSnapshot(bytes.NewReader(snapshot))
+	return err
+}
+
+// WRITE_PATH ---------------------------------------------------------------------------------
+// proposes a write to the raft log and waits for it to be committed and applied
+func proposeWrite(inst *Instruction) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), constants.RAFT_PROPOSE_TIMEOUT)
+	defer cancel()
+
+	proposal := absoluteExpiry(*inst)
+	response, err := raftNode.Propose(ctx, proposal.Serialize())
+	var notLeader *raft.NotLeaderError
+	switch {
+	case err == nil:
+		return response
+	case errors.As(err, &notLeader):
+		return utils.ErrorSerialize(utils.ErrorCodes.NOTLEADER, notLeader.Leader)
+	case errors.Is(err, context.DeadlineExceeded):
+		return utils.ErrorSerialize(utils.ErrorCodes.ERR, "timed out waiting for the write to be committed.")
+	default:
+		return utils.ErrorSerialize(utils.ErrorCodes.ERR, err.Error())
+	}
+}
+
+// SET ... PX millis becomes SET ... PXAT unix-millis, so the key expires at the same moment on every
+// node (and when the log is replayed after a restart) rather than relative to when each applied it
+func absoluteExpiry(inst Instruction) Instruction {
+	n := len(inst.Args)
+	if strings.ToUpper(inst.Command) != protocol.Commands.SET || n < 4 || strings.ToUpper(inst.Args[n-2]) != "PX" {
+		return inst
+	}
+	duration, err := strconv.Atoi(inst.Args[n-1])
+	if err != nil {
+		return inst
+	}
+	expiry := time.Now().Add(time.Duration(duration) * time.Millisecond).UnixMilli()
+	inst.Args = append(append([]string{}, inst.Args[:n-2]...), "PXAT", strconv.FormatInt(expiry, 10))
+	return inst
+}
+
+// RAFT_TRANSPORT -----------------------------------------------------------------------------
+// sends raft RPCs to the other nodes as RAFTVOTE / RAFTAPPEND / RAFTSNAPSHOT commands with a JSON payload,
+// over one connection per peer (RPCs to the same peer take turns)
+type RaftTransport struct {
+	peers map[string]*raftPeer
+	mutex sync.Mutex
+}
+
+type raftPeer struct {
+	address   string
+	conn      net.Conn
+	responses chan protocol.Response
+	mutex     sync.Mutex
+}
+
+func NewRaftTransport() *RaftTransport {
+	return &RaftTransport{peers: map[string]*raftPeer{}}
+}
+
+// private methods -------------
+func (t *RaftTransport) peer(address string) *raftPeer {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, exists := t.peers[address]; !exists {
+		t.peers[address] = &raftPeer{address: address}
+	}
+	return t.peers[address]
+}
+
+func (t *RaftTransport) call(address string, command string, args any, reply any, timeout time.Duration) error {
+	payload, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	peer := t.peer(address)
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	if peer.conn == nil {
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			return err
+		}
+		peer.conn, peer.responses = conn, utils.ReadRepliesFromConn(conn, protocol.NewResponse)
+	}
+	// any failure leaves the connection in an unknown state, so start over with a new one next time
+	fail := func(err error) error {
+		peer.conn.Close()
+		peer.conn, peer.responses = nil, nil
+		return err
+	}
+
+	peer.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := peer.conn.Write(utils.BulkStringArraySerialize([]string{command, string(payload)})); err != nil {
+		return fail(err)
+	}
+	select {
+	case response, ok := <-peer.responses:
+		if !ok {
+			return fail(errors.Errorf("%s closed the connection", address))
+		}
+		if response.Err != nil {
+			return response.Err
+		}
+		return json.Unmarshal([]byte(response.String()), reply)
+	case <-time.After(timeout):
+		return fail(errors.Errorf("timed out waiting for %s", address))
+	}
+}
+
+// public methods -------------
+func (t *RaftTransport) RequestVote(peer string, args raft.RequestVoteArgs) (raft.RequestVoteReply, error) {
+	var reply raft.RequestVoteReply
+	err := t.call(peer, protocol.Commands.RAFT_VOTE, args, &reply, constants.RAFT_RPC_TIMEOUT)
+	return reply, err
+}
+
+func (t *RaftTransport) AppendEntries(peer string, args raft.AppendEntriesArgs) (raft.AppendEntriesReply, error) {
+	var reply raft.AppendEntriesReply
+	err := t.call(peer, protocol.Commands.RAFT_APPEND, args, &reply, constants.RAFT_RPC_TIMEOUT)
+	return reply, err
+}
+
+func (t *RaftTransport) InstallSnapshot(peer string, args raft.InstallSnapshotArgs) (raft.InstallSnapshotReply, error) {
+	var reply raft.InstallSnapshotReply
+	err := t.call(peer, protocol.Commands.RAFT_INSTALL, args, &reply, constants.REPL_TIMEOUT) // snapshots can be big
+	return reply, err
+}
+
+// whether conn comes from the host of one of raftPeerAddresses. RPCs are sent from whatever port the peer's
+// dialer picked, so only the host can be checked.
+func fromRaftPeer(conn net.Conn) bool {
+	if conn == nil {
+		return false
+	}
+	remote, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	remoteIP := net.ParseIP(remote)
+	for _, peer := range raftPeerAddresses {
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(remoteIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handles a raft RPC sent by another node over conn, replying with handle's reply as JSON. anyone else
+// could otherwise overwrite the log (or the whole cache, with a snapshot) by claiming a newer term.
+func handleRaftRPC[Args any, Reply any](conn net.Conn, payload string, handle func(Args) Reply) []byte {
+	if raftNode == nil {
+		return utils.ErrorSerialize(utils.ErrorCodes.ERR, "this node is not running in raft mode.")
+	}
+	if !fromRaftPeer(conn) {
+		return utils.ErrorSerialize(utils.ErrorCodes.ERR, "raft RPCs are only accepted from --raft-peers.")
+	}
+	var args Args
+	if err := json.Unmarshal([]byte(payload), &args); err != nil {
+		return utils.ErrorSerialize(utils.ErrorCodes.ERR, "malformed raft request.")
+	}
+	reply, _ := json.Marshal(handle(args))
+	return utils.BulkStringSerialize(string(reply))
+}
+
+// raft section of INFO
+func raftInfo() []string {
+	status := raftNode.Status()
+	return []string{
+		"raft_id:" + status.ID,
+		"raft_role:" + status.Role.String(),
+		"raft_term:" + strconv.Itoa(status.Term),
+		"raft_leader:" + status.Leader,
+		"raft_commit_index:" + strconv.Itoa(status.CommitIndex),
+		"raft_last_applied:" + strconv.Itoa(status.LastApplied),
+		"raft_last_index:" + strconv.Itoa(status.LastIndex),
+	}
+}
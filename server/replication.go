@@ -0,0 +1,813 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cadence/constants"
+	"cadence/protocol"
+	"cadence/utils"
+
+	"github.com/pkg/errors"
+)
+
+// REPLICA ------------------------------------------------------------------------------------
+// the replication stream is queued for each replica and written by its own goroutine, so a slow replica
+// never holds up writes. everything but host, port and connection is guarded by replicationMutex.
+type Replica struct {
+	host       string
+	port       string // the port it listens on, if it announced it, otherwise the port it connected from
+	connection net.Conn
+	syncing    bool   // still being sent its full sync, the stream queues up until it is done
+	outbox     []byte // stream not yet written to it, at most REPL_OUTPUT_LIMIT bytes
+	ready      *sync.Cond
+	closed     bool
+	ackOffset  int // replication offset it last acknowledged having applied
+	ackTime    time.Time
+}
+
+func NewReplica(host string, port string, conn net.Conn) *Replica {
+	return &Replica{
+		host:       host,
+		port:       port,
+		connection: conn,
+		ready:      sync.NewCond(&replicationMutex),
+		ackTime:    time.Now(),
+	}
+}
+
+// private methods -------------
+// queues data to be written, disconnecting the replica if it has fallen too far behind.
+// never blocks, must hold replicationMutex.
+func (replica *Replica) send(data []byte) {
+	if replica.closed {
+		return
+	}
+	if len(replica.outbox)+len(data) > constants.REPL_OUTPUT_LIMIT {
+		fmt.Printf("ERROR: replica %s:%s is too far behind (over %d bytes queued), disconnecting it\n",
+			replica.host, replica.port, constants.REPL_OUTPUT_LIMIT)
+		replica.disconnect()
+		return
+	}
+	replica.outbox = append(replica.outbox, data...)
+	replica.ready.Signal()
+}
+
+// writes whatever is queued until the replica is disconnected. must not hold replicationMutex.
+func (replica *Replica) writeQueued() {
+	for {
+		replicationMutex.Lock()
+		for len(replica.outbox) == 0 && !replica.closed {
+			replica.ready.Wait()
+		}
+		if replica.closed {
+			replicationMutex.Unlock()
+			return
+		}
+		data := replica.outbox
+		replica.outbox = nil
+		replicationMutex.Unlock()
+
+		replica.connection.SetWriteDeadline(time.Now().Add(constants.REPL_TIMEOUT))
+		if _, err := replica.connection.Write(data); err != nil {
+			fmt.Printf("ERROR: could not write to replica %s:%s, disconnecting it: %v\n", replica.host, replica.port, err)
+			replicationMutex.Lock()
+			replica.disconnect()
+			replicationMutex.Unlock()
+			return
+		}
+	}
+}
+
+// starts writing the queued stream, once whatever has to come before it has been sent. must hold replicationMutex.
+func (replica *Replica) goOnline() {
+	replica.syncing = false
+	go replica.writeQueued()
+}
+
+// closes the connection and forgets the replica, must hold replicationMutex
+func (replica *Replica) disconnect() {
+	if replica.closed {
+		return
+	}
+	replica.closed = true
+	replica.outbox = nil
+	replica.connection.Close()
+	replicas = deleteReplica(replicas, replica)
+	replica.ready.Broadcast()
+	ackCond.Broadcast() // waiters counting it should recount
+}
+
+var replicas = []*Replica{}
+
+// listening ports replicas announced with REPLCONF before asking to sync
+var announcedPorts = map[net.Conn]string{}
+
+// signalled whenever a replica acknowledges an offset, uses replicationMutex
+var ackCond = sync.NewCond(&replicationMutex)
+
+// the most recent part of the replication stream, for partial resyncs
+var backlog = NewReplicationBacklog(constants.REPL_BACKLOG_SIZE)
+
+// guards replicas, backlog, masterLink and the replication id and offset in ServerInfo
+var replicationMutex sync.Mutex
+
+// connection to the master, nil unless this is a replica with its link up
+var masterLink net.Conn
+
+// the link a replica keeps to its master, nil on a master
+var link *ReplicationLink
+
+// held for the whole of a role change, so two REPLICAOFs can't interleave
+var roleMutex sync.Mutex
+
+// health of the link to the master, shown in INFO
+var linkStatus = struct {
+	lastInteraction time.Time // last time anything was received from the master
+	downSince       time.Time
+}{downSince: time.Now()}
+
+// random 40 character id naming a replication stream, offsets only mean something within one
+func newReplicationID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func isReplica() bool {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	return ServerInfo.IsReplica
+}
+
+func isMasterLink(conn net.Conn) bool {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	return conn != nil && conn == masterLink
+}
+
+// adds bytes to the replication stream: counts them towards the offset, keeps them in the backlog
+// and queues them for replicas (replicas still receiving their full sync get them right after).
+// must hold replicationMutex.
+func feedReplicationStream(data []byte) {
+	ServerInfo.CurrentOffset += len(data)
+	backlog.Write(data)
+
+	// disconnecting a replica removes it from replicas, so go over a copy
+	for i, replica := range slices.Clone(replicas) {
+		fmt.Println("Propagating to replica #", i)
+		replica.send(data)
+	}
+}
+
+// sends a write to every replica. a relative TTL would start over when each replica applies it (and
+// again whenever the backlog is replayed to one), so they are sent when the key expires instead.
+func propagate(inst *Instruction) {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	propagated := absoluteExpiry(*inst)
+	feedReplicationStream(propagated.Serialize())
+}
+
+// keys the cache expired or evicted that haven't been logged and propagated yet
+var (
+	pendingEvictions []string
+	evictionFlushing bool // a goroutine is waiting to flush them
+	evictionMutex    sync.Mutex
+)
+
+// called by the cache whenever it expires or evicts a key. on a master these are logged and propagated
+// as explicit DELETEs, so the log and replicas (whose caches are passive) lose exactly the same keys.
+// that can happen in the middle of a write (or a read, which doesn't hold writeMutex at all), so they are
+// only queued here, and written out in between writes by flushEvictions.
+func propagateEviction(key string) {
+	evictionMutex.Lock()
+	defer evictionMutex.Unlock()
+	pendingEvictions = append(pendingEvictions, key)
+	if !evictionFlushing {
+		evictionFlushing = true
+		go func() {
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			flushEvictions()
+		}()
+	}
+}
+
+// logs and propagates the DELETEs for the keys evicted so far. must hold writeMutex, and be done with
+// logging and propagating the current write, if any.
+func flushEvictions() {
+	evictionMutex.Lock()
+	keys := pendingEvictions
+	pendingEvictions, evictionFlushing = nil, false
+	evictionMutex.Unlock()
+
+	for _, key := range keys {
+		// a write that set it again since has already been logged after it, so this DELETE would come too late
+		if _, exists := cache.Peek(key); exists {
+			continue
+		}
+		inst := Instruction{Command: protocol.Commands.DELETE, Args: []string{key}}
+		if aof != nil {
+			if err := aof.Append(&inst); err != nil {
+				fmt.Println("ERROR: failed to write to append only log:", err)
+			}
+		}
+		replicationMutex.Lock()
+		if !ServerInfo.IsReplica {
+			feedReplicationStream(inst.Serialize())
+		}
+		replicationMutex.Unlock()
+	}
+}
+
+// MASTER SIDE --------------------------------------------------------------------------------
+// handles a replica asking to sync, optionally with the replication id and offset it already has.
+// if that offset is still in the backlog it is just sent what it missed, otherwise it gets a full sync.
+func syncReplica(conn net.Conn, args []string) error {
+	host, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return errors.Wrap(err, "could not read replica address")
+	}
+	replicationMutex.Lock()
+	if announced, ok := announcedPorts[conn]; ok {
+		port = announced
+		delete(announcedPorts, conn)
+	}
+	replicationMutex.Unlock()
+	replica := NewReplica(host, port, conn)
+
+	if len(args) == 2 {
+		offset, _ := strconv.Atoi(args[1])
+		continued, err := partialSyncReplica(replica, args[0], offset)
+		if continued || err != nil {
+			return err
+		}
+	}
+	return fullSyncReplica(replica)
+}
+
+func partialSyncReplica(replica *Replica, replicationID string, offset int) (bool, error) {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+
+	if replicationID != ServerInfo.ReplicationID {
+		return false, nil
+	}
+	missed, ok := backlog.ReadFrom(offset)
+	if !ok {
+		return false, nil
+	}
+
+	fmt.Printf("Partially resyncing replica from offset %d (%d bytes).\n", offset, len(missed))
+	reply := utils.BulkStringArraySerialize([]string{protocol.Commands.PARTIAL_SYNC, ServerInfo.ReplicationID})
+	replicas = append(replicas, replica)
+	replica.send(append(reply, missed...))
+	replica.goOnline()
+	return true, nil
+}
+
+// sends the replica a point in time snapshot of the cache, then every write made after that point.
+// the replica is registered at the exact moment the snapshot is taken, so it neither misses nor
+// double applies anything, and is told the replication offset of that moment.
+func fullSyncReplica(replica *Replica) error {
+	replica.syncing = true
+	var replicationID string
+	var offset int
+	register := func() {
+		replicationMutex.Lock()
+		defer replicationMutex.Unlock()
+		replicas = append(replicas, replica)
+		replicationID, offset = ServerInfo.ReplicationID, ServerInfo.CurrentOffset
+	}
+	var payload bytes.Buffer
+	if _, err := cache.WriteSnapshot(&payload, register); err != nil {
+		removeReplica(replica)
+		return errors.Wrap(err, "could not snapshot cache")
+	}
+
+	// the snapshot goes out first (without holding up writes), then everything queued since
+	reply := utils.BulkStringArraySerialize([]string{protocol.Commands.FULL_SYNC, payload.String(), replicationID, strconv.Itoa(offset)})
+	if _, err := replica.connection.Write(reply); err != nil {
+		removeReplica(replica)
+		return errors.Wrap(err, "could not send full sync")
+	}
+
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	if replica.closed {
+		return errors.New("replica fell too far behind during full sync")
+	}
+	replica.goOnline()
+	return nil
+}
+
+// ACKNOWLEDGEMENTS ---------------------------------------------------------------------------
+// REPLCONF listening-port, sent by a replica before it asks to sync
+func announceReplicaPort(conn net.Conn, port string) {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	announcedPorts[conn] = port
+}
+
+// REPLCONF ACK, sent by a replica every REPL_ACK_INTERVAL and whenever it is asked to
+func acknowledgeOffset(conn net.Conn, offset int) {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+
+	for _, replica := range replicas {
+		if replica.connection == conn {
+			replica.ackOffset = max(replica.ackOffset, offset)
+			replica.ackTime = time.Now()
+			ackCond.Broadcast()
+			return
+		}
+	}
+}
+
+// replica side of REPLCONF ACK, sent on the link to the master
+func sendAcknowledgement(conn net.Conn) error {
+	replicationMutex.Lock()
+	offset := ServerInfo.CurrentOffset
+	replicationMutex.Unlock()
+
+	ack := []string{protocol.Commands.REPLICA_CONF, "ACK", strconv.Itoa(offset)}
+	_, err := conn.Write(utils.BulkStringArraySerialize(ack))
+	return err
+}
+
+// blocks until at least numReplicas replicas have acknowledged every write made before it was called,
+// or the timeout passes (zero means no timeout). returns how many replicas had acknowledged them.
+func waitForReplicas(numReplicas int, timeout time.Duration) int {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+
+	target := ServerInfo.CurrentOffset
+	if acked := countAcknowledged(target); acked >= numReplicas {
+		return acked
+	}
+
+	// ask for acknowledgements now rather than waiting for the next periodic ones
+	getAck := Instruction{Command: protocol.Commands.REPLICA_CONF, Args: []string{"GETACK", "*"}}
+	feedReplicationStream(getAck.Serialize())
+
+	timedOut := false
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			replicationMutex.Lock()
+			defer replicationMutex.Unlock()
+			timedOut = true
+			ackCond.Broadcast()
+		})
+		defer timer.Stop()
+	}
+	for {
+		acked := countAcknowledged(target)
+		if acked >= numReplicas || timedOut {
+			return acked
+		}
+		ackCond.Wait()
+	}
+}
+
+// must hold replicationMutex
+func countAcknowledged(offset int) int {
+	acked := 0
+	for _, replica := range replicas {
+		if !replica.syncing && replica.ackOffset >= offset {
+			acked++
+		}
+	}
+	return acked
+}
+
+func removeReplica(replica *Replica) {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	replica.disconnect()
+}
+
+// forgets everything about a connection once it is closed, in case it was a replica's
+func forgetConnection(conn net.Conn) {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+
+	delete(announcedPorts, conn)
+	for _, replica := range replicas {
+		if replica.connection == conn {
+			fmt.Printf("Replica %s:%s disconnected.\n", replica.host, replica.port)
+			replica.disconnect()
+			return
+		}
+	}
+}
+
+func deleteReplica(list []*Replica, replica *Replica) []*Replica {
+	for i, r := range list {
+		if r == replica {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// REPLICA SIDE -------------------------------------------------------------------------------
+// throws away whatever this node had and loads the master's snapshot instead, picking up its
+// replication stream from the offset the snapshot was taken at
+func loadFullSync(payload string, replicationID string, offset int) error {
+	cache.Flush()
+	loaded, err := cache.ReadSnapshot(strings.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "could not load master snapshot")
+	}
+	fmt.Printf("Loaded %d keys from master.\n", loaded)
+	// the log still holds the keys that were thrown away
+	if aof != nil {
+		aof.RewriteReplaced()
+	}
+
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	ServerInfo.ReplicationID = replicationID
+	ServerInfo.CurrentOffset = offset
+	backlog.Reset(offset)
+	return nil
+}
+
+// the master is going to send just the part of its stream this node missed
+func continueSync(replicationID string) {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	ServerInfo.ReplicationID = replicationID
+	fmt.Println("Continuing replication from offset", ServerInfo.CurrentOffset)
+}
+
+// REPLICATION_LINK ---------------------------------------------------------------------------
+// a replica's link to its master. it is kept up (handshake, resync, reconnect when it drops) until
+// stopped, which happens when the node is pointed at another master or promoted.
+type ReplicationLink struct {
+	masterAddress string
+	conn          net.Conn // connection currently handshaking or streaming, guarded by replicationMutex
+	stopping      bool     // guarded by replicationMutex
+	stop          chan struct{}
+	done          chan struct{} // closed once the link has fully shut down
+}
+
+// starts linking up to the master at masterAddress in the background
+func NewReplicationLink(masterAddress string) *ReplicationLink {
+	link := &ReplicationLink{
+		masterAddress: masterAddress,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go link.supervise()
+	return link
+}
+
+// private methods -------------
+// keeps this replica linked to its master until stopped - whenever the link drops (or never comes up)
+// it retries with exponential backoff, and resyncs once reconnected
+func (link *ReplicationLink) supervise() {
+	defer close(link.done)
+	backoff := constants.REPL_MIN_BACKOFF
+	for {
+		conn, instChannel, err := link.handshake()
+		if link.stopped() {
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			fmt.Printf("ERROR: master handshake failed, retrying in %v: %v\n", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-link.stop:
+				return
+			}
+			backoff = min(backoff*2, constants.REPL_MAX_BACKOFF)
+			continue
+		}
+		backoff = constants.REPL_MIN_BACKOFF
+
+		setMasterLink(conn)
+		handleMasterConnection(conn, instChannel)
+		setMasterLink(nil)
+		if link.stopped() {
+			return
+		}
+		fmt.Println("Lost connection to master, reconnecting...")
+	}
+}
+
+// remembers conn so Stop can close it, false if the link is already stopping
+func (link *ReplicationLink) track(conn net.Conn) bool {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	if link.stopping {
+		return false
+	}
+	link.conn = conn
+	return true
+}
+
+func (link *ReplicationLink) stopped() bool {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	return link.stopping
+}
+
+// expects a "RESPONSE" once and then an "INSTRUCTION"
+func (link *ReplicationLink) handshake() (net.Conn, chan Instruction, error) {
+	fmt.Println("Commencing handshake with master, at remote address: ", link.masterAddress)
+
+	// first, create tcp connection with master and start accepting reads from it
+	conn, err := net.DialTimeout("tcp", link.masterAddress, constants.REPL_TIMEOUT)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error connecting to master")
+	}
+	if !link.track(conn) {
+		conn.Close()
+		return nil, nil, errors.New("link was stopped")
+	}
+	instChannel := utils.ReadFromConn(conn, NewInstruction)
+	fail := func(err error) (net.Conn, chan Instruction, error) {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	// send PING and check if PONG received
+	err = utils.WriteToConn(conn, protocol.Commands.STATUS)
+	if err != nil {
+		return fail(err)
+	}
+	response, err := awaitMasterResponse(instChannel)
+	if err != nil {
+		return fail(err)
+	}
+	if response.Command != protocol.Responses.ALL_GOOD {
+		return fail(errors.New("ERROR: master did not respond with a PONG"))
+	}
+
+	// second, tell the master which port we listen on, so it can tell others where to find us
+	replconf := []string{protocol.Commands.REPLICA_CONF, "listening-port", ServerInfo.Port}
+	if _, err = conn.Write(utils.BulkStringArraySerialize(replconf)); err != nil {
+		return fail(err)
+	}
+	response, err = awaitMasterResponse(instChannel)
+	if err != nil {
+		return fail(err)
+	}
+	if response.Command != protocol.Responses.OKAY {
+		return fail(errors.New("ERROR: master did not accept REPLCONF listening-port"))
+	}
+
+	// third, send the REPL_SYNC command to master (with where we got up to, if we were synced before)
+	// and check if a partial or full sync is received
+	syncCmd := []string{protocol.Commands.REPLICA_SYNC}
+	replicationMutex.Lock()
+	if ServerInfo.ReplicationID != "" {
+		syncCmd = append(syncCmd, ServerInfo.ReplicationID, strconv.Itoa(ServerInfo.CurrentOffset))
+	}
+	replicationMutex.Unlock()
+	if _, err = conn.Write(utils.BulkStringArraySerialize(syncCmd)); err != nil {
+		return fail(err)
+	}
+	response, err = awaitMasterResponse(instChannel)
+	if err != nil {
+		return fail(err)
+	}
+	switch {
+	case response.Command == protocol.Commands.PARTIAL_SYNC && len(response.Args) == 1:
+		continueSync(response.Args[0])
+	case response.Command == protocol.Commands.FULL_SYNC && len(response.Args) == 3:
+		// load the master's data before applying anything it propagates after it
+		offset, err := strconv.Atoi(response.Args[2])
+		if err != nil {
+			return fail(errors.New("ERROR: master sent a FULLSYNC with an invalid offset"))
+		}
+		if err := loadFullSync(response.Args[0], response.Args[1], offset); err != nil {
+			return fail(err)
+		}
+	default:
+		return fail(errors.New("ERROR: master did not respond with a FULLSYNC or CONTINUE"))
+	}
+
+	// last, hand back the connection so the rest of the stream can be applied
+	return conn, instChannel, nil
+}
+
+// public methods -------------
+// closes the connection to the master and waits until nothing more from it will be applied.
+// must not hold writeMutex or replicationMutex, the stream may need them to wind down.
+func (link *ReplicationLink) Stop() {
+	replicationMutex.Lock()
+	link.stopping = true
+	if link.conn != nil {
+		link.conn.Close()
+	}
+	replicationMutex.Unlock()
+
+	close(link.stop)
+	<-link.done
+}
+
+func awaitMasterResponse(instChannel chan Instruction) (Instruction, error) {
+	select {
+	case response, ok := <-instChannel:
+		if !ok {
+			return Instruction{}, errors.New("master closed the connection")
+		}
+		return response, nil
+	case <-time.After(constants.REPL_TIMEOUT):
+		return Instruction{}, errors.New("timed out waiting for master")
+	}
+}
+
+// must be called with nil once the link is down
+func setMasterLink(conn net.Conn) {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+
+	masterLink = conn
+	if conn != nil {
+		linkStatus.lastInteraction = time.Now()
+	} else {
+		linkStatus.downSince = time.Now()
+	}
+}
+
+// applies the master's replication stream, counting every byte of it towards this node's offset.
+// the stream is also kept in the backlog and passed on to this node's own replicas, as is.
+func handleMasterConnection(conn net.Conn, instChannel chan Instruction) {
+	defer conn.Close()
+	fmt.Println("Master connected:", conn.RemoteAddr())
+
+	// acknowledge our offset regularly, and drop the link if the master goes quiet for too long
+	done := make(chan struct{})
+	defer close(done)
+	go watchMasterLink(conn, done)
+
+	for inst := range instChannel {
+		inst.Run(conn)
+
+		replicationMutex.Lock()
+		feedReplicationStream(inst.Serialize())
+		linkStatus.lastInteraction = time.Now()
+		replicationMutex.Unlock()
+	}
+}
+
+// every REPL_ACK_INTERVAL, tells the master how far we got and checks it hasn't gone quiet
+// (it pings at least every REPL_PING_INTERVAL)
+func watchMasterLink(conn net.Conn, done chan struct{}) {
+	t := time.NewTicker(constants.REPL_ACK_INTERVAL)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := sendAcknowledgement(conn); err != nil {
+				fmt.Println("ERROR: could not acknowledge offset to master,", err)
+			}
+
+			replicationMutex.Lock()
+			quietFor := time.Since(linkStatus.lastInteraction)
+			replicationMutex.Unlock()
+			if quietFor > constants.REPL_TIMEOUT {
+				fmt.Printf("ERROR: nothing heard from master in %v, dropping link\n", quietFor.Round(time.Second))
+				conn.Close() // ends the stream, so handleMasterConnection returns
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// ROLE CHANGES -------------------------------------------------------------------------------
+// REPLICAOF host port - drops whatever this node had and follows the master at address instead, with a full sync
+func followMaster(address string) {
+	roleMutex.Lock()
+	defer roleMutex.Unlock()
+
+	replicationMutex.Lock()
+	oldLink := link
+	if oldLink != nil && oldLink.masterAddress == address {
+		replicationMutex.Unlock()
+		return
+	}
+	link = nil
+	replicationMutex.Unlock()
+	if oldLink != nil {
+		oldLink.Stop()
+	}
+
+	// no write is half applied while the role changes
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	cache.SetPassive(true)
+
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	ServerInfo.IsReplica = true
+	ServerInfo.MasterAddress = address
+	// forget the old stream, so the new master sends a full sync
+	ServerInfo.ReplicationID = ""
+
+	// our own replicas are on a stream that just ended, they reconnect and resync from scratch
+	for _, replica := range slices.Clone(replicas) {
+		replica.disconnect()
+	}
+
+	link = NewReplicationLink(address)
+	fmt.Println("Now replicating from master at", address)
+}
+
+// REPLICAOF NO ONE - stops following the master and starts taking writes. the data and offset it got up to
+// are kept, but it starts a new stream (its history diverges from the old master's from here on).
+func promoteToMaster() {
+	roleMutex.Lock()
+	defer roleMutex.Unlock()
+
+	replicationMutex.Lock()
+	oldLink := link
+	link = nil
+	replicationMutex.Unlock()
+	if oldLink == nil {
+		return
+	}
+	oldLink.Stop()
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	cache.SetPassive(false)
+
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+	ServerInfo.IsReplica = false
+	ServerInfo.MasterAddress = ""
+	ServerInfo.ReplicationID = newReplicationID()
+	fmt.Println("Promoted to master, at offset", ServerInfo.CurrentOffset)
+}
+
+// pings replicas every REPL_PING_INTERVAL as part of the replication stream, so they can tell a
+// quiet master from a dead link. replicas just pass their master's pings on to their own replicas.
+func startReplicationHeartbeat() {
+	t := time.NewTicker(constants.REPL_PING_INTERVAL)
+	defer t.Stop()
+	for range t.C {
+		replicationMutex.Lock()
+		if !ServerInfo.IsReplica && len(replicas) > 0 {
+			ping := Instruction{Command: protocol.Commands.STATUS}
+			feedReplicationStream(ping.Serialize())
+		}
+		replicationMutex.Unlock()
+	}
+}
+
+// replication section of INFO
+func replicationInfo() []string {
+	replicationMutex.Lock()
+	defer replicationMutex.Unlock()
+
+	info := []string{}
+	if ServerInfo.IsReplica {
+		host, port, _ := net.SplitHostPort(ServerInfo.MasterAddress)
+		info = append(info, "role:slave", "master_host:"+host, "master_port:"+port)
+		if masterLink != nil {
+			info = append(info, "master_link_status:up")
+		} else {
+			info = append(info, "master_link_status:down",
+				"master_link_down_since_seconds:"+strconv.Itoa(int(time.Since(linkStatus.downSince).Seconds())))
+		}
+		lastIO := -1
+		if !linkStatus.lastInteraction.IsZero() {
+			lastIO = int(time.Since(linkStatus.lastInteraction).Seconds())
+		}
+		info = append(info, "master_last_io_seconds_ago:"+strconv.Itoa(lastIO))
+	} else {
+		info = append(info, "role:master")
+	}
+	info = append(info, "connected_slaves:"+strconv.Itoa(len(replicas)))
+	for i, replica := range replicas {
+		state := "online"
+		if replica.syncing {
+			state = "wait_bgsave"
+		}
+		info = append(info, fmt.Sprintf("slave%d:ip=%s,port=%s,state=%s,offset=%d,lag=%d",
+			i, replica.host, replica.port, state, replica.ackOffset, int(time.Since(replica.ackTime).Seconds())))
+	}
+	return append(info,
+		"master_replid:"+ServerInfo.ReplicationID,
+		"master_repl_offset:"+strconv.Itoa(ServerInfo.CurrentOffset),
+		"repl_backlog_size:"+strconv.Itoa(constants.REPL_BACKLOG_SIZE),
+	)
+}
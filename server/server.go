@@ -5,13 +5,14 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"time"
 
+	"cadence/cluster"
 	"cadence/constants"
 	"cadence/lru"
+	"cadence/raft"
 	"cadence/utils"
-
-	"github.com/pkg/errors"
 )
 
 var ServerInfo = ServerBasicInfo{}
@@ -22,16 +23,118 @@ func main() {
 	// get and parse flag for which port it is
 	port := flag.String("port", constants.DefaultPort, "the port at which to run the db")
 	replicaOf := flag.String("replicaof", "", "the host and port of master node that this is a replica of in the format host:port")
+	appendOnly := flag.Bool("appendonly", false, "log every write to an append only file and replay it on startup")
+	appendFsync := flag.String("appendfsync", FsyncEverySec, "how often to fsync the append only file: always, everysec or never")
+	replicaReadOnly := flag.String("replica-read-only", "yes", "whether a replica rejects writes from clients (yes or no)")
+	raftAddress := flag.String("raft-address", "", "run in raft mode, as the node the other raft nodes reach at this host:port")
+	raftPeers := flag.String("raft-peers", "", "comma separated host:port of every other node in raft mode")
+	clusterAddr := flag.String("cluster-address", "", "run in cluster mode, as the node clients and other nodes reach at this host:port")
 	flag.Parse()
 
 	// TODO: do some validation of the flags
+	if *replicaReadOnly != "yes" && *replicaReadOnly != "no" {
+		fmt.Println("ERROR: --replica-read-only must be yes or no")
+		os.Exit(1)
+	}
+	// raft mode keeps its own log, and has no masters or replicas
+	if *raftAddress != "" && (*replicaOf != "" || *appendOnly) {
+		fmt.Println("ERROR: --raft-address cannot be used with --replicaof or --appendonly")
+		os.Exit(1)
+	}
+	if *raftAddress != "" && *clusterAddr != "" {
+		fmt.Println("ERROR: --raft-address cannot be used with --cluster-address")
+		os.Exit(1)
+	}
 
 	// set basic server info
 	ServerInfo = ServerBasicInfo{
-		IsReplica:     *replicaOf != "",
-		MasterAddress: *replicaOf,
-		Port:          *port,
-		CurrentOffset: 0,
+		IsReplica:       *replicaOf != "",
+		MasterAddress:   *replicaOf,
+		Port:            *port,
+		CurrentOffset:   0,
+		ReplicaReadOnly: *replicaReadOnly == "yes",
+	}
+	if !ServerInfo.IsReplica {
+		ServerInfo.ReplicationID = newReplicationID()
+	}
+
+	// in cluster mode, slots start out unassigned until CLUSTER ADDSLOTS hands them out (or
+	// nodes.conf says who had them before a restart), and the nodes gossip them to each other
+	if *clusterAddr != "" {
+		clusterAddress = *clusterAddr
+		slots = cluster.NewSlotMap()
+		bus, err := cluster.NewBus(clusterAddress, slots, constants.CLUSTER_CONFIG_FILE)
+		if err != nil {
+			fmt.Println("ERROR: failed to start cluster bus,", err)
+			os.Exit(1)
+		}
+		clusterBus = bus
+	}
+
+	// instantiate cache
+	cache = lru.NewShardedLRU(constants.CAPACITY_PER_SHARD, constants.SHARD_COUNT)
+	cache.OnEvict(propagateEviction)
+	if slots != nil {
+		cache.OnKeys(indexSlotKey)
+	}
+	defer cache.Cleanup()
+
+	// replicas leave expiring and evicting keys to their master, which sends them the DELETEs
+	cache.SetPassive(ServerInfo.IsReplica)
+
+	// restore the keyspace before accepting any connections - in raft mode it comes from the raft
+	// snapshot and log, otherwise the append only log is more up to date than the last snapshot, so if there is one it wins
+	restoredFromLog := false
+	if *raftAddress != "" {
+		peers := []string{}
+		for _, peer := range strings.Split(*raftPeers, ",") {
+			if peer = strings.TrimSpace(peer); peer != "" {
+				peers = append(peers, peer)
+			}
+		}
+		raftPeerAddresses = peers
+		persister := raft.NewFilePersister(constants.RAFT_STATE_FILE, constants.RAFT_SNAPSHOT_FILE)
+		node, err := raft.NewNode(*raftAddress, peers, NewRaftTransport(), cacheStateMachine{}, persister, raft.DefaultConfig())
+		if err != nil {
+			fmt.Println("ERROR: failed to start raft node,", err)
+			os.Exit(1)
+		}
+		raftNode = node
+		restoredFromLog = true
+	}
+	if *appendOnly {
+		if _, err := os.Stat(constants.AOF_FILE); err == nil {
+			applied, err := ReplayAppendOnlyLog(constants.AOF_FILE)
+			if err != nil {
+				fmt.Println("ERROR: failed to replay append only log,", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Replayed %d instructions from append only log.\n", applied)
+			restoredFromLog = true
+		}
+
+		var err error
+		aof, err = OpenAppendOnlyLog(constants.AOF_FILE, *appendFsync)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			os.Exit(1)
+		}
+		defer aof.Close()
+	}
+	if !restoredFromLog {
+		loaded, err := cache.LoadSnapshot(constants.SNAPSHOT_FILE)
+		if err != nil {
+			fmt.Println("ERROR: failed to load snapshot,", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Loaded %d keys from snapshot.\n", loaded)
+		// the append only log was just created, so it has none of them - and it is what the next start
+		// restores from, so write them to it
+		if aof != nil && loaded > 0 {
+			if err := aof.StartRewrite(); err != nil {
+				fmt.Println("ERROR: failed to write snapshot keys to append only log,", err)
+			}
+		}
 	}
 
 	fmt.Println("Starting server at port " + *port + "...")
@@ -46,10 +149,6 @@ func main() {
 	// close binding after function exits
 	defer l.Close()
 
-	// instantiate cache
-	cache = lru.NewShardedLRU(constants.CAPACITY_PER_SHARD, constants.SHARD_COUNT)
-	defer cache.Cleanup()
-
 	// start a go routine to do snapshot every 5 minutes
 	t := time.NewTicker(constants.SNAPSHOT_INTERVAL)
 	snapshotStop := make(chan struct{})
@@ -58,7 +157,9 @@ func main() {
         for {
             select {
             case <-t.C:
-				cache.Snapshot("snapshot")
+				if err := snapshots.Save(); err != nil {
+					fmt.Println("ERROR: periodic snapshot failed,", err)
+				}
             case <-snapshotStop:
                 return
             }
@@ -66,15 +167,24 @@ func main() {
     }()
 	defer close(snapshotStop)
 
-	// if its a replica, first perform handshake with master
-	if ServerInfo.IsReplica {
-		masterConn, instChannel, err := handshakeMaster()
-		if err != nil {
-			fmt.Println("ERROR: master handshake failed, ", err)
+	if raftNode != nil {
+		raftNode.Start()
+		defer raftNode.Stop()
+	}
+	if clusterBus != nil {
+		if err := clusterBus.Start(); err != nil {
+			fmt.Println("ERROR:", err)
 			os.Exit(1)
 		}
-		go handleConnection(masterConn, instChannel)
+		defer clusterBus.Stop()
+	}
+
+	// if its a replica, keep a link to the master up (handshake, resync, reconnect when it drops)
+	if ServerInfo.IsReplica {
+		link = NewReplicationLink(ServerInfo.MasterAddress)
 	}
+	// and if its a master, keep the link to its replicas alive
+	go startReplicationHeartbeat()
 
 	// wait for an incoming TCP connection
 	for {
@@ -88,46 +198,11 @@ func main() {
 	}
 }
 
-// expects a "RESPONSE" once and then an "INSTRUCTION"
-func handshakeMaster() (net.Conn, chan Instruction, error) {
-	fmt.Println("Commencing handshake with master, at remote address: ", ServerInfo.MasterAddress)
-
-	// first, create tcp connection with master and start accepting reads from it
-	conn, err := net.Dial("tcp", ServerInfo.MasterAddress)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "error connecting to master")
-	}
-	instChannel := utils.ReadFromConn(conn, NewInstruction)
-
-	// send PING and check if PONG received
-	err = utils.WriteToConn(conn, Commands.STATUS)
-	if err != nil {
-		return nil, nil, err
-	}
-	response := <-instChannel
-	if response.Command != Responses.ALL_GOOD {
-		return nil, nil, errors.New("ERROR: master did not respond with a PONG")
-	}
-
-	// second, send the REPL_SYNC command to master and check if full sync received
-	err = utils.WriteToConn(conn, Commands.REPLICA_SYNC)
-	if err != nil {
-		return nil, nil, err
-	}
-	response = <-instChannel
-	if response.Command != Commands.FULL_SYNC {
-		return nil, nil, errors.New("ERROR: master did not respond with a FULLSYNC")
-	}
-	// TODO - actually do stuff with the RDB file later
-
-	// last, handle rest of connection
-	fmt.Println("Master connected:", conn.RemoteAddr())
-	return conn, instChannel, nil
-}
-
 // expects ONLY INSTRUCTIONS
 func handleConnection(conn net.Conn, instChannel chan Instruction) {
 	defer conn.Close()
+	defer forgetConnection(conn)
+	defer forgetAsking(conn)
 	fmt.Println("Client connected:", conn.RemoteAddr())
 	for inst := range instChannel {
 		inst.Run(conn)
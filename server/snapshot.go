@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"cadence/constants"
+
+	"github.com/pkg/errors"
+)
+
+// status of the last snapshot run
+const (
+	SnapshotOkay   = "ok"
+	SnapshotFailed = "err"
+)
+
+var snapshots = SnapshotState{lastSave: time.Now(), lastStatus: SnapshotOkay}
+
+// SNAPSHOT_STATE -----------------------------------------------------------------------------
+// guards against overlapping snapshot runs (SAVE, BGSAVE and the periodic one all share it)
+type SnapshotState struct {
+	inProgress bool
+	background bool
+	startTime  time.Time
+	lastSave   time.Time // time of the last successful snapshot (or startup)
+	lastStatus string
+	mutex      sync.Mutex
+}
+
+// private methods -------------
+func (state *SnapshotState) begin(background bool) error {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.inProgress {
+		return errors.New("a snapshot is already in progress")
+	}
+	state.inProgress = true
+	state.background = background
+	state.startTime = time.Now()
+	return nil
+}
+
+func (state *SnapshotState) run() error {
+	written, err := cache.Snapshot(constants.SNAPSHOT_FILE)
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.inProgress = false
+	if err != nil {
+		state.lastStatus = SnapshotFailed
+		return err
+	}
+	state.lastStatus = SnapshotOkay
+	state.lastSave = time.Now()
+	fmt.Printf("Snapshot of %d keys saved in %v.\n", written, time.Since(state.startTime))
+	return nil
+}
+
+// public methods -------------
+// takes a snapshot, blocking until it is written
+func (state *SnapshotState) Save() error {
+	if err := state.begin(false); err != nil {
+		return err
+	}
+	return state.run()
+}
+
+// starts taking a snapshot in the background
+func (state *SnapshotState) BackgroundSave() error {
+	if err := state.begin(true); err != nil {
+		return err
+	}
+	go func() {
+		if err := state.run(); err != nil {
+			fmt.Println("ERROR: background snapshot failed,", err)
+		}
+	}()
+	return nil
+}
+
+func (state *SnapshotState) LastSave() time.Time {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.lastSave
+}
+
+// persistence section of INFO
+func (state *SnapshotState) Info() []string {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	bgsaveInProgress, bgsaveSeconds := 0, -1
+	if state.inProgress && state.background {
+		bgsaveInProgress = 1
+		bgsaveSeconds = int(time.Since(state.startTime).Seconds())
+	}
+	return []string{
+		"rdb_bgsave_in_progress:" + strconv.Itoa(bgsaveInProgress),
+		"rdb_current_bgsave_time_sec:" + strconv.Itoa(bgsaveSeconds),
+		"rdb_last_save_time:" + strconv.FormatInt(state.lastSave.Unix(), 10),
+		"rdb_last_bgsave_status:" + state.lastStatus,
+	}
+}
@@ -3,21 +3,28 @@ package server
 import (
 	"fmt"
 	"net"
-	"slices"
 	"strings"
+	"sync"
 
 	"cadence/utils"
 )
 
 // SERVER_BASIC_INFO --------------------------------------------------------------------------
+// the role (IsReplica, MasterAddress) only changes with writeMutex and replicationMutex both held
 type ServerBasicInfo struct {
 	IsReplica     bool
 	MasterAddress string // empty string if not replica
 	Port          string
-	CurrentOffset int
+	ReplicationID string // id of the replication stream this node is on (a replica takes its master's), empty until synced
+	CurrentOffset int    // bytes of the replication stream produced (master) or applied (replica) so far
+
+	ReplicaReadOnly bool // if a replica, reject writes from anyone but the master
 }
 
 // INSTRUCTION --------------------------------------------------------------------------------
+// held while a write is applied, logged and propagated
+var writeMutex sync.Mutex
+
 type Instruction struct {
 	Command string
 	Args    []string
@@ -37,42 +44,86 @@ func (inst *Instruction) Validate() (bool, string) {
 func (inst *Instruction) Run(conn net.Conn) {
 	fmt.Print("Running inst: ")
 	inst.Print()
+	// the master doesn't read replies to its replication stream, so never send it any
+	fromMaster := isMasterLink(conn)
 	valid, errorMsg := inst.Validate()
+	errorCode := utils.ErrorCodes.ERR
+	if valid && rejectsWrites(cmdMap[strings.ToUpper(inst.Command)], fromMaster) {
+		valid, errorCode, errorMsg = false, utils.ErrorCodes.READONLY, "You can't write against a read only replica."
+	}
+	// in cluster mode, keys this node doesn't serve are redirected to the node that does
+	if valid && slots != nil && !fromMaster {
+		if keys := cmdMap[strings.ToUpper(inst.Command)].Keys; keys != nil {
+			if code, redirect := clusterRedirect(keys(inst.Args), conn); code != "" {
+				valid, errorCode, errorMsg = false, code, redirect
+			}
+		}
+	}
 	if !valid {
-		errorMsg = fmt.Sprintf("ERROR: %s", errorMsg)
-		fmt.Println(errorMsg)
-		utils.WriteToConn(conn, errorMsg)
+		fmt.Println("ERROR:", errorCode, errorMsg)
+		if !fromMaster {
+			conn.Write(utils.ErrorSerialize(errorCode, errorMsg))
+		}
 	} else {
-		executionFunc := cmdMap[strings.ToUpper(inst.Command)].Execute
-		conn.Write(executionFunc(inst.Args, conn))
-
-		// if need to propagate it, do a couple things:
-		// - propagate to replicas
-		// - increment your replica offset
-		// - append to log - should do this first regardless
-		// - only keep a log as long as the memory you would like to store - run compaction on it?
-		//  - perhaps, when you evict stuff from the thing, you append the evication to the log as well
-		// 					- and then you can run compaction on it
-		if slices.Contains(commandsToPropagate, inst.Command) {
-			fmt.Println("Propagate command to any replicas.")
-			// iterate through all replicas, and propagate
-			for i, replica := range replicas {
-				fmt.Println("Propagating to replica #", i)
-				// write to connection, but if doesn't work retry (TODO)
-				replica.connection.Write(inst.Serialize())
-				/**
-				TODO:
-				when make instruction better (e.g. args actually store type information), make instruction
-				also store the original command passed, so don't have to reconstruct it (POF)
-				**/
-			}
-
+		commandInfo := cmdMap[strings.ToUpper(inst.Command)]
+		var response []byte
+		if commandInfo.IsWrite && raftNode != nil {
+			response = proposeWrite(inst)
+		} else if commandInfo.IsWrite {
+			response = inst.applyWrite(commandInfo, conn, fromMaster)
+		} else {
+			response = commandInfo.Execute(inst.Args, conn)
+		}
+		if !fromMaster {
+			conn.Write(response)
 		}
 	}
 
 	fmt.Println("Done.")
 }
 
+// applies a write, logs it so it can be replayed after a crash, and propagates it to replicas.
+// writes do all three one at a time, so the log and replicas see them in exactly the order they were applied.
+func (inst *Instruction) applyWrite(commandInfo CommandInfo, conn net.Conn, fromMaster bool) []byte {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	if commandInfo.Keys != nil {
+		if redirect := waitForMigration(commandInfo.Keys(inst.Args)); redirect != nil {
+			return redirect
+		}
+	}
+	return inst.applyWriteLocked(commandInfo, conn, fromMaster)
+}
+
+// like applyWrite, for callers already holding writeMutex
+func (inst *Instruction) applyWriteLocked(commandInfo CommandInfo, conn net.Conn, fromMaster bool) []byte {
+	response := commandInfo.Execute(inst.Args, conn)
+	// a write that failed changed nothing, so there is nothing to log or propagate
+	if len(response) > 0 && response[0] == '-' {
+		return response
+	}
+	if aof != nil {
+		if err := aof.Append(inst); err != nil {
+			fmt.Println("ERROR: failed to write to append only log:", err)
+		}
+	}
+
+	// (the master's own stream is passed on as is by handleMasterConnection, and writes
+	// made directly on a writable replica stay local to it)
+	if !fromMaster && !ServerInfo.IsReplica {
+		fmt.Println("Propagate command to any replicas.")
+		propagate(inst)
+	}
+	// keys it evicted (or that expired while it ran) go after it
+	flushEvictions()
+	return response
+}
+
+// read only replicas only take writes from their master
+func rejectsWrites(commandInfo CommandInfo, fromMaster bool) bool {
+	return commandInfo.IsWrite && !fromMaster && ServerInfo.ReplicaReadOnly && isReplica()
+}
+
 func (inst *Instruction) Print() {
 	fmt.Println(inst.Command + " " + strings.Join(inst.Args, " "))
 }
@@ -97,19 +148,3 @@ func NewInstruction(rawParts []string) Instruction {
 	}
 	return Instruction{Command: rawParts[0], Args: rawParts[1:]}
 }
-
-// RESPONSE -------------------------------------------------------------------------------------------------
-type Response string
-
-func (r Response) Print() {
-	fmt.Println(string(r))
-}
-
-func (r Response) String() string {
-	return string(r)
-}
-
-func NewResponse(rawParts []string) Response {
-	return Response(strings.Join(rawParts, "\n"))
-}
-
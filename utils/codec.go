@@ -1,8 +1,13 @@
 package utils
 
 import (
+	"bufio"
+	"io"
 	"strconv"
 	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
 )
 
 func SimpleStringSerialize(s string) []byte {
@@ -30,6 +35,128 @@ func NilBulkString() []byte {
 	return []byte("$-1\r\n")
 }
 
+func IntegerSerialize(n int) []byte {
+	return []byte(":" + strconv.Itoa(n) + "\r\n")
+}
+
+// an array of already serialized values, which can be arrays themselves
+func ArraySerialize(elements [][]byte) []byte {
+	temp := []byte("*" + strconv.Itoa(len(elements)) + "\r\n")
+	for _, element := range elements {
+		temp = append(temp, element...)
+	}
+	return temp
+}
+
+func NilArray() []byte {
+	return []byte("*-1\r\n")
+}
+
+// codes error replies start with, so clients can tell what went wrong without reading the message
+var ErrorCodes = struct {
+	ERR         string
+	READONLY    string
+	MOVED       string
+	ASK         string
+	CLUSTERDOWN string
+	CROSSSLOT   string
+	NOTLEADER   string
+	IOERR       string
+}{
+	ERR:         "ERR",         // anything without a more specific code
+	READONLY:    "READONLY",    // a write sent to a read only replica
+	MOVED:       "MOVED",       // the key's slot is served by another node
+	ASK:         "ASK",         // the key's slot is being moved, and the key has already gone
+	CLUSTERDOWN: "CLUSTERDOWN", // no node serves the key's slot
+	CROSSSLOT:   "CROSSSLOT",   // the keys are in different slots
+	NOTLEADER:   "NOTLEADER",   // a write sent to a raft follower
+	IOERR:       "IOERR",       // a node couldn't be reached while running the command
+}
+
+// -CODE message\r\n, an error reply (it has to fit on one line, so line breaks in message become spaces)
+func ErrorSerialize(code string, message string) []byte {
+	message = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(message)
+	return []byte("-" + code + " " + message + "\r\n")
+}
+
+// ERROR_REPLY --------------------------------------------------------------------------------
+type RESPError struct {
+	Code    string
+	Message string // the rest of the line, after the code
+}
+
+func (e *RESPError) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + " " + e.Message
+}
+
+// the error in an error reply's line (without its leading -). the code is the first word if it is in
+// capitals, like every code this server sends - otherwise it is ERR, and the whole line is the message.
+func ParseError(line string) *RESPError {
+	code, message, _ := strings.Cut(line, " ")
+	if code == "" || strings.IndexFunc(code, func(r rune) bool { return !unicode.IsUpper(r) }) != -1 {
+		return &RESPError{Code: ErrorCodes.ERR, Message: line}
+	}
+	return &RESPError{Code: code, Message: message}
+}
+
+// RESP_VALUE ---------------------------------------------------------------------------------
+// a value read off a connection, of any RESP type
+type RESPValue struct {
+	Type  byte        // +, -, :, $ or *, the byte the value started with
+	Str   string      // a simple or bulk string
+	Int   int         // an integer
+	Array []RESPValue // an array's elements, which can be arrays themselves
+	Nil   bool        // a nil bulk string ($-1) or null array (*-1)
+	Err   *RESPError  // an error
+}
+
+// the value as text: a nil bulk string is NIL, a null array is empty, and an array is its elements one
+// per line (nested arrays on one line, their elements separated by spaces)
+func (v RESPValue) String() string {
+	return v.text(0)
+}
+
+func (v RESPValue) text(depth int) string {
+	switch v.Type {
+	case '-':
+		return v.Err.Error()
+	case ':':
+		return strconv.Itoa(v.Int)
+	case '$':
+		if v.Nil {
+			return "NIL"
+		}
+		return v.Str
+	case '*':
+		separator := "\n"
+		if depth > 0 {
+			separator = " "
+		}
+		elements := make([]string, len(v.Array))
+		for i, element := range v.Array {
+			elements[i] = element.text(depth + 1)
+		}
+		return strings.Join(elements, separator)
+	default:
+		return v.Str
+	}
+}
+
+// an array's elements as text, or the value as the only one if it isn't an array
+func (v RESPValue) Strings() []string {
+	if v.Type != '*' {
+		return []string{v.String()}
+	}
+	elements := make([]string, len(v.Array))
+	for i, element := range v.Array {
+		elements[i] = element.text(1)
+	}
+	return elements
+}
+
 func fullRESPDeserialize(serializedString string) [][]string {
 	ans := [][]string{}
 	return helper(serializedString, ans, 0)
@@ -128,4 +255,128 @@ func RESPDeserialize(s string) []string {
 	return ans
 }
 
+// reads one RESP bulk string array (the format instructions are serialized in) from a buffered reader
+// returns io.EOF if the reader is exhausted before the array starts, and io.ErrUnexpectedEOF if it ends midway
+func ReadBulkStringArray(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[0] != '*' {
+		return nil, errors.Errorf("expected bulk string array, got %q", line)
+	}
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length < 0 {
+		return nil, errors.Errorf("invalid array length %q", line[1:])
+	}
+
+	arr := make([]string, 0, length)
+	for i := 0; i < length; i++ {
+		line, err = readRESPLine(r)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if len(line) < 2 || line[0] != '$' {
+			return nil, errors.Errorf("expected bulk string, got %q", line)
+		}
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid bulk string length %q", line[1:])
+		}
+
+		// read the string along with its trailing \r\n
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return nil, errors.New("bulk string is not terminated by CRLF")
+		}
+		arr = append(arr, string(buf[:n]))
+	}
+	return arr, nil
+}
+
+// reads one value of any type (a reply) from a buffered reader - arrays are read the same way, so they can nest.
+// returns io.EOF if the reader is exhausted before the value starts, and io.ErrUnexpectedEOF if it ends midway
+func ReadValue(r *bufio.Reader) (RESPValue, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return RESPValue{}, err
+	}
+	if len(line) == 0 {
+		return RESPValue{}, errors.New("empty line where a value should start")
+	}
+	switch line[0] {
+	case '+':
+		return RESPValue{Type: '+', Str: line[1:]}, nil
+	case '-':
+		return RESPValue{Type: '-', Err: ParseError(line[1:])}, nil
+	case ':':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return RESPValue{}, errors.Errorf("invalid integer %q", line[1:])
+		}
+		return RESPValue{Type: ':', Int: n}, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return RESPValue{}, errors.Errorf("invalid bulk string length %q", line[1:])
+		}
+		if n < 0 {
+			return RESPValue{Type: '$', Nil: true}, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return RESPValue{}, unexpectedEOF(err)
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return RESPValue{}, errors.New("bulk string is not terminated by CRLF")
+		}
+		return RESPValue{Type: '$', Str: string(buf[:n])}, nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return RESPValue{}, errors.Errorf("invalid array length %q", line[1:])
+		}
+		if n < 0 {
+			return RESPValue{Type: '*', Nil: true}, nil
+		}
+		arr := make([]RESPValue, 0, n)
+		for i := 0; i < n; i++ {
+			element, err := ReadValue(r)
+			if err != nil {
+				return RESPValue{}, unexpectedEOF(err)
+			}
+			arr = append(arr, element)
+		}
+		return RESPValue{Type: '*', Array: arr}, nil
+	default:
+		return RESPValue{}, errors.Errorf("unknown RESP type %q", line[0])
+	}
+}
+
+// reads a single \r\n terminated line, without the terminator
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.Errorf("line %q is not terminated by CRLF", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// once part of a value has been read, running out of input means the value was truncated
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 // later implement Serialize
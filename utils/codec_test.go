@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadValue(t *testing.T) {
+	bulk := func(s string) RESPValue { return RESPValue{Type: '$', Str: s} }
+	integer := func(n int) RESPValue { return RESPValue{Type: ':', Int: n} }
+	array := func(elements ...RESPValue) RESPValue {
+		return RESPValue{Type: '*', Array: append([]RESPValue{}, elements...)}
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		want  RESPValue
+		text  string // what String gives for it
+	}{
+		{"simple string", "+OK\r\n", RESPValue{Type: '+', Str: "OK"}, "OK"},
+		{"empty simple string", "+\r\n", RESPValue{Type: '+'}, ""},
+		{"error", "-ERR Invalid command.\r\n", RESPValue{Type: '-', Err: &RESPError{Code: "ERR", Message: "Invalid command."}}, "ERR Invalid command."},
+		{"redirect", "-MOVED 3999 127.0.0.1:6381\r\n", RESPValue{Type: '-', Err: &RESPError{Code: "MOVED", Message: "3999 127.0.0.1:6381"}}, "MOVED 3999 127.0.0.1:6381"},
+		{"error with only a code", "-NOTLEADER\r\n", RESPValue{Type: '-', Err: &RESPError{Code: "NOTLEADER"}}, "NOTLEADER"},
+		{"error without a code", "-oops something broke\r\n", RESPValue{Type: '-', Err: &RESPError{Code: "ERR", Message: "oops something broke"}}, "ERR oops something broke"},
+		{"zero", ":0\r\n", integer(0), "0"},
+		{"integer", ":42\r\n", integer(42), "42"},
+		{"negative integer", ":-7\r\n", integer(-7), "-7"},
+		{"bulk string", "$5\r\nhello\r\n", bulk("hello"), "hello"},
+		{"empty bulk string", "$0\r\n\r\n", bulk(""), ""},
+		{"bulk string with CRLF in it", "$4\r\na\r\nb\r\n", bulk("a\r\nb"), "a\r\nb"},
+		{"nil bulk string", "$-1\r\n", RESPValue{Type: '$', Nil: true}, "NIL"},
+		{"empty array", "*0\r\n", array(), ""},
+		{"null array", "*-1\r\n", RESPValue{Type: '*', Nil: true}, ""},
+		{"array", "*3\r\n$1\r\na\r\n:2\r\n$-1\r\n", array(bulk("a"), integer(2), RESPValue{Type: '$', Nil: true}), "a\n2\nNIL"},
+		{"array with an error in it", "*2\r\n-ERR x\r\n+OK\r\n", array(RESPValue{Type: '-', Err: &RESPError{Code: "ERR", Message: "x"}}, RESPValue{Type: '+', Str: "OK"}), "ERR x\nOK"},
+		{"nested arrays", "*2\r\n*2\r\n:0\r\n:5\r\n*1\r\n$1\r\nb\r\n", array(array(integer(0), integer(5)), array(bulk("b"))), "0 5\nb"},
+		{"nested null array", "*2\r\n*-1\r\n:1\r\n", array(RESPValue{Type: '*', Nil: true}, integer(1)), "\n1"},
+		{"deeply nested", "*1\r\n*1\r\n*1\r\n:9\r\n", array(array(array(integer(9)))), "9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// followed by another value, which must be left for the next read
+			r := bufio.NewReader(strings.NewReader(tt.input + "+NEXT\r\n"))
+			got, err := ReadValue(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+			if text := got.String(); text != tt.text {
+				t.Fatalf("String() = %q, want %q", text, tt.text)
+			}
+			if next, err := ReadValue(r); err != nil || next.Str != "NEXT" {
+				t.Fatalf("next read got %#v (%v), want NEXT", next, err)
+			}
+		})
+	}
+}
+
+func TestReadValueMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   error  // the error it should be, if it's a sentinel
+		msg   string // otherwise, what it should say
+	}{
+		{"nothing", "", io.EOF, ""},
+		{"line without its end", "+OK", io.ErrUnexpectedEOF, ""},
+		{"line ending in LF only", "+OK\n", nil, "not terminated by CRLF"},
+		{"empty line", "\r\n", nil, "empty line"},
+		{"unknown type", "?x\r\n", nil, "unknown RESP type"},
+		{"no type byte", "OK\r\n", nil, "unknown RESP type"},
+		{"integer that isn't one", ":abc\r\n", nil, "invalid integer"},
+		{"integer with nothing in it", ":\r\n", nil, "invalid integer"},
+		{"bad bulk string length", "$abc\r\n", nil, "invalid bulk string length"},
+		{"bulk string cut short", "$5\r\nhel", io.ErrUnexpectedEOF, ""},
+		{"bulk string without its CRLF", "$5\r\nhello", io.ErrUnexpectedEOF, ""},
+		{"bulk string longer than its length", "$3\r\nhello\r\n", nil, "not terminated by CRLF"},
+		{"bad array length", "*x\r\n", nil, "invalid array length"},
+		{"array missing elements", "*2\r\n:1\r\n", io.ErrUnexpectedEOF, ""},
+		{"array with an element cut short", "*2\r\n:1\r\n$3\r\nab", io.ErrUnexpectedEOF, ""},
+		{"nested array missing elements", "*1\r\n*1\r\n", io.ErrUnexpectedEOF, ""},
+		{"array with a bad element", "*2\r\n:1\r\n?\r\n", nil, "unknown RESP type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadValue(bufio.NewReader(strings.NewReader(tt.input)))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.msg) {
+				t.Fatalf("got error %v, want one saying %q", err, tt.msg)
+			}
+		})
+	}
+}
@@ -18,7 +18,7 @@ func readRawDataFromConnection(rawDataChannel chan<- string, conn net.Conn) {
 		n, err := conn.Read(buffer)
 		// fmt.Println("Recieved bytes:", string(buffer))
 		if err != nil {
-			if err == io.EOF {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
 				fmt.Println("CONNECTION_STATUS: Connection closed...")
 				break
 			} else {
@@ -31,7 +31,7 @@ func readRawDataFromConnection(rawDataChannel chan<- string, conn net.Conn) {
 	defer close(rawDataChannel) // close channel at end
 }
 
-func interpretRecievedBytes[T any](rawDataChannel <-chan string, dataChannel chan<- T, dataCtor func([]string) T) {
+func interpretRecievedBytes[T any](rawDataChannel <-chan string, dataChannel chan<- T, dataCtor func(RESPValue) T) {
 	defer close(dataChannel)
 	var data = ""
 	var i = 0
@@ -87,88 +87,98 @@ func interpretRecievedBytes[T any](rawDataChannel <-chan string, dataChannel cha
 		return n, nil
 	}
 
-	// iterate over the data channel
-	for {
-		// either gonna start with + (simple string), $ (bulk string), * (array of bulk strings)
+	var readLine = func() string {
+		temp := ""
+		t := getNextChars(1)
+		for !channelDead && t[0] != '\r' {
+			temp += t
+			t = getNextChars(1)
+		}
+		getNextChars(1) // skip \n that should come after
+		return temp
+	}
+
+	// reads one value of any type - an array reads its elements the same way, so arrays can nest
+	var readValue func() (RESPValue, error)
+	readValue = func() (RESPValue, error) {
 		firstChar := getNextChars(1)
 		if channelDead {
-			return
+			return RESPValue{}, errors.New("channel died")
 		}
 		switch firstChar[0] {
 		case '+':
-			// fmt.Println("Interpreting simple string.")
-			temp := ""
-			t := getNextChars(1)
-			for !channelDead && t[0] != '\r' {
-				temp += t
-				t = getNextChars(1)
-			}
-			getNextChars(1) // skip \n that should come after
-			if channelDead {
-				return
+			return RESPValue{Type: '+', Str: readLine()}, nil
+		case '-':
+			return RESPValue{Type: '-', Err: ParseError(readLine())}, nil
+		case ':':
+			line := readLine()
+			n, err := strconv.Atoi(line)
+			if err != nil {
+				return RESPValue{}, errors.Errorf("invalid integer %q", line)
 			}
-			// fmt.Println("Simple string is:", temp)
-			dataChannel <- dataCtor([]string{temp})
+			return RESPValue{Type: ':', Int: n}, nil
 		case '$':
-			// fmt.Println("Interpreting bulk string.")
 			length, err := lengthExtractor()
 			if err != nil {
-				continue
-			}
-			var bulkString string
-			if length >= 0 {
-				bulkString = getNextChars(length)
-				getNextChars(2)
-			} else if length == -1 {
-				bulkString = "NIL"
+				return RESPValue{}, err
 			}
-			if channelDead {
-				return
+			if length < 0 {
+				return RESPValue{Type: '$', Nil: true}, nil
 			}
-			// fmt.Println("Bulk string is:", bulkString)
-			dataChannel <- dataCtor([]string{bulkString})
+			bulkString := getNextChars(length)
+			getNextChars(2) // skip over \r\n
+			return RESPValue{Type: '$', Str: bulkString}, nil
 		case '*':
-			// fmt.Println("Interpreting bulk string array.")
-
-			// extract length of array
-			arrLength, err := lengthExtractor()
+			length, err := lengthExtractor()
 			if err != nil {
-				// fmt.Println("CRY CRY CRY")
-				continue
+				return RESPValue{}, err
+			}
+			if length < 0 {
+				return RESPValue{Type: '*', Nil: true}, nil
 			}
-			arr := []string{}
-			for i := 0; i < arrLength; i++ {
-				getNextChars(1) // remove $ from way
-				length, err := lengthExtractor()
+			arr := make([]RESPValue, 0, length)
+			for i := 0; i < length; i++ {
+				element, err := readValue()
 				if err != nil {
-					continue
-				}
-				bulkString := getNextChars(length)
-				if channelDead {
-					return
-				}
-				arr = append(arr, bulkString)
-				// skip over \r\n
-				getNextChars(2)
-				if channelDead {
-					return
+					return RESPValue{}, err
 				}
+				arr = append(arr, element)
 			}
-
-			// fmt.Println("Bulk string array is:", arr)
-			dataChannel <- dataCtor(arr)
+			return RESPValue{Type: '*', Array: arr}, nil
 		default:
-			fmt.Println("I DONT KNOW WHAT KIND OF THING YOU GAVE ME :SOB:")
+			return RESPValue{}, errors.Errorf("unknown RESP type %q", firstChar)
+		}
+	}
+
+	// iterate over the data channel
+	for {
+		// either gonna start with + (simple string), - (error), : (integer), $ (bulk string), * (array)
+		value, err := readValue()
+		if channelDead {
+			return
+		}
+		if err != nil {
+			fmt.Println("I DONT KNOW WHAT KIND OF THING YOU GAVE ME :SOB:", err)
 			continue
 		}
+		dataChannel <- dataCtor(value)
 	}
 }
 
+// reads values as flat lists of strings, which is what requests are - anything else is passed on as
+// text (see RESPValue.Strings)
 func ReadFromConn[T any](conn net.Conn, dataCtor func([]string) T) chan T {
+	return ReadRepliesFromConn(conn, func(value RESPValue) T {
+		return dataCtor(value.Strings())
+	})
+}
+
+// like ReadFromConn, for replies - which can be of any type, so replyCtor gets them whole
+func ReadRepliesFromConn[T any](conn net.Conn, replyCtor func(RESPValue) T) chan T {
 	rawDataChannel := make(chan string)
 	dataChannel := make(chan T)
 	go readRawDataFromConnection(rawDataChannel, conn)
-	go interpretRecievedBytes(rawDataChannel, dataChannel, dataCtor)
+	go interpretRecievedBytes(rawDataChannel, dataChannel, replyCtor)
 	return dataChannel
 }
 